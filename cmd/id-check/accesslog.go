@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/mygaru/id-check/pkg/accesslog"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/mygaru/id-check/pkg/requestid"
+	"github.com/valyala/fasthttp"
+	"time"
+)
+
+// logAccess writes the served request to the access log.
+func logAccess(ctx *fasthttp.RequestCtx, upstreamLatency time.Duration) {
+	if !accesslog.Enabled() {
+		return
+	}
+
+	e := accesslog.Entry{
+		Time:            ctx.Time(),
+		ClientIP:        mtls.ClientIP(ctx).String(),
+		Method:          string(ctx.Method()),
+		URI:             string(ctx.RequestURI()),
+		Proto:           string(ctx.Request.Header.Protocol()),
+		Status:          ctx.Response.StatusCode(),
+		RequestBytes:    len(ctx.Request.Body()),
+		ResponseBytes:   len(ctx.Response.Body()),
+		Duration:        time.Since(ctx.Time()),
+		UpstreamLatency: upstreamLatency,
+		Referer:         string(ctx.Referer()),
+		UserAgent:       string(ctx.UserAgent()),
+		RequestID:       requestid.Get(ctx),
+	}
+
+	if cs := ctx.TLSConnectionState(); cs != nil {
+		e.TLSVersion = tls.VersionName(cs.Version)
+		e.CipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+	}
+	if certs := mtls.PeerCertificates(ctx); len(certs) > 0 {
+		e.CommonName = certs[0].Subject.CommonName
+		e.Serial = certs[0].SerialNumber.String()
+	}
+
+	accesslog.Log(e)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/audit"
+	"github.com/mygaru/id-check/pkg/signing"
+	"io/fs"
+	"os"
+)
+
+const auditUsage = `usage: id-check audit verify -log=/path/to/audit.log [-key=/path/to/public.pem] [-head=/path/to/audit.log.head] [-strict]`
+
+// runAudit implements the "audit" subcommand and returns the process exit code.
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, auditUsage)
+		return 2
+	}
+
+	cmd := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	logPath := cmd.String("log", "", "Path to the audit log")
+	keyPath := cmd.String("key", "", "Path to the PEM public key or certificate matching auditSigningKeyPath; without it signatures are not checked")
+	headPath := cmd.String("head", "", "Path to the head file; defaults to the log path + "+audit.HeadSuffix)
+	strict := cmd.Bool("strict", false, "Fail when the log ends with records not covered by a signed checkpoint")
+
+	if err := cmd.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *logPath == "" {
+		fmt.Fprintln(os.Stderr, auditUsage)
+		return 2
+	}
+
+	res, err := verifyAuditLog(*logPath, *keyPath, *headPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit verify: %s\n", err)
+		return 2
+	}
+
+	for _, p := range res.Problems {
+		fmt.Printf("FAIL: %s\n", p)
+	}
+
+	fmt.Printf("%d records, %d checkpoints, %d records after the last checkpoint\n", res.Records, res.Checkpoints, res.Unsigned)
+
+	if !res.OK() {
+		return 1
+	}
+	if *strict && res.Unsigned > 0 {
+		fmt.Println("FAIL: log ends with unsigned records")
+		return 1
+	}
+
+	fmt.Println("OK")
+	return 0
+}
+
+func verifyAuditLog(logPath, keyPath, headPath string) (*audit.VerifyResult, error) {
+	var pub crypto.PublicKey
+	if keyPath != "" {
+		k, err := signing.LoadPublicKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		pub = k
+	}
+
+	if headPath == "" {
+		headPath = logPath + audit.HeadSuffix
+	}
+
+	head, err := audit.ReadHead(headPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("WARN: no head file at %s, truncation of the log tail cannot be detected\n", headPath)
+		head = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return audit.Verify(f, pub, head)
+}
@@ -1,55 +1,233 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"github.com/mygaru/id-check/pkg/accesslog"
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/mygaru/id-check/pkg/allowlist"
+	"github.com/mygaru/id-check/pkg/audit"
+	"github.com/mygaru/id-check/pkg/authz"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/mygaru/id-check/pkg/forwarded"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metering"
+	"github.com/mygaru/id-check/pkg/metrics"
 	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/mygaru/id-check/pkg/peers"
+	"github.com/mygaru/id-check/pkg/pinning"
+	"github.com/mygaru/id-check/pkg/problem"
+	"github.com/mygaru/id-check/pkg/quota"
+	"github.com/mygaru/id-check/pkg/requestid"
+	"github.com/mygaru/id-check/pkg/route"
+	"github.com/mygaru/id-check/pkg/scopes"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/mygaru/id-check/pkg/tenant"
+	"github.com/mygaru/id-check/pkg/tracing"
 	"github.com/valyala/fasthttp"
 	"github.com/vharitonsky/iniflags"
-	"log"
+	"log/slog"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
 var (
 	forwardTrafficAddr = flag.String("idCheckForwardTrafficAddr", "", "Where you want the Auth MW to forward your request to...")
 	forwardTimeout     = flag.Duration("idCheckForwardTimeout", 5*time.Second, "How long to wait for forwarded request")
+	forwardMaxConns    = flag.Int("idCheckForwardMaxConns", fasthttp.DefaultMaxConnsPerHost, "Max connections to the upstream")
+)
+
+var (
+	mainLog       = logger.For(logger.ComponentMain)
+	forwardingLog = logger.For(logger.ComponentForwarding)
+)
+
+var (
+	forwardURL     *url.URL
+	upstreamClient *fasthttp.HostClient
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		os.Exit(runSnapshot(os.Args[2:]))
+	}
+
 	iniflags.Parse()
+	if err := logger.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize logging", "err", err)
+	}
 	logAllFlags()
 
-	log.Printf("Initializing...")
-	// :'( empty
-	log.Printf("Initialized.")
+	mainLog.Info("Initializing...")
+	parsed, err := url.Parse(*forwardTrafficAddr)
+	if err != nil {
+		logger.Fatal(mainLog, "Failed to parse forwardTrafficAddr", "err", err)
+	}
+	forwardURL = parsed
+	upstreamClient = &fasthttp.HostClient{Addr: parsed.Host, MaxConns: *forwardMaxConns}
+	initMetrics()
 
-	mtls.RunServer(requestHandler)
+	if err := quota.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize quotas", "err", err)
+	}
+	if err := metering.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize usage metering", "err", err)
+	}
+	if err := audit.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize audit log", "err", err)
+	}
+	if err := tracing.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize tracing", "err", err)
+	}
+	if err := forwarded.Init(); err != nil {
+		logger.Fatal(mainLog, "Invalid forwarding header settings", "err", err)
+	}
+	if err := requestid.Validate(); err != nil {
+		logger.Fatal(mainLog, "Invalid request ID settings", "err", err)
+	}
+	denylist.OnChange(closeDeniedConnections)
+	if err := denylist.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize denylist", "err", err)
+	}
+	if err := peers.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize peer cache sharing", "err", err)
+	}
+	if err := allowlist.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize allowlist", "err", err)
+	}
+	if err := pinning.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize key pinning", "err", err)
+	}
+	if err := scopes.Init(); err != nil {
+		logger.Fatal(mainLog, "Invalid scope extension settings", "err", err)
+	}
+	if err := spiffe.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to load SPIFFE trust bundles", "err", err)
+	}
+	if err := authz.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize route authorization", "err", err)
+	}
+	if err := tenant.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize tenant mapping", "err", err)
+	}
+	if err := accesslog.Init(); err != nil {
+		logger.Fatal(mainLog, "Failed to initialize access log", "err", err)
+	}
+
+	admin.Handle("/quota", quota.AdminHandler)
+	admin.Handle("/handshakes/failures", mtls.HandshakeFailuresHandler)
+	admin.Handle("/metrics", metrics.Handler)
+	admin.Handle("/tenants", tenant.AdminHandler)
+	admin.Handle("/denylist", denylist.AdminHandler)
+	go admin.RunServer()
+	if mtls.FrontProxyEnabled() {
+		go mtls.RunFrontProxyServer(requestHandler)
+	}
+	go mtls.RunServer(requestHandler)
+	mainLog.Info("Initialized.")
+
+	awaitShutdown()
 }
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
 	path := string(ctx.Path())
 
-	// todo do this only once on init
-	parsed, err := url.Parse(*forwardTrafficAddr)
-	if err != nil {
-		log.Fatalf("Failed to parse forwardTrafficAddr: %v", err)
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	peerCert := mtls.PeerCertificates(ctx)[0]
+	id := identity.FromCertificate(peerCert)
+	id.IssuerDomain = mtls.IssuerDomain(ctx)
+
+	requestID := requestid.Assign(ctx, id.Name())
+	logger.AddRequestAttrs(ctx,
+		slog.String("requestId", requestID),
+		slog.String("cn", id.CommonName),
+		slog.String("serial", id.Serial),
+		slog.String("issuerDomain", id.IssuerDomain),
+	)
+	if !id.SPIFFEID.IsZero() {
+		logger.AddRequestAttrs(ctx, slog.String("spiffeId", id.SPIFFEID.String()))
+	}
+	if h := mtls.ProxyHeader(ctx.Conn()); h != nil && len(h.UniqueID()) > 0 {
+		logger.AddRequestAttrs(ctx, slog.String("balancerConnId", hex.EncodeToString(h.UniqueID())))
+	}
+
+	// rejected requests are accounted as well, once the client is authenticated
+	var upstreamLatency time.Duration
+	defer func() {
+		recordRequest(ctx, peerCert, id, upstreamLatency)
+		logAccess(ctx, upstreamLatency)
+	}()
+
+	if !denylist.Check(ctx, id, denylist.StageRequest) {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "certificate is denied")
+		return
+	}
+	if !allowlist.Allowed(ctx, id, mtls.ClientIP(ctx)) {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "client IP is not allowed for this identity")
+		return
+	}
+	if !pinning.Check(ctx, id, mtls.ClientIP(ctx).String()) {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "certificate key is not pinned for this identity")
+		return
+	}
+	if !authz.Allowed(ctx, id, string(ctx.Method()), path) {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "identity is not authorized for this route")
+		return
+	}
+	tenantAttrs, ok := tenant.Resolve(ctx, id)
+	if !ok {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "certificate is not mapped to a tenant")
+		return
 	}
-	client := fasthttp.HostClient{Addr: parsed.Host}
 
 	switch path {
 	case "/test", "/test/":
 		_, _ = fmt.Fprintf(ctx, "Hello World!")
 
 	default:
-		peerCert := ctx.TLSConnectionState().PeerCertificates[0]
+		span := startRequestSpan(ctx, id)
+
+		defer finishRequestSpan(ctx, span)
+
+		if resetAt, ok := quota.Allow(id.IssuerDomain, id.Name(), path, time.Now()); !ok {
+			forwardingLog.DebugContext(ctx, "Quota exceeded", "path", path, "resetAt", resetAt)
+			ctx.Response.Header.Set("X-Quota-Reset", resetAt.Format(time.RFC3339))
+			ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, fmt.Sprintf("%d", int(time.Until(resetAt).Seconds())+1))
+			problem.Write(ctx, fasthttp.StatusTooManyRequests, "Quota exceeded", "quota resets at "+resetAt.Format(time.RFC3339))
+			return
+		}
 
 		req := fasthttp.AcquireRequest()
 		resp := fasthttp.AcquireResponse()
 
 		ctx.Request.CopyTo(req)
+		forwarded.Apply(ctx, req)
 
-		req.Header.Set("X-ClientID", peerCert.Subject.CommonName)
+		req.Header.Set("X-ClientID", id.Name())
+		req.Header.Set("X-Client-Issuer-Domain", id.IssuerDomain)
+		tenant.SetHeaders(req, tenantAttrs)
+		if len(id.Scopes) == 0 {
+			req.Header.Del(scopes.Header())
+		} else {
+			req.Header.Set(scopes.Header(), strings.Join(id.Scopes, " "))
+		}
+		if id.SPIFFEID.IsZero() {
+			req.Header.Del("X-Client-SPIFFE-ID")
+		} else {
+			req.Header.Set("X-Client-SPIFFE-ID", id.SPIFFEID.String())
+		}
+		req.Header.Set(requestid.Header(), requestID)
 
 		ogQueryPArams := ctx.QueryArgs().String()
 
@@ -59,30 +237,98 @@ func requestHandler(ctx *fasthttp.RequestCtx) {
 			req.SetRequestURI(*forwardTrafficAddr + string(ctx.Path()))
 		}
 
-		if ctx.IsTLS() && parsed.Scheme == "http" {
+		if ctx.IsTLS() && forwardURL.Scheme == "http" {
 			req.URI().SetScheme("http")
 		}
 
-		req.Header.SetHost(parsed.Host)
+		req.Header.SetHost(forwardURL.Host)
 
 		defer func() {
 			fasthttp.ReleaseRequest(req)
 			fasthttp.ReleaseResponse(resp)
 		}()
 
-		err := client.DoTimeout(req, resp, *forwardTimeout)
+		upstreamSpan := startUpstreamSpan(span, req)
+
+		startedAt := time.Now()
+		err := upstreamClient.DoTimeout(req, resp, *forwardTimeout)
+		upstreamLatency = time.Since(startedAt)
+
+		upstreamSpan.SetError(err)
+		upstreamSpan.SetAttribute("http.response.status_code", resp.StatusCode())
+		upstreamSpan.Finish()
+
 		if err != nil {
-			ctx.Error(fmt.Sprintf("request failed: %s", err), fasthttp.StatusBadRequest)
+			forwardingLog.WarnContext(ctx, "Upstream request failed", "path", path, "err", err)
+			problem.Write(ctx, fasthttp.StatusBadRequest, "Request failed", err.Error())
 			return
 		}
 
+		quota.AddBytes(id.IssuerDomain, id.Name(), path, int64(len(req.Body())+len(resp.Body())), time.Now())
+
 		ctx.SetStatusCode(resp.StatusCode())
 		ctx.SetBody(resp.Body())
 	}
 }
 
+// closeDeniedConnections closes open connections whose certificate is on the denylist, once their in-flight request is answered.
+func closeDeniedConnections() {
+	closing := mtls.CloseConnections(func(leaf *x509.Certificate, issuerDomain string) bool {
+		id := identity.FromCertificate(leaf)
+		id.IssuerDomain = issuerDomain
+		_, denied := denylist.Lookup(id)
+		return denied
+	}, mtls.DisconnectDenylist)
+	if closing > 0 {
+		mainLog.Warn("Closing connections of denied certificates", "connections", closing)
+	}
+}
+
+// recordRequest accounts an authenticated request in metrics, usage metering and the audit log.
+func recordRequest(ctx *fasthttp.RequestCtx, peerCert *x509.Certificate, id identity.Identity, upstreamLatency time.Duration) {
+	observeRequest(ctx, id, upstreamLatency)
+
+	metering.Add(metering.Record{
+		Timestamp:       ctx.Time(),
+		Identity:        id.Name(),
+		IssuerDomain:    id.IssuerDomain,
+		CommonName:      id.CommonName,
+		Serial:          id.Serial,
+		Route:           route.Of(string(ctx.Path())),
+		Method:          string(ctx.Method()),
+		Status:          ctx.Response.StatusCode(),
+		RequestBytes:    int64(len(ctx.Request.Body())),
+		ResponseBytes:   int64(len(ctx.Response.Body())),
+		UpstreamLatency: upstreamLatency,
+	})
+
+	if audit.Enabled() {
+		verdict, _ := mtls.CachedVerdict(id.IssuerDomain, id.Serial)
+
+		audit.Log(audit.Record{
+			Type:              audit.TypeRequest,
+			RequestID:         requestid.Get(ctx),
+			CommonName:        id.CommonName,
+			SPIFFEID:          id.SPIFFEID.String(),
+			IssuerDomain:      id.IssuerDomain,
+			Serial:            id.Serial,
+			Fingerprint:       identity.CertificateFingerprint(peerCert),
+			ReputationVerdict: verdict.Status,
+			ClientIP:          mtls.ClientIP(ctx).String(),
+			Method:            string(ctx.Method()),
+			Path:              string(ctx.Path()),
+			Status:            ctx.Response.StatusCode(),
+			BodySHA256:        audit.BodySHA256(ctx.Request.Body()),
+			DurationMs:        time.Since(ctx.Time()).Milliseconds(),
+			UpstreamMs:        upstreamLatency.Milliseconds(),
+		})
+	}
+}
+
 func logAllFlags() {
+	// every flag shares the message, it must not be sampled
+	ctx := logger.Unsampled(context.Background())
 	flag.VisitAll(func(f *flag.Flag) {
-		log.Printf("FLAG: --%s=%s", f.Name, f.Value)
+		mainLog.InfoContext(ctx, "FLAG", "name", f.Name, "value", f.Value.String())
 	})
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/route"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"time"
+)
+
+var (
+	metricsMaxIdentities = flag.Int("idCheckMetricsMaxIdentities", 100, "How many distinct identities get their own label value in request metrics; "+
+		"the rest are reported as \"other\". 0 reports every identity as \"other\"")
+	metricsMaxRoutes = flag.Int("idCheckMetricsMaxRoutes", 50, "How many distinct routes get their own label value in request metrics; the rest are reported as \"other\"")
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("idcheck_requests_total",
+		"Authenticated requests by route, status, identity and issuer domain", "route", "status", "identity", "issuer_domain")
+	requestDuration = metrics.NewHistogramVec("idcheck_request_duration_seconds",
+		"Duration of authenticated requests by route, status, identity and issuer domain", metrics.DurationBuckets, "route", "status", "identity", "issuer_domain")
+	upstreamDuration = metrics.NewHistogramVec("idcheck_upstream_duration_seconds",
+		"Duration of upstream calls by route", metrics.DurationBuckets, "route")
+	requestBodySize = metrics.NewHistogramVec("idcheck_request_body_bytes",
+		"Size of request bodies by route", metrics.SizeBuckets, "route")
+	responseBodySize = metrics.NewHistogramVec("idcheck_response_body_bytes",
+		"Size of response bodies by route", metrics.SizeBuckets, "route")
+	requestsInFlight = metrics.NewGauge("idcheck_requests_in_flight",
+		"Requests currently being handled")
+
+	identityLabels = &metrics.LabelLimiter{}
+	routeLabels    = &metrics.LabelLimiter{}
+)
+
+func initMetrics() {
+	identityLabels.Max = *metricsMaxIdentities
+	routeLabels.Max = *metricsMaxRoutes
+
+	metrics.NewGaugeFunc("idcheck_upstream_connections", "Open connections to the upstream", func() float64 {
+		return float64(upstreamClient.ConnsCount())
+	})
+	metrics.NewGaugeFunc("idcheck_upstream_max_connections", "Connection limit of the upstream pool", func() float64 {
+		if upstreamClient.MaxConns > 0 {
+			return float64(upstreamClient.MaxConns)
+		}
+		return fasthttp.DefaultMaxConnsPerHost
+	})
+}
+
+func observeRequest(ctx *fasthttp.RequestCtx, id identity.Identity, upstreamLatency time.Duration) {
+	r := routeLabels.Value(route.Of(string(ctx.Path())))
+	status := strconv.Itoa(ctx.Response.StatusCode())
+	who := identityLabels.Value(id.Name())
+
+	// issuer domains are the configured trust bundles, their number is bounded
+	requestsTotal.With(r, status, who, id.IssuerDomain).Inc()
+	requestDuration.With(r, status, who, id.IssuerDomain).ObserveSince(ctx.Time())
+	if upstreamLatency > 0 {
+		upstreamDuration.With(r).Observe(upstreamLatency.Seconds())
+	}
+	requestBodySize.With(r).Observe(float64(len(ctx.Request.Body())))
+	responseBodySize.With(r).Observe(float64(len(ctx.Response.Body())))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"github.com/mygaru/id-check/pkg/metering"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/mygaru/id-check/pkg/quota"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second, "How long in-flight requests are waited for on SIGINT or SIGTERM before "+
+	"quota counters and the usage rollup are persisted and the process exits")
+
+// awaitShutdown blocks until SIGINT or SIGTERM, then stops accepting client connections, waits for in-flight requests
+// up to shutdownTimeout and persists the state kept in memory.
+func awaitShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	mainLog.Info("Shutting down...", "signal", sig.String())
+
+	drained := make(chan struct{})
+	go func() {
+		mtls.Shutdown()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(*shutdownTimeout):
+		mainLog.Warn("In-flight requests did not finish before shutdownTimeout", "shutdownTimeout", *shutdownTimeout)
+	}
+
+	if err := quota.Flush(); err != nil {
+		mainLog.Error("Failed to persist quota counters", "err", err)
+	}
+	if err := metering.Flush(time.Now()); err != nil {
+		mainLog.Error("Failed to flush usage rollup", "err", err)
+	}
+
+	mainLog.Info("Stopped.")
+}
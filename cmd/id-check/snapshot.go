@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"github.com/mygaru/id-check/pkg/revsnapshot"
+	"github.com/mygaru/id-check/pkg/signing"
+	"os"
+	"strings"
+	"time"
+)
+
+const snapshotUsage = `usage: id-check snapshot build -key=/path/to/signing.key -serials=/path/to/revoked.txt -out=/path/to/snapshot.json [-issuer=mygaru] [-sequence=N] [-validity=168h]
+       id-check snapshot verify -key=/path/to/public.pem -in=/path/to/snapshot.json`
+
+// runSnapshot implements the "snapshot" subcommand and returns the process exit code.
+func runSnapshot(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, snapshotUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "build":
+		return buildSnapshot(args[1:])
+	case "verify":
+		return verifySnapshot(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, snapshotUsage)
+		return 2
+	}
+}
+
+func buildSnapshot(args []string) int {
+	cmd := flag.NewFlagSet("snapshot build", flag.ContinueOnError)
+	keyPath := cmd.String("key", "", "Path to the PEM private key signing the snapshot")
+	serialsPath := cmd.String("serials", "", `Path to the revoked certificates, one "serial[,reason]" per line; - reads stdin`)
+	outPath := cmd.String("out", "", "Where to write the snapshot")
+	issuer := cmd.String("issuer", "mygaru", "Name of the CA the snapshot is issued for")
+	sequence := cmd.Uint64("sequence", 0, "Sequence number, which must increase with every snapshot; 0 uses the current Unix time")
+	validity := cmd.Duration("validity", 7*24*time.Hour, "How long the snapshot is valid")
+
+	if err := cmd.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" || *serialsPath == "" || *outPath == "" {
+		fmt.Fprintln(os.Stderr, snapshotUsage)
+		return 2
+	}
+
+	signer, err := signing.LoadPrivateKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot build: %s\n", err)
+		return 2
+	}
+	revoked, err := readRevokedSerials(*serialsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot build: %s\n", err)
+		return 2
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if *sequence == 0 {
+		*sequence = uint64(now.Unix())
+	}
+	s := revsnapshot.Snapshot{
+		Issuer:    *issuer,
+		Sequence:  *sequence,
+		IssuedAt:  now,
+		NotBefore: now,
+		NotAfter:  now.Add(*validity),
+		Revoked:   revoked,
+	}
+
+	data, err := revsnapshot.Build(s, signer)
+	if err == nil {
+		err = atomicfile.WriteFile(*outPath, data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot build: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d revoked certificates, sequence %d, valid until %s\n", *outPath, len(revoked), s.Sequence, s.NotAfter.Format(time.RFC3339))
+	return 0
+}
+
+func verifySnapshot(args []string) int {
+	cmd := flag.NewFlagSet("snapshot verify", flag.ContinueOnError)
+	keyPath := cmd.String("key", "", "Path to the PEM public key or certificate the snapshot must be signed with")
+	inPath := cmd.String("in", "", "Path to the snapshot")
+
+	if err := cmd.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" || *inPath == "" {
+		fmt.Fprintln(os.Stderr, snapshotUsage)
+		return 2
+	}
+
+	pub, err := signing.LoadPublicKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot verify: %s\n", err)
+		return 2
+	}
+	data, err := os.ReadFile(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot verify: %s\n", err)
+		return 2
+	}
+
+	s, err := revsnapshot.Parse(data, pub)
+	if err != nil {
+		fmt.Printf("FAIL: %s\n", err)
+		return 1
+	}
+	fmt.Printf("issuer %s, sequence %d, %d revoked certificates, valid from %s to %s\n", s.Issuer, s.Sequence, len(s.Revoked),
+		s.NotBefore.Format(time.RFC3339), s.NotAfter.Format(time.RFC3339))
+	if err := s.Check(time.Now()); err != nil {
+		fmt.Printf("FAIL: %s\n", err)
+		return 1
+	}
+
+	fmt.Println("OK")
+	return 0
+}
+
+// readRevokedSerials parses "serial[,reason]" lines, skipping blank lines and # comments.
+func readRevokedSerials(path string) ([]revsnapshot.Entry, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	var out []revsnapshot.Entry
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		serial, reason, _ := strings.Cut(line, ",")
+		serial = strings.TrimSpace(serial)
+		if serial == "" {
+			return nil, fmt.Errorf("%s:%d: missing serial", path, n)
+		}
+		if seen[serial] {
+			continue
+		}
+		seen[serial] = true
+		out = append(out, revsnapshot.Entry{Serial: serial, Reason: strings.TrimSpace(reason)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/mygaru/id-check/pkg/route"
+	"github.com/mygaru/id-check/pkg/tracing"
+	"github.com/valyala/fasthttp"
+)
+
+// startRequestSpan continues the trace of an inbound traceparent or starts a new one.
+// The span links to the handshake span of the connection. It returns nil when tracing is disabled.
+func startRequestSpan(ctx *fasthttp.RequestCtx, id identity.Identity) *tracing.Span {
+	if !tracing.Enabled() {
+		return nil
+	}
+
+	// an invalid inbound traceparent is ignored and a new trace started
+	parent, _ := tracing.ParseTraceparent(string(ctx.Request.Header.Peek(tracing.HeaderTraceparent)))
+
+	span := tracing.StartSpan(string(ctx.Method())+" "+route.Of(string(ctx.Path())), tracing.KindServer, parent)
+	span.AddLink(mtls.HandshakeSpanContext(ctx.Conn()))
+
+	span.SetAttribute("http.request.method", string(ctx.Method()))
+	span.SetAttribute("url.path", string(ctx.Path()))
+	span.SetAttribute("client.address", mtls.ClientIP(ctx).String())
+	if tracing.IdentityAttributes() {
+		span.SetAttribute("idcheck.client.cn", id.CommonName)
+		span.SetAttribute("idcheck.client.serial", id.Serial)
+		span.SetAttribute("idcheck.client.fingerprint", id.Fingerprint)
+	}
+
+	return span
+}
+
+func finishRequestSpan(ctx *fasthttp.RequestCtx, span *tracing.Span) {
+	span.SetAttribute("http.response.status_code", ctx.Response.StatusCode())
+	span.Finish()
+}
+
+// startUpstreamSpan starts the span of the upstream call and propagates it in req.
+func startUpstreamSpan(span *tracing.Span, req *fasthttp.Request) *tracing.Span {
+	upstream := span.StartChild("upstream", tracing.KindClient)
+	if upstream != nil {
+		req.Header.Set(tracing.HeaderTraceparent, upstream.SpanContext().Traceparent())
+		upstream.SetAttribute("server.address", forwardURL.Host)
+	}
+	return upstream
+}
@@ -0,0 +1,152 @@
+package accesslog
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var log = logger.For(logger.ComponentAccessLog)
+
+var (
+	accessLogPath           = flag.String("accessLogPath", "", "Path to the access log; - logs to stdout, empty disables the access log")
+	accessLogFormat         = flag.String("accessLogFormat", FormatJSON, "Access log format: common, combined, json or template. Only json and template carry TLS details, latencies and the request ID")
+	accessLogTemplate       = flag.String("accessLogTemplate", "", "text/template of an access log line used with accessLogFormat=template, e.g. {{.ClientIP}} {{.CommonName}} {{.Status}} {{.UpstreamMs}}")
+	accessLogMaxSize        = flag.Int64("accessLogMaxSize", 100<<20, "Rotate the access log once it grows beyond this many bytes; 0 disables size-based rotation")
+	accessLogRotateInterval = flag.Duration("accessLogRotateInterval", 0, "Rotate the access log at this interval, e.g. 24h; 0 disables time-based rotation")
+	accessLogMaxBackups     = flag.Int("accessLogMaxBackups", 10, "How many rotated access logs are kept; 0 keeps all")
+	accessLogMaxAge         = flag.Duration("accessLogMaxAge", 0, "Rotated access logs older than this are removed; 0 keeps them regardless of age")
+	accessLogCompress       = flag.Bool("accessLogCompress", true, "Gzip rotated access logs")
+)
+
+const (
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+	FormatTemplate = "template"
+)
+
+// Entry describes a single served request.
+type Entry struct {
+	Time            time.Time     `json:"time"`
+	ClientIP        string        `json:"clientIp"`
+	CommonName      string        `json:"cn"`
+	Serial          string        `json:"serial"`
+	Method          string        `json:"method"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	Status          int           `json:"status"`
+	RequestBytes    int           `json:"requestBytes"`
+	ResponseBytes   int           `json:"responseBytes"`
+	Duration        time.Duration `json:"-"`
+	UpstreamLatency time.Duration `json:"-"`
+	TLSVersion      string        `json:"tlsVersion"`
+	CipherSuite     string        `json:"cipherSuite"`
+	RequestID       string        `json:"requestId"`
+	Referer         string        `json:"referer"`
+	UserAgent       string        `json:"userAgent"`
+}
+
+// DurationMs is the time spent serving the request in milliseconds.
+func (e *Entry) DurationMs() int64 {
+	return e.Duration.Milliseconds()
+}
+
+// UpstreamMs is the upstream latency in milliseconds.
+func (e *Entry) UpstreamMs() int64 {
+	return e.UpstreamLatency.Milliseconds()
+}
+
+var (
+	mu  sync.Mutex
+	out *rotatingFile
+	enc encoder
+)
+
+// Enabled reports whether the access log is configured.
+func Enabled() bool {
+	return *accessLogPath != ""
+}
+
+// Init opens the access log and reopens it on SIGUSR1. It is a no-op when the access log is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	e, err := newEncoder(*accessLogFormat, *accessLogTemplate)
+	if err != nil {
+		return err
+	}
+
+	f, err := openRotating(*accessLogPath, rotation{
+		maxSize:    *accessLogMaxSize,
+		interval:   *accessLogRotateInterval,
+		maxBackups: *accessLogMaxBackups,
+		maxAge:     *accessLogMaxAge,
+		compress:   *accessLogCompress,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open access log %s: %w", *accessLogPath, err)
+	}
+
+	mu.Lock()
+	out, enc = f, e
+	mu.Unlock()
+
+	// external logrotate moves the file away and signals us to start a new one
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGUSR1)
+	go func() {
+		for range reopen {
+			if err := Reopen(); err != nil {
+				log.Error("Failed to reopen access log", "err", err)
+			} else {
+				log.Info("Reopened access log", "path", *accessLogPath)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Log writes e to the access log.
+func Log(e Entry) {
+	if !Enabled() {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if out == nil {
+		return
+	}
+
+	line, err := enc(&e)
+	if err != nil {
+		log.Error("Failed to format access log entry", "err", err)
+		return
+	}
+
+	if _, err := out.Write(line); err != nil {
+		log.Error("Failed to write access log", "err", err)
+	}
+}
+
+// Reopen closes the access log and opens it again at its path.
+func Reopen() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if out == nil {
+		return nil
+	}
+
+	return out.reopen()
+}
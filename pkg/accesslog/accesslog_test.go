@@ -0,0 +1,155 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:            time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIP:        "10.0.0.1",
+		CommonName:      "partner one",
+		Serial:          "42",
+		Method:          "GET",
+		URI:             "/lookup?id=1",
+		Proto:           "HTTP/1.1",
+		Status:          200,
+		ResponseBytes:   512,
+		Duration:        15 * time.Millisecond,
+		UpstreamLatency: 12 * time.Millisecond,
+		TLSVersion:      "TLS 1.3",
+		CipherSuite:     "TLS_AES_128_GCM_SHA256",
+		UserAgent:       "curl/8.0",
+	}
+}
+
+func TestFormats(t *testing.T) {
+	enc, err := newEncoder(FormatCommon, "")
+	require.NoError(t, err)
+	line, err := enc(testEntry())
+	require.NoError(t, err)
+	require.Equal(t, `10.0.0.1 - partner_one [01/Mar/2024:12:30:00 +0000] "GET /lookup?id=1 HTTP/1.1" 200 512`+"\n", string(line))
+
+	enc, err = newEncoder(FormatCombined, "")
+	require.NoError(t, err)
+	line, err = enc(testEntry())
+	require.NoError(t, err)
+	require.Equal(t, `10.0.0.1 - partner_one [01/Mar/2024:12:30:00 +0000] "GET /lookup?id=1 HTTP/1.1" 200 512 "-" "curl/8.0"`+"\n", string(line))
+
+	enc, err = newEncoder(FormatJSON, "")
+	require.NoError(t, err)
+	line, err = enc(testEntry())
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(line, &m))
+	require.Equal(t, "partner one", m["cn"])
+	require.Equal(t, "TLS 1.3", m["tlsVersion"])
+	require.EqualValues(t, 12, m["upstreamMs"])
+
+	enc, err = newEncoder(FormatTemplate, "{{.CommonName}} {{.Status}} {{.UpstreamMs}}ms {{.CipherSuite}}")
+	require.NoError(t, err)
+	line, err = enc(testEntry())
+	require.NoError(t, err)
+	require.Equal(t, "partner one 200 12ms TLS_AES_128_GCM_SHA256\n", string(line))
+
+	_, err = newEncoder(FormatTemplate, "")
+	require.Error(t, err)
+	_, err = newEncoder("apache", "")
+	require.Error(t, err)
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	r, err := openRotating(path, rotation{maxSize: 10, maxBackups: 2})
+	require.NoError(t, err)
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		_, err := r.Write([]byte("0123456789"))
+		require.NoError(t, err)
+	}
+	// three rotations, the oldest backup is pruned in the background
+	var backups []backup
+	require.Eventually(t, func() bool {
+		backups, err = r.backups()
+		return err == nil && len(backups) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, path+".20240301-120004.000", backups[1].path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(data))
+}
+
+func TestRotationFailureKeepsWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	r, err := openRotating(path, rotation{maxSize: 10})
+	require.NoError(t, err)
+	r.now = func() time.Time { return now }
+
+	_, err = r.Write([]byte("0123456789"))
+	require.NoError(t, err)
+
+	// the backup name is taken by a directory, so the file cannot be moved away
+	blocked := path + ".20240301-120000.000"
+	require.NoError(t, os.MkdirAll(filepath.Join(blocked, "x"), 0o755))
+	_, err = r.Write([]byte("abc"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789abc", string(data))
+
+	// rotating is retried later
+	require.NoError(t, os.RemoveAll(blocked))
+	now = now.Add(rotateRetryDelay)
+	_, err = r.Write([]byte("def"))
+	require.NoError(t, err)
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "def", string(data))
+	require.FileExists(t, path+".20240301-120100.000")
+}
+
+func TestTimeRotationCompressAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	r, err := openRotating(path, rotation{interval: time.Hour, compress: true})
+	require.NoError(t, err)
+	r.now = func() time.Time { return now }
+	r.nextRotation = now.Add(time.Hour)
+
+	_, err = r.Write([]byte("a\n"))
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+	_, err = r.Write([]byte("b\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path + ".20240301-130000.000.gz")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// logrotate moved the file away
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, r.reopen())
+	_, err = r.Write([]byte("c\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "c\n", string(data))
+}
@@ -0,0 +1,98 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// clfTimeLayout is the timestamp layout of the Common Log Format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// encoder formats an entry as a single line including the trailing newline.
+type encoder func(e *Entry) ([]byte, error)
+
+func newEncoder(format, tmpl string) (encoder, error) {
+	switch format {
+	case FormatCommon:
+		return func(e *Entry) ([]byte, error) {
+			return appendCommon(nil, e), nil
+		}, nil
+	case FormatCombined:
+		return encodeCombined, nil
+	case FormatJSON:
+		return encodeJSON, nil
+	case FormatTemplate:
+		if tmpl == "" {
+			return nil, fmt.Errorf("accessLogTemplate must be set with accessLogFormat=%s", FormatTemplate)
+		}
+		t, err := template.New("accessLog").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid accessLogTemplate: %w", err)
+		}
+		return func(e *Entry) ([]byte, error) {
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, e); err != nil {
+				return nil, err
+			}
+			if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+				buf.WriteByte('\n')
+			}
+			return buf.Bytes(), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported accessLogFormat %q, want %s, %s, %s or %s", format, FormatCommon, FormatCombined, FormatJSON, FormatTemplate)
+	}
+}
+
+// appendCommon appends e in the Common Log Format, with the certificate CN as the user.
+func appendCommon(b []byte, e *Entry) []byte {
+	b = append(b, dash(e.ClientIP)...)
+	b = append(b, " - "...)
+	b = append(b, dash(strings.ReplaceAll(e.CommonName, " ", "_"))...)
+	b = append(b, " ["...)
+	b = e.Time.AppendFormat(b, clfTimeLayout)
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, e.Method+" "+e.URI+" "+e.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.ResponseBytes > 0 {
+		b = strconv.AppendInt(b, int64(e.ResponseBytes), 10)
+	} else {
+		b = append(b, '-')
+	}
+	return append(b, '\n')
+}
+
+func encodeCombined(e *Entry) ([]byte, error) {
+	b := appendCommon(nil, e)
+	b = b[:len(b)-1]
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, dash(e.Referer))
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, dash(e.UserAgent))
+	return append(b, '\n'), nil
+}
+
+func encodeJSON(e *Entry) ([]byte, error) {
+	b, err := json.Marshal(struct {
+		*Entry
+		DurationMs int64 `json:"durationMs"`
+		UpstreamMs int64 `json:"upstreamMs"`
+	}{e, e.DurationMs(), e.UpstreamMs()})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
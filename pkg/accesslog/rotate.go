@@ -0,0 +1,270 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupLayout = "20060102-150405.000"
+	gzipSuffix   = ".gz"
+)
+
+// rotateRetryDelay is how long a file that failed to rotate is appended to before rotating is tried again.
+const rotateRetryDelay = time.Minute
+
+type rotation struct {
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+}
+
+// rotatingFile is an append-only file rotated by size and time. Rotated files are renamed
+// to <path>.<timestamp>, optionally gzipped, and pruned in the background.
+// It is not safe for concurrent use.
+type rotatingFile struct {
+	path string
+	cfg  rotation
+	now  func() time.Time
+
+	f            *os.File
+	size         int64
+	nextRotation time.Time
+	retryAt      time.Time
+
+	// cleanup is held while compressing and pruning backups
+	cleanup sync.Mutex
+}
+
+func openRotating(path string, cfg rotation) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, cfg: cfg, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) stdout() bool {
+	return r.path == "-"
+}
+
+func (r *rotatingFile) open() error {
+	if r.stdout() {
+		r.f = os.Stdout
+		return nil
+	}
+
+	f, size, err := r.openFile()
+	if err != nil {
+		return err
+	}
+	r.use(f, size)
+
+	return nil
+}
+
+// openFile opens the file at path for appending and returns it with its size.
+func (r *rotatingFile) openFile() (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+
+	return f, st.Size(), nil
+}
+
+func (r *rotatingFile) use(f *os.File, size int64) {
+	r.f = f
+	r.size = size
+	if r.cfg.interval > 0 {
+		r.nextRotation = r.now().Truncate(r.cfg.interval).Add(r.cfg.interval)
+	}
+}
+
+// swap starts writing to f and closes the file written so far.
+func (r *rotatingFile) swap(f *os.File, size int64) {
+	old := r.f
+	r.use(f, size)
+	if err := old.Close(); err != nil {
+		log.Warn("Failed to close previous access log", "err", err)
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if !r.stdout() && r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			// lines keep going to the current file until rotating succeeds
+			log.Error("Failed to rotate access log", "path", r.path, "err", err)
+			r.retryAt = r.now().Add(rotateRetryDelay)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(n int) bool {
+	if r.now().Before(r.retryAt) {
+		return false
+	}
+	if r.cfg.maxSize > 0 && r.size > 0 && r.size+int64(n) > r.cfg.maxSize {
+		return true
+	}
+	return r.cfg.interval > 0 && !r.now().Before(r.nextRotation)
+}
+
+// rotate moves the file away and starts a new one. On failure the current file stays open at path.
+func (r *rotatingFile) rotate() error {
+	now := r.now()
+	backup := r.path + "." + now.UTC().Format(backupLayout)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+
+	f, size, err := r.openFile()
+	if err != nil {
+		if rerr := os.Rename(backup, r.path); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return err
+	}
+	r.swap(f, size)
+
+	go r.cleanupBackups(backup, now)
+
+	return nil
+}
+
+// reopen starts writing to a fresh file at path, e.g. after it was moved away by logrotate.
+// On failure the current file is written to.
+func (r *rotatingFile) reopen() error {
+	if r.stdout() {
+		return nil
+	}
+
+	f, size, err := r.openFile()
+	if err != nil {
+		return err
+	}
+	r.swap(f, size)
+
+	return nil
+}
+
+func (r *rotatingFile) cleanupBackups(rotated string, now time.Time) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+
+	if r.cfg.compress {
+		if err := compress(rotated); err != nil {
+			log.Error("Failed to compress rotated access log", "path", rotated, "err", err)
+		}
+	}
+
+	if err := r.prune(now); err != nil {
+		log.Error("Failed to remove old access logs", "err", err)
+	}
+}
+
+type backup struct {
+	path string
+	at   time.Time
+}
+
+// backups returns the rotated files of r, oldest first.
+func (r *rotatingFile) backups() ([]backup, error) {
+	paths, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(r.path) + "."
+
+	var out []backup
+	for _, p := range paths {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), prefix), gzipSuffix)
+		at, err := time.Parse(backupLayout, stamp)
+		if err != nil {
+			continue
+		}
+		out = append(out, backup{path: p, at: at})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].at.Before(out[j].at) })
+
+	return out, nil
+}
+
+func (r *rotatingFile) prune(now time.Time) error {
+	backups, err := r.backups()
+	if err != nil {
+		return err
+	}
+
+	for i, b := range backups {
+		tooMany := r.cfg.maxBackups > 0 && len(backups)-i > r.cfg.maxBackups
+		tooOld := r.cfg.maxAge > 0 && now.Sub(b.at) > r.cfg.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + gzipSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path+gzipSuffix); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"sync"
+)
+
+var log = logger.For(logger.ComponentAdmin)
+
+var (
+	adminListenAddr = flag.String("adminListenAddr", "", "Address of the plain HTTP admin listener (usage reports etc.); empty disables it. Do not expose it publicly")
+)
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]fasthttp.RequestHandler{}
+)
+
+// Handle registers handler for path and everything below it (path + "/...").
+func Handle(path string, handler fasthttp.RequestHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	handlers[strings.TrimSuffix(path, "/")] = handler
+}
+
+// Enabled reports whether the admin listener is configured.
+func Enabled() bool {
+	return *adminListenAddr != ""
+}
+
+// RunServer serves the registered handlers on adminListenAddr. It blocks, so run it in a goroutine.
+// It returns immediately when the admin listener is disabled.
+func RunServer() {
+	if !Enabled() {
+		return
+	}
+
+	s := &fasthttp.Server{
+		Handler: requestHandler,
+		Name:    "id-check-admin",
+	}
+
+	log.Info("Admin listener started", "addr", *adminListenAddr)
+
+	if err := s.ListenAndServe(*adminListenAddr); err != nil {
+		logger.Fatal(log, "Failed to serve admin", "err", err)
+	}
+}
+
+func requestHandler(ctx *fasthttp.RequestCtx) {
+	handler := lookup(string(ctx.Path()))
+	if handler == nil {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	handler(ctx)
+}
+
+// lookup returns the handler registered for the longest prefix of path.
+func lookup(path string) fasthttp.RequestHandler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	p := strings.TrimSuffix(path, "/")
+	for {
+		if h, ok := handlers[p]; ok {
+			return h
+		}
+
+		i := strings.LastIndexByte(p, '/')
+		if i < 0 {
+			return nil
+		}
+		p = p[:i]
+	}
+}
+
+// WriteJSON writes v as the JSON response body.
+func WriteJSON(ctx *fasthttp.RequestCtx, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		ctx.Error("failed to encode response: "+err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// Subpath returns the part of the request path below prefix, without leading slashes.
+func Subpath(ctx *fasthttp.RequestCtx, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(string(ctx.Path()), prefix), "/")
+}
@@ -0,0 +1,162 @@
+package allowlist
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var log = logger.For(logger.ComponentAllowlist)
+
+var (
+	allowlistPath           = flag.String("allowlistPath", "", "Path to JSON file binding identities (CN, serial or SPKI fingerprint) to the source CIDRs they may connect from; empty disables the allowlist")
+	allowlistReloadInterval = flag.Duration("allowlistReloadInterval", 10*time.Second, "How often allowlistPath is checked for changes")
+)
+
+var denials = metrics.NewCounterVec("idcheck_allowlist_denials_total", "Requests rejected because the client IP is outside the allowlist of its identity")
+
+// Entry restricts the identities matching any of CommonName, Serial or SPKI to CIDRs.
+// With Domain set, it only applies to certificates issued within that trust bundle.
+type Entry struct {
+	CommonName string   `json:"cn,omitempty"`
+	Serial     string   `json:"serial,omitempty"`
+	SPKI       string   `json:"spki,omitempty"`
+	Domain     string   `json:"domain,omitempty"`
+	CIDRs      []string `json:"cidrs"`
+}
+
+// Config is the content of allowlistPath.
+type Config struct {
+	Entries []Entry `json:"entries"`
+}
+
+// index maps identity attributes to the networks they may connect from.
+type index struct {
+	byCN     map[string][]scoped
+	bySerial map[string][]scoped
+	bySPKI   map[string][]scoped
+}
+
+// scoped are the networks of an entry and the issuer domain it is limited to, empty for any.
+type scoped struct {
+	domain string
+	cidrs  cidr.List
+}
+
+var current atomic.Pointer[index]
+
+// Enabled reports whether the allowlist is configured.
+func Enabled() bool {
+	return *allowlistPath != ""
+}
+
+// Init loads the allowlist and reloads it when the file changes. It is a no-op when the allowlist is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	filewatch.Watch(*allowlistPath, *allowlistReloadInterval, reload, func(err error) {
+		log.Error("Failed to reload allowlist, keeping the previous one", "err", err)
+	})
+
+	return nil
+}
+
+func reload() error {
+	data, err := os.ReadFile(*allowlistPath)
+	if err != nil {
+		return fmt.Errorf("failed to read allowlist %s: %w", *allowlistPath, err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse allowlist %s: %w", *allowlistPath, err)
+	}
+
+	idx, err := build(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid allowlist %s: %w", *allowlistPath, err)
+	}
+
+	current.Store(idx)
+	log.Info("Loaded allowlist", "entries", len(cfg.Entries))
+
+	return nil
+}
+
+func build(cfg *Config) (*index, error) {
+	idx := &index{byCN: map[string][]scoped{}, bySerial: map[string][]scoped{}, bySPKI: map[string][]scoped{}}
+
+	for i, e := range cfg.Entries {
+		if e.CommonName == "" && e.Serial == "" && e.SPKI == "" {
+			return nil, fmt.Errorf("entry #%d matches no identity, set cn, serial or spki", i)
+		}
+		if len(e.CIDRs) == 0 {
+			return nil, fmt.Errorf("entry #%d has no cidrs", i)
+		}
+
+		list, err := cidr.Parse(strings.Join(e.CIDRs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("entry #%d: %w", i, err)
+		}
+		s := scoped{domain: e.Domain, cidrs: list}
+
+		if e.CommonName != "" {
+			idx.byCN[e.CommonName] = append(idx.byCN[e.CommonName], s)
+		}
+		if e.Serial != "" {
+			idx.bySerial[e.Serial] = append(idx.bySerial[e.Serial], s)
+		}
+		if e.SPKI != "" {
+			spki := strings.ToLower(e.SPKI)
+			idx.bySPKI[spki] = append(idx.bySPKI[spki], s)
+		}
+	}
+
+	return idx, nil
+}
+
+// Allowed reports whether id may connect from ip. Identities without an allowlist entry may connect from anywhere;
+// identities matching several entries may connect from any of their networks.
+func Allowed(ctx context.Context, id identity.Identity, ip net.IP) bool {
+	idx := current.Load()
+	if idx == nil {
+		return true
+	}
+
+	var allowed cidr.List
+	listed := false
+	for _, l := range [][]scoped{idx.byCN[id.CommonName], idx.bySerial[id.Serial], idx.bySPKI[id.Fingerprint]} {
+		for _, s := range l {
+			if id.InDomain(s.domain) {
+				listed = true
+				allowed = append(allowed, s.cidrs...)
+			}
+		}
+	}
+
+	if !listed || allowed.Contains(ip) {
+		return true
+	}
+
+	denials.With().Inc()
+	log.WarnContext(ctx, "Client IP is not allowed for identity", "cn", id.CommonName, "serial", id.Serial, "issuerDomain", id.IssuerDomain, "clientIp", ip.String())
+
+	return false
+}
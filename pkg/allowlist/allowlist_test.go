@@ -0,0 +1,75 @@
+package allowlist
+
+import (
+	"context"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	idx, err := build(&Config{Entries: []Entry{
+		{CommonName: "partner-a", CIDRs: []string{"203.0.113.0/24"}},
+		{Serial: "42", CIDRs: []string{"2001:db8::/32"}},
+		{SPKI: "ABCD", CIDRs: []string{"198.51.100.7"}},
+	}})
+	require.NoError(t, err)
+	current.Store(idx)
+	t.Cleanup(func() { current.Store(nil) })
+
+	partnerA := identity.Identity{CommonName: "partner-a", Serial: "42"}
+	require.True(t, Allowed(context.Background(), partnerA, net.ParseIP("203.0.113.9")))
+	require.True(t, Allowed(context.Background(), partnerA, net.ParseIP("2001:db8::5")))
+	require.True(t, Allowed(context.Background(), partnerA, net.ParseIP("::ffff:203.0.113.9")))
+	require.False(t, Allowed(context.Background(), partnerA, net.ParseIP("192.0.2.1")))
+
+	pinned := identity.Identity{CommonName: "partner-b", Fingerprint: "abcd"}
+	require.True(t, Allowed(context.Background(), pinned, net.ParseIP("198.51.100.7")))
+	require.False(t, Allowed(context.Background(), pinned, net.ParseIP("198.51.100.8")))
+
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "unlisted"}, net.ParseIP("192.0.2.1")))
+
+	_, err = build(&Config{Entries: []Entry{{CIDRs: []string{"10.0.0.0/8"}}}})
+	require.Error(t, err)
+	_, err = build(&Config{Entries: []Entry{{CommonName: "x", CIDRs: []string{"10.0.0.0/40"}}}})
+	require.Error(t, err)
+}
+
+func TestAllowed_Domain(t *testing.T) {
+	idx, err := build(&Config{Entries: []Entry{
+		{CommonName: "partner-a", Domain: "mygaru", CIDRs: []string{"203.0.113.0/24"}},
+	}})
+	require.NoError(t, err)
+	current.Store(idx)
+	t.Cleanup(func() { current.Store(nil) })
+
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "mygaru"}, net.ParseIP("203.0.113.9")))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "mygaru"}, net.ParseIP("192.0.2.1")))
+	// the same CN issued by another CA is not covered by the entry
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "partner-ca"}, net.ParseIP("192.0.2.1")))
+}
+
+func TestHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"entries":[{"cn":"partner-a","cidrs":["10.0.0.0/8"]}]}`), 0o644))
+
+	prevPath, prevInterval := *allowlistPath, *allowlistReloadInterval
+	*allowlistPath, *allowlistReloadInterval = path, 10*time.Millisecond
+	t.Cleanup(func() {
+		*allowlistPath, *allowlistReloadInterval = prevPath, prevInterval
+		current.Store(nil)
+	})
+
+	require.NoError(t, Init())
+
+	id := identity.Identity{CommonName: "partner-a"}
+	ip := net.ParseIP("192.0.2.1")
+	require.False(t, Allowed(context.Background(), id, ip))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"entries":[{"cn":"partner-a","cidrs":["10.0.0.0/8","192.0.2.0/24"]}]}`), 0o644))
+	require.Eventually(t, func() bool { return Allowed(context.Background(), id, ip) }, 2*time.Second, 10*time.Millisecond)
+}
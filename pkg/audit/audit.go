@@ -0,0 +1,278 @@
+package audit
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentAudit)
+
+var (
+	auditLogPath        = flag.String("auditLogPath", "", "Path to the append-only, hash-chained JSONL audit log; empty disables auditing")
+	auditSigningKeyPath = flag.String("auditSigningKeyPath", "", "Path to PEM (PKCS#8) private key used to sign audit log checkpoints; empty leaves the log unsigned")
+	auditSignInterval   = flag.Duration("auditSignInterval", time.Minute, "How often a signed checkpoint covering the new audit records is appended")
+)
+
+const (
+	TypeRequest    = "request"
+	TypeCheckpoint = "checkpoint"
+	TypeResume     = "resume"
+	// TypePinLearned records a key pinned for an identity in learn mode.
+	TypePinLearned = "pin_learned"
+	// TypePinMismatch records a key that does not match the pins of its identity.
+	TypePinMismatch = "pin_mismatch"
+)
+
+// Record is a single audit log entry. Seq, Time, Prev and, for checkpoints, Head and Signature are filled by the logger.
+type Record struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	RequestID         string `json:"requestId,omitempty"`
+	CommonName        string `json:"cn,omitempty"`
+	SPIFFEID          string `json:"spiffeId,omitempty"`
+	IssuerDomain      string `json:"issuerDomain,omitempty"`
+	Serial            string `json:"serial,omitempty"`
+	Fingerprint       string `json:"fingerprint,omitempty"`
+	SPKI              string `json:"spki,omitempty"`
+	ReputationVerdict string `json:"reputation,omitempty"`
+	ClientIP          string `json:"clientIp,omitempty"`
+	Method            string `json:"method,omitempty"`
+	Path              string `json:"path,omitempty"`
+	Status            int    `json:"status,omitempty"`
+	BodySHA256        string `json:"bodySha256,omitempty"`
+	DurationMs        int64  `json:"durationMs,omitempty"`
+	UpstreamMs        int64  `json:"upstreamMs,omitempty"`
+	Detail            string `json:"detail,omitempty"`
+
+	Head      string `json:"head,omitempty"`
+	Signature string `json:"sig,omitempty"`
+
+	Prev string `json:"prev"`
+}
+
+var (
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	signer   crypto.Signer
+	nextSeq  uint64
+	prevHash string
+	// head of the chain at the last checkpoint
+	signedSeq uint64
+)
+
+// Enabled reports whether the audit log is configured.
+func Enabled() bool {
+	return *auditLogPath != ""
+}
+
+// Init opens the audit log, resumes its chain and starts periodic checkpoints.
+// It is a no-op when auditing is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if *auditSigningKeyPath != "" {
+		s, err := LoadSigningKey(*auditSigningKeyPath)
+		if err != nil {
+			return err
+		}
+		signer = s
+	} else {
+		log.Warn("auditSigningKeyPath is not set, audit log checkpoints will not be signed")
+	}
+
+	tail, err := readTail(*auditLogPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*auditLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", *auditLogPath, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	file = f
+	w = newWriter(f)
+	nextSeq = tail.nextSeq
+	prevHash = tail.lastHash
+	signedSeq = tail.nextSeq
+
+	if tail.damaged {
+		// keep the damaged bytes for the verifier to report and continue the chain after them
+		log.Error("Audit log ends with a damaged record, continuing the chain after it", "path", *auditLogPath)
+	}
+	if tail.needsNewline {
+		if _, err := w.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+
+	if tail.nextSeq > 0 {
+		if err := appendLocked(Record{Type: TypeResume}); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(*auditSignInterval) {
+			if err := Checkpoint(); err != nil {
+				log.Error("Failed to checkpoint audit log", "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Log appends rec to the audit log.
+func Log(rec Record) {
+	if !Enabled() {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := appendLocked(rec); err != nil {
+		log.Error("Failed to write audit record", "err", err)
+		return
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Error("Failed to flush audit log", "err", err)
+	}
+}
+
+// Checkpoint appends a checkpoint record signing the current head of the chain,
+// when records were added since the previous one, and updates the head file.
+func Checkpoint() error {
+	if !Enabled() {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if nextSeq == signedSeq {
+		return nil
+	}
+
+	head := Head{Seq: nextSeq - 1, Hash: prevHash}
+	rec := Record{Type: TypeCheckpoint, Head: head.Hash}
+	if signer != nil {
+		sig, err := sign(signer, head.Seq, head.Hash)
+		if err != nil {
+			return err
+		}
+		rec.Signature = sig
+		head.Signature = sig
+	}
+
+	if err := appendLocked(rec); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	signedSeq = nextSeq
+
+	return writeHead(*auditLogPath+HeadSuffix, head)
+}
+
+// appendLocked chains rec to the previous record and writes it. The caller must hold mu.
+func appendLocked(rec Record) error {
+	rec.Seq = nextSeq
+	rec.Time = time.Now().UTC()
+	rec.Prev = prevHash
+
+	line, hash, err := encode(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(line); err != nil {
+		return err
+	}
+
+	nextSeq++
+	prevHash = hash
+
+	return nil
+}
+
+type tailState struct {
+	nextSeq      uint64
+	lastHash     string
+	damaged      bool
+	needsNewline bool
+}
+
+// readTail finds the last intact record of the log at path.
+func readTail(path string) (tailState, error) {
+	state := tailState{lastHash: GenesisHash}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			state.needsNewline = line[len(line)-1] != '\n'
+			rec, hash, decodeErr := decode(line)
+			if decodeErr != nil {
+				state.damaged = true
+			} else {
+				state.damaged = false
+				state.nextSeq = rec.Seq + 1
+				state.lastHash = hash
+			}
+		}
+		if err == io.EOF {
+			return state, nil
+		}
+		if err != nil {
+			return state, fmt.Errorf("failed to read audit log %s: %w", path, err)
+		}
+	}
+}
+
+// BodySHA256 returns the hex encoded SHA-256 of a request body.
+func BodySHA256(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func newWriter(f *os.File) *bufio.Writer {
+	return bufio.NewWriterSize(f, 64*1024)
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog produces a log of n request records followed by a signed checkpoint.
+func writeLog(t *testing.T, n int) (string, ed25519.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	*auditLogPath = path
+	t.Cleanup(func() { *auditLogPath = "" })
+
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+
+	mu.Lock()
+	file = f
+	w = newWriter(f)
+	signer = priv
+	nextSeq, signedSeq, prevHash = 0, 0, GenesisHash
+	mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		Log(Record{Type: TypeRequest, CommonName: "DV1", Method: "GET", Path: "/lookup", Status: 200})
+	}
+	assert.Nil(t, Checkpoint())
+
+	return path, pub
+}
+
+func verifyFile(t *testing.T, data []byte, pub ed25519.PublicKey, path string) *VerifyResult {
+	t.Helper()
+
+	head, err := ReadHead(path + HeadSuffix)
+	assert.Nil(t, err)
+
+	res, err := Verify(bytes.NewReader(data), pub, head)
+	assert.Nil(t, err)
+	return res
+}
+
+func TestVerify_Intact(t *testing.T) {
+	path, pub := writeLog(t, 5)
+	data, _ := os.ReadFile(path)
+
+	res := verifyFile(t, data, pub, path)
+	assert.True(t, res.OK(), res.Problems)
+	assert.Equal(t, uint64(6), res.Records)
+	assert.Equal(t, 1, res.Checkpoints)
+	assert.Equal(t, uint64(0), res.Unsigned)
+}
+
+func TestVerify_Modified(t *testing.T) {
+	path, pub := writeLog(t, 5)
+	data, _ := os.ReadFile(path)
+
+	data = bytes.Replace(data, []byte(`"status":200`), []byte(`"status":201`), 1)
+
+	res := verifyFile(t, data, pub, path)
+	assert.False(t, res.OK())
+}
+
+func TestVerify_Reordered(t *testing.T) {
+	path, pub := writeLog(t, 5)
+	data, _ := os.ReadFile(path)
+
+	lines := strings.SplitAfter(string(data), "\n")
+	lines[1], lines[2] = lines[2], lines[1]
+
+	res := verifyFile(t, []byte(strings.Join(lines, "")), pub, path)
+	assert.False(t, res.OK())
+}
+
+func TestVerify_Truncated(t *testing.T) {
+	path, pub := writeLog(t, 5)
+	data, _ := os.ReadFile(path)
+
+	lines := strings.SplitAfter(string(data), "\n")
+	truncated := strings.Join(lines[:3], "")
+
+	res := verifyFile(t, []byte(truncated), pub, path)
+	assert.False(t, res.OK())
+	assert.Contains(t, res.Problems[0], "truncated")
+}
+
+func TestVerify_WrongKey(t *testing.T) {
+	path, _ := writeLog(t, 2)
+	data, _ := os.ReadFile(path)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	res := verifyFile(t, data, other, path)
+	assert.False(t, res.OK())
+}
+
+func TestReadTail_Resume(t *testing.T) {
+	path, _ := writeLog(t, 3)
+
+	tail, err := readTail(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), tail.nextSeq)
+	assert.False(t, tail.damaged)
+
+	mu.Lock()
+	assert.Equal(t, prevHash, tail.lastHash)
+	mu.Unlock()
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GenesisHash is the prev hash of the first record of a log.
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// hashField is appended to every encoded record; it covers the exact bytes that precede it.
+const hashField = `,"hash":"`
+
+// encode returns rec as a JSONL line ending with its chain hash, and that hash.
+// The hash is SHA-256 over the previous hash followed by the record JSON without the hash field.
+func encode(rec Record) ([]byte, string, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode audit record: %w", err)
+	}
+
+	hash := chainHash(rec.Prev, body)
+
+	line := make([]byte, 0, len(body)+len(hashField)+len(hash)+3)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, hashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+
+	return line, hash, nil
+}
+
+// decode parses a JSONL line produced by encode and checks that its hash matches its content.
+func decode(line []byte) (Record, string, error) {
+	var rec Record
+
+	line = bytes.TrimRight(line, "\n")
+
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return rec, "", errors.New("record has no hash")
+	}
+
+	hash := string(line[i+len(hashField) : len(line)-2])
+	body := append(append([]byte{}, line[:i]...), '}')
+
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return rec, "", fmt.Errorf("malformed record: %w", err)
+	}
+
+	if want := chainHash(rec.Prev, body); hash != want {
+		return rec, "", fmt.Errorf("hash mismatch: record says %s, content hashes to %s", hash, want)
+	}
+
+	return rec, hash, nil
+}
+
+func chainHash(prev string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"github.com/mygaru/id-check/pkg/signing"
+	"os"
+	"strconv"
+)
+
+// HeadSuffix is appended to the audit log path to name the file holding the last signed head.
+// Comparing it with the log detects truncation of records that were already checkpointed.
+const HeadSuffix = ".head"
+
+// Head is the head of the chain at the last checkpoint.
+type Head struct {
+	Seq       uint64 `json:"seq"`
+	Hash      string `json:"hash"`
+	Signature string `json:"sig,omitempty"`
+}
+
+// LoadSigningKey reads the private key checkpoints are signed with.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	return signing.LoadPrivateKey(path)
+}
+
+func signedMessage(seq uint64, hash string) []byte {
+	return []byte("id-check-audit-v1\n" + strconv.FormatUint(seq, 10) + "\n" + hash)
+}
+
+func sign(signer crypto.Signer, seq uint64, hash string) (string, error) {
+	sig, err := signing.Sign(signer, signedMessage(seq, hash))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign audit checkpoint: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func verifySignature(pub crypto.PublicKey, seq uint64, hash, sig string) error {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	return signing.Verify(pub, signedMessage(seq, hash), raw)
+}
+
+func writeHead(path string, head Head) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0o600)
+}
+
+// ReadHead reads a head file written next to the audit log.
+func ReadHead(path string) (*Head, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	head := &Head{}
+	if err := json.Unmarshal(data, head); err != nil {
+		return nil, fmt.Errorf("failed to parse audit head %s: %w", path, err)
+	}
+
+	return head, nil
+}
@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bufio"
+	"crypto"
+	"fmt"
+	"io"
+)
+
+// maxProblems caps the number of problems reported by Verify.
+const maxProblems = 100
+
+// VerifyResult summarizes the verification of an audit log.
+type VerifyResult struct {
+	Records     uint64
+	Checkpoints int
+	// Unsigned is the number of records after the last checkpoint, not yet covered by a signature.
+	Unsigned uint64
+	Problems []string
+}
+
+// OK reports whether no modification, truncation or reordering was found.
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyResult) problem(format string, args ...any) {
+	if len(r.Problems) == maxProblems {
+		r.Problems = append(r.Problems, "too many problems, giving up reporting")
+	}
+	if len(r.Problems) > maxProblems {
+		return
+	}
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Verify walks the audit log in r, recomputing the hash chain and checking checkpoint signatures with pub.
+// When pub is nil signatures are not checked. When head (the content of the head file) is given,
+// the log must still contain the record it points to, which detects truncation of checkpointed records.
+func Verify(r io.Reader, pub crypto.PublicKey, head *Head) (*VerifyResult, error) {
+	res := &VerifyResult{}
+
+	if head != nil && pub != nil {
+		if head.Signature == "" {
+			res.problem("head file is not signed")
+		} else if err := verifySignature(pub, head.Seq, head.Hash, head.Signature); err != nil {
+			res.problem("head file signature: %s", err)
+		}
+	}
+
+	var (
+		expectedSeq  uint64
+		prev         = GenesisHash
+		headSeen     bool
+		lineNo       int
+		lastSeq      uint64
+		sinceSigned  uint64
+		hasAnyRecord bool
+	)
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNo++
+
+			rec, hash, decodeErr := decode(line)
+			switch {
+			case decodeErr != nil:
+				res.problem("line %d: %s", lineNo, decodeErr)
+
+			default:
+				if rec.Seq != expectedSeq {
+					res.problem("line %d: seq %d, want %d (records missing or reordered)", lineNo, rec.Seq, expectedSeq)
+				}
+				if rec.Prev != prev {
+					res.problem("line %d: seq %d does not link to the previous record (records missing or reordered)", lineNo, rec.Seq)
+				}
+
+				if rec.Type == TypeCheckpoint {
+					res.Checkpoints++
+					sinceSigned = 0
+
+					if rec.Head != rec.Prev {
+						res.problem("line %d: checkpoint head %s does not match the chain", lineNo, rec.Head)
+					}
+					if pub != nil {
+						if rec.Signature == "" {
+							res.problem("line %d: checkpoint is not signed", lineNo)
+						} else if err := verifySignature(pub, rec.Seq-1, rec.Head, rec.Signature); err != nil {
+							res.problem("line %d: checkpoint signature: %s", lineNo, err)
+						}
+					}
+				} else {
+					sinceSigned++
+				}
+
+				if head != nil && rec.Seq == head.Seq {
+					headSeen = true
+					if hash != head.Hash {
+						res.problem("line %d: seq %d differs from the signed head (log rewritten)", lineNo, rec.Seq)
+					}
+				}
+
+				res.Records++
+				hasAnyRecord = true
+				lastSeq = rec.Seq
+				expectedSeq = rec.Seq + 1
+				prev = hash
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if head != nil && !headSeen {
+		if !hasAnyRecord || lastSeq < head.Seq {
+			res.problem("log ends at seq %d but the signed head is at seq %d (log truncated)", lastSeq, head.Seq)
+		} else {
+			res.problem("record seq %d of the signed head is missing", head.Seq)
+		}
+	}
+
+	res.Unsigned = sinceSigned
+
+	return res, nil
+}
@@ -0,0 +1,223 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/route"
+	"github.com/mygaru/id-check/pkg/scopes"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var log = logger.For(logger.ComponentAuthz)
+
+var (
+	authzRulesPath      = flag.String("authzRulesPath", "", "Path to JSON file with per-route rules on which identities (names or SPIFFE ID patterns) may call a route; empty allows every identity on every route")
+	authzReloadInterval = flag.Duration("authzReloadInterval", 10*time.Second, "How often authzRulesPath is checked for changes")
+)
+
+var denials = metrics.NewCounterVec("idcheck_authz_denials_total", "Requests rejected because their identity is not authorized for the route", "route")
+
+const (
+	DefaultAllow = "allow"
+	DefaultDeny  = "deny"
+)
+
+// Rule authorizes the identities matching any of Allow (any identity when empty) that hold all of RequireScopes
+// on requests whose path starts with Route and whose method is one of Methods (any method when empty).
+// With Domain set, only identities issued within that trust bundle are authorized by the rule.
+//
+// Allow entries are identity names, * for any identity, or SPIFFE ID patterns such as
+// spiffe://prod.mygaru.internal/ns/*/sa/billing, where * matches one path segment and a trailing ** any number of them.
+type Rule struct {
+	Route         string   `json:"route"`
+	Methods       []string `json:"methods,omitempty"`
+	Allow         []string `json:"allow,omitempty"`
+	RequireScopes []string `json:"requireScopes,omitempty"`
+	Domain        string   `json:"domain,omitempty"`
+}
+
+// Config is the content of authzRulesPath.
+type Config struct {
+	Rules []Rule `json:"rules"`
+	// Default decides requests no rule matches, allow (the default) or deny.
+	Default string `json:"default,omitempty"`
+}
+
+type rule struct {
+	Rule
+	allow []pattern
+}
+
+type ruleSet struct {
+	rules        []rule
+	defaultAllow bool
+}
+
+var current atomic.Pointer[ruleSet]
+
+// Enabled reports whether authorization rules are configured.
+func Enabled() bool {
+	return *authzRulesPath != ""
+}
+
+// Init loads the rules and reloads them when the file changes. It is a no-op when authorization is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	filewatch.Watch(*authzRulesPath, *authzReloadInterval, reload, func(err error) {
+		log.Error("Failed to reload authorization rules, keeping the previous ones", "err", err)
+	})
+
+	return nil
+}
+
+func reload() error {
+	data, err := os.ReadFile(*authzRulesPath)
+	if err != nil {
+		return fmt.Errorf("failed to read authorization rules %s: %w", *authzRulesPath, err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse authorization rules %s: %w", *authzRulesPath, err)
+	}
+
+	rs, err := compile(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid authorization rules %s: %w", *authzRulesPath, err)
+	}
+
+	current.Store(rs)
+	log.Info("Loaded authorization rules", "rules", len(cfg.Rules), "default", cfg.Default)
+
+	return nil
+}
+
+func compile(cfg *Config) (*ruleSet, error) {
+	rs := &ruleSet{}
+
+	switch cfg.Default {
+	case "", DefaultAllow:
+		rs.defaultAllow = true
+	case DefaultDeny:
+	default:
+		return nil, fmt.Errorf("invalid default %q, want %s or %s", cfg.Default, DefaultAllow, DefaultDeny)
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Route == "" {
+			r.Route = "/"
+		}
+		if !strings.HasPrefix(r.Route, "/") {
+			return nil, fmt.Errorf("rule #%d: route %q must start with /", i, r.Route)
+		}
+		if len(r.Allow) == 0 && len(r.RequireScopes) == 0 {
+			return nil, fmt.Errorf("rule #%d restricts nothing, set allow or requireScopes", i)
+		}
+		for j, m := range r.Methods {
+			r.Methods[j] = strings.ToUpper(m)
+		}
+
+		compiled := rule{Rule: r}
+		for _, a := range r.Allow {
+			p, err := parsePattern(a)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d: %w", i, err)
+			}
+			compiled.allow = append(compiled.allow, p)
+		}
+		rs.rules = append(rs.rules, compiled)
+	}
+
+	return rs, nil
+}
+
+// Allowed reports whether id may call method on path. Only the rules with the longest route matching the request apply;
+// requests no rule matches are decided by the configured default.
+func Allowed(ctx context.Context, id identity.Identity, method, path string) bool {
+	rs := current.Load()
+	if rs == nil {
+		return true
+	}
+
+	route, allowed := rs.decide(id, method, path)
+	if allowed {
+		return true
+	}
+
+	denials.With(route).Inc()
+	log.WarnContext(ctx, "Identity is not authorized for route", "identity", id.Name(), "issuerDomain", id.IssuerDomain, "scopes", id.Scopes, "method", method, "path", path, "route", route)
+
+	return false
+}
+
+// decide returns the route of the applied rules, empty when the default was used, and the decision.
+func (rs *ruleSet) decide(id identity.Identity, method, path string) (string, bool) {
+	var applied []rule
+	for _, r := range rs.rules {
+		if !route.Matches(r.Route, path) || !r.matchesMethod(method) {
+			continue
+		}
+
+		switch {
+		case len(applied) == 0 || len(r.Route) > len(applied[0].Route):
+			applied = []rule{r}
+		case len(r.Route) == len(applied[0].Route):
+			applied = append(applied, r)
+		}
+	}
+
+	if len(applied) == 0 {
+		return "", rs.defaultAllow
+	}
+
+	for _, r := range applied {
+		if r.allows(id) && scopes.HasAll(id.Scopes, r.RequireScopes) {
+			return r.Route, true
+		}
+	}
+
+	return applied[0].Route, false
+}
+
+func (r rule) allows(id identity.Identity) bool {
+	if !id.InDomain(r.Domain) {
+		return false
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, p := range r.allow {
+		if p.matches(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matchesMethod(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
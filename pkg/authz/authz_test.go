@@ -0,0 +1,109 @@
+package authz
+
+import (
+	"context"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func svid(t *testing.T, s string) identity.Identity {
+	t.Helper()
+
+	id, err := spiffe.Parse(s)
+	require.NoError(t, err)
+	return identity.Identity{CommonName: "ignored", SPIFFEID: id}
+}
+
+func TestAllowed(t *testing.T) {
+	rs, err := compile(&Config{
+		Default: DefaultDeny,
+		Rules: []Rule{
+			{Route: "/", Allow: []string{"*"}, Methods: []string{"get"}},
+			{Route: "/billing", Allow: []string{"spiffe://prod.mygaru.internal/ns/*/sa/billing"}},
+			{Route: "/billing", Allow: []string{"partner-a"}},
+			{Route: "/admin", Allow: []string{"spiffe://*/ns/ops/**"}},
+		},
+	})
+	require.NoError(t, err)
+	current.Store(rs)
+	t.Cleanup(func() { current.Store(nil) })
+
+	billing := svid(t, "spiffe://prod.mygaru.internal/ns/eu/sa/billing")
+	require.True(t, Allowed(context.Background(), billing, "POST", "/billing/invoices"))
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a"}, "POST", "/billing"))
+	require.False(t, Allowed(context.Background(), svid(t, "spiffe://prod.mygaru.internal/ns/eu/sa/web"), "POST", "/billing"))
+	require.False(t, Allowed(context.Background(), svid(t, "spiffe://dev.mygaru.internal/ns/eu/sa/billing"), "POST", "/billing"))
+	require.False(t, Allowed(context.Background(), svid(t, "spiffe://prod.mygaru.internal/ns/eu/sa/billing/extra"), "POST", "/billing"))
+
+	require.True(t, Allowed(context.Background(), svid(t, "spiffe://dev.mygaru.internal/ns/ops/sa/deploy"), "DELETE", "/admin/cache"))
+	require.True(t, Allowed(context.Background(), svid(t, "spiffe://dev.mygaru.internal/ns/ops"), "DELETE", "/admin/cache"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "spiffe://dev.mygaru.internal/ns/ops"}, "DELETE", "/admin/cache"))
+
+	// the longest matching route wins, shorter ones are not consulted
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b"}, "GET", "/billing"))
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b"}, "GET", "/lookup"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b"}, "POST", "/lookup"))
+}
+
+func TestAllowed_Domain(t *testing.T) {
+	rs, err := compile(&Config{Rules: []Rule{
+		{Route: "/billing", Allow: []string{"partner-a"}, Domain: "mygaru"},
+	}})
+	require.NoError(t, err)
+	current.Store(rs)
+	t.Cleanup(func() { current.Store(nil) })
+
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "mygaru"}, "GET", "/billing"))
+	// the same CN issued by another CA
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "partner-ca"}, "GET", "/billing"))
+}
+
+func TestAllowed_WholeSegments(t *testing.T) {
+	rs, err := compile(&Config{
+		Default: DefaultAllow,
+		Rules:   []Rule{{Route: "/pub", Allow: []string{"partner-a"}}},
+	})
+	require.NoError(t, err)
+	current.Store(rs)
+	t.Cleanup(func() { current.Store(nil) })
+
+	partnerB := identity.Identity{CommonName: "partner-b"}
+	require.False(t, Allowed(context.Background(), partnerB, "GET", "/pub"))
+	require.False(t, Allowed(context.Background(), partnerB, "GET", "/pub/feed"))
+	// /public is not below /pub, the default decides
+	require.True(t, Allowed(context.Background(), partnerB, "GET", "/public"))
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Default: "maybe"},
+		{Rules: []Rule{{Route: "billing", Allow: []string{"*"}}}},
+		{Rules: []Rule{{Route: "/billing"}}},
+		{Rules: []Rule{{Route: "/billing", Allow: []string{"spiffe:///ns"}}}},
+		{Rules: []Rule{{Route: "/billing", Allow: []string{"spiffe://prod/ns/**/sa"}}}},
+		{Rules: []Rule{{Route: "/billing", Allow: []string{"spiffe://prod/ns//sa"}}}},
+	} {
+		_, err := compile(cfg)
+		require.Error(t, err)
+	}
+}
+
+func TestAllowed_RequireScopes(t *testing.T) {
+	rs, err := compile(&Config{Rules: []Rule{
+		{Route: "/lookup", RequireScopes: []string{"product:lookup"}},
+		{Route: "/lookup/bulk", Allow: []string{"partner-a"}, RequireScopes: []string{"product:lookup", "ids:bulk"}},
+	}})
+	require.NoError(t, err)
+	current.Store(rs)
+	t.Cleanup(func() { current.Store(nil) })
+
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b", Scopes: []string{"product:lookup"}}, "GET", "/lookup"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b", Scopes: []string{"product:batch"}}, "GET", "/lookup"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b"}, "GET", "/lookup"))
+
+	require.True(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", Scopes: []string{"ids:bulk", "product:lookup"}}, "GET", "/lookup/bulk"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-a", Scopes: []string{"product:lookup"}}, "GET", "/lookup/bulk"))
+	require.False(t, Allowed(context.Background(), identity.Identity{CommonName: "partner-b", Scopes: []string{"ids:bulk", "product:lookup"}}, "GET", "/lookup/bulk"))
+}
@@ -0,0 +1,77 @@
+package authz
+
+import (
+	"fmt"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"strings"
+)
+
+const (
+	// Wildcard matches any identity, or one SPIFFE ID path segment.
+	Wildcard = "*"
+	// Rest matches any number of trailing SPIFFE ID path segments.
+	Rest = "**"
+)
+
+// pattern matches an identity by name, or by trust domain and path segments of its SPIFFE ID.
+type pattern struct {
+	name        string
+	spiffe      bool
+	trustDomain string
+	segments    []string
+}
+
+func parsePattern(s string) (pattern, error) {
+	prefix := spiffe.Scheme + "://"
+	if !strings.HasPrefix(s, prefix) {
+		return pattern{name: s}, nil
+	}
+
+	domain, path, _ := strings.Cut(strings.TrimPrefix(s, prefix), "/")
+	if domain == "" {
+		return pattern{}, fmt.Errorf("SPIFFE ID pattern %q has no trust domain", s)
+	}
+
+	p := pattern{spiffe: true, trustDomain: domain}
+	if path != "" {
+		p.segments = strings.Split(path, "/")
+	}
+	for i, seg := range p.segments {
+		if seg == "" {
+			return pattern{}, fmt.Errorf("SPIFFE ID pattern %q has empty path segments", s)
+		}
+		if seg == Rest && i != len(p.segments)-1 {
+			return pattern{}, fmt.Errorf("SPIFFE ID pattern %q may only end with %s", s, Rest)
+		}
+	}
+
+	return p, nil
+}
+
+func (p pattern) matches(id identity.Identity) bool {
+	if !p.spiffe {
+		return p.name == Wildcard || p.name == id.Name()
+	}
+
+	if id.SPIFFEID.IsZero() {
+		return false
+	}
+	if p.trustDomain != Wildcard && p.trustDomain != id.SPIFFEID.TrustDomain {
+		return false
+	}
+
+	return matchSegments(p.segments, id.SPIFFEID.Segments())
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for i, p := range pattern {
+		if p == Rest {
+			return true
+		}
+		if i >= len(segments) || (p != Wildcard && p != segments[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
@@ -0,0 +1,253 @@
+package certpolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/identity"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Violation reasons, reported as handshake failure reasons.
+const (
+	ReasonKeyType  = "policy_key_type"
+	ReasonKeySize  = "policy_key_size"
+	ReasonEKU      = "policy_eku"
+	ReasonValidity = "policy_validity"
+	ReasonSubject  = "policy_subject"
+	ReasonSAN      = "policy_san"
+	ReasonIssuer   = "policy_issuer"
+)
+
+// Key algorithms of KeyAlgorithms.
+const (
+	AlgRSA     = "rsa"
+	AlgECDSA   = "ecdsa"
+	AlgEd25519 = "ed25519"
+)
+
+// Fields that FieldRule can match.
+var fields = map[string]func(c *x509.Certificate) []string{
+	"subject.CN": func(c *x509.Certificate) []string { return nonEmpty(c.Subject.CommonName) },
+	"subject.O":  func(c *x509.Certificate) []string { return c.Subject.Organization },
+	"subject.OU": func(c *x509.Certificate) []string { return c.Subject.OrganizationalUnit },
+	"subject.C":  func(c *x509.Certificate) []string { return c.Subject.Country },
+	"subject.ST": func(c *x509.Certificate) []string { return c.Subject.Province },
+	"subject.L":  func(c *x509.Certificate) []string { return c.Subject.Locality },
+	"san.dns":    func(c *x509.Certificate) []string { return c.DNSNames },
+	"san.email":  func(c *x509.Certificate) []string { return c.EmailAddresses },
+	"san.uri": func(c *x509.Certificate) []string {
+		out := make([]string, 0, len(c.URIs))
+		for _, u := range c.URIs {
+			out = append(out, u.String())
+		}
+		return out
+	},
+	"san.ip": func(c *x509.Certificate) []string {
+		out := make([]string, 0, len(c.IPAddresses))
+		for _, ip := range c.IPAddresses {
+			out = append(out, ip.String())
+		}
+		return out
+	},
+}
+
+// FieldRule constrains a subject attribute or SAN type of the client certificate.
+type FieldRule struct {
+	// Field is one of subject.CN, subject.O, subject.OU, subject.C, subject.ST, subject.L, san.dns, san.email, san.uri or san.ip.
+	Field string `json:"field"`
+	// Require fails certificates without a value for Field.
+	Require bool `json:"require,omitempty"`
+	// Forbid fails certificates with any value for Field.
+	Forbid bool `json:"forbid,omitempty"`
+	// Pattern is a regular expression every value of Field must match in full.
+	Pattern string `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Policy is the content of the certificate policy file. Zero values disable the respective check.
+type Policy struct {
+	// KeyAlgorithms lists the allowed public key algorithms of client certificates: rsa, ecdsa, ed25519.
+	KeyAlgorithms []string `json:"keyAlgorithms,omitempty"`
+	MinRSABits    int      `json:"minRsaBits,omitempty"`
+	MinECDSABits  int      `json:"minEcdsaBits,omitempty"`
+	// RequireClientAuthEKU fails certificates without an explicit clientAuth extended key usage;
+	// certificates without any EKU are otherwise valid for client authentication.
+	RequireClientAuthEKU bool `json:"requireClientAuthEku,omitempty"`
+	// MaxValidityDays caps the NotBefore..NotAfter period of client certificates.
+	MaxValidityDays int         `json:"maxValidityDays,omitempty"`
+	Fields          []FieldRule `json:"fields,omitempty"`
+	// AllowedIssuerCNs and AllowedIssuerSPKIs restrict the intermediate that issued the client certificate,
+	// by subject CN or SPKI SHA-256 fingerprint. The certificate passes if the issuer matches either list.
+	AllowedIssuerCNs   []string `json:"allowedIssuerCNs,omitempty"`
+	AllowedIssuerSPKIs []string `json:"allowedIssuerSpkis,omitempty"`
+}
+
+// Violation is a failed policy check.
+type Violation struct {
+	Reason string
+	Detail string
+}
+
+func (v *Violation) Error() string {
+	return "certificate policy violation: " + v.Detail
+}
+
+// Load reads and validates a policy file.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate policy %s: %w", path, err)
+	}
+
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate policy %s: %w", path, err)
+	}
+
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("invalid certificate policy %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+func (p *Policy) compile() error {
+	for _, alg := range p.KeyAlgorithms {
+		if alg != AlgRSA && alg != AlgECDSA && alg != AlgEd25519 {
+			return fmt.Errorf("unsupported key algorithm %q", alg)
+		}
+	}
+
+	for i := range p.Fields {
+		r := &p.Fields[i]
+		if _, ok := fields[r.Field]; !ok {
+			return fmt.Errorf("unsupported field %q", r.Field)
+		}
+		if r.Require && r.Forbid {
+			return fmt.Errorf("field %s is both required and forbidden", r.Field)
+		}
+		if r.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + r.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid pattern of field %s: %w", r.Field, err)
+			}
+			r.re = re
+		}
+	}
+
+	for i, spki := range p.AllowedIssuerSPKIs {
+		p.AllowedIssuerSPKIs[i] = strings.ToLower(spki)
+	}
+
+	return nil
+}
+
+// Evaluate checks a verified chain, leaf first, against the policy and returns the first violation.
+func (p *Policy) Evaluate(chain []*x509.Certificate) *Violation {
+	if p == nil || len(chain) == 0 {
+		return nil
+	}
+	leaf := chain[0]
+
+	if v := p.checkKey(leaf); v != nil {
+		return v
+	}
+
+	if p.RequireClientAuthEKU && !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageClientAuth) {
+		return &Violation{ReasonEKU, "clientAuth extended key usage is missing"}
+	}
+
+	if p.MaxValidityDays > 0 {
+		maxValidity := time.Duration(p.MaxValidityDays) * 24 * time.Hour
+		if validity := leaf.NotAfter.Sub(leaf.NotBefore); validity > maxValidity {
+			return &Violation{ReasonValidity, fmt.Sprintf("validity of %d days exceeds %d days", int(validity.Hours()/24), p.MaxValidityDays)}
+		}
+	}
+
+	for i := range p.Fields {
+		if v := p.Fields[i].check(leaf); v != nil {
+			return v
+		}
+	}
+
+	if len(p.AllowedIssuerCNs) > 0 || len(p.AllowedIssuerSPKIs) > 0 {
+		if len(chain) < 2 {
+			return &Violation{ReasonIssuer, "issuer is not part of the chain"}
+		}
+		issuer := chain[1]
+		if !slices.Contains(p.AllowedIssuerCNs, issuer.Subject.CommonName) && !slices.Contains(p.AllowedIssuerSPKIs, identity.SPKIFingerprint(issuer)) {
+			return &Violation{ReasonIssuer, fmt.Sprintf("issuer %q is not allowed", issuer.Subject.CommonName)}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkKey(leaf *x509.Certificate) *Violation {
+	var alg string
+	var bits int
+	switch k := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		alg, bits = AlgRSA, k.N.BitLen()
+	case *ecdsa.PublicKey:
+		alg, bits = AlgECDSA, k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		alg = AlgEd25519
+	default:
+		alg = strings.ToLower(leaf.PublicKeyAlgorithm.String())
+	}
+
+	if len(p.KeyAlgorithms) > 0 && !slices.Contains(p.KeyAlgorithms, alg) {
+		return &Violation{ReasonKeyType, fmt.Sprintf("%s keys are not allowed", alg)}
+	}
+
+	switch {
+	case alg == AlgRSA && bits < p.MinRSABits:
+		return &Violation{ReasonKeySize, fmt.Sprintf("RSA key of %d bits is shorter than %d", bits, p.MinRSABits)}
+	case alg == AlgECDSA && bits < p.MinECDSABits:
+		return &Violation{ReasonKeySize, fmt.Sprintf("ECDSA key of %d bits is shorter than %d", bits, p.MinECDSABits)}
+	}
+
+	return nil
+}
+
+func (r *FieldRule) check(leaf *x509.Certificate) *Violation {
+	reason := ReasonSubject
+	if strings.HasPrefix(r.Field, "san.") {
+		reason = ReasonSAN
+	}
+
+	values := fields[r.Field](leaf)
+	switch {
+	case r.Require && len(values) == 0:
+		return &Violation{reason, r.Field + " is required"}
+	case r.Forbid && len(values) > 0:
+		return &Violation{reason, r.Field + " is forbidden"}
+	}
+
+	if r.re != nil {
+		for _, v := range values {
+			if !r.re.MatchString(v) {
+				return &Violation{reason, fmt.Sprintf("%s %q does not match %s", r.Field, v, r.Pattern)}
+			}
+		}
+	}
+
+	return nil
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
@@ -0,0 +1,160 @@
+package certpolicy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type issued struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func issue(t *testing.T, tmpl *x509.Certificate, key crypto.Signer, parent *issued) *issued {
+	t.Helper()
+
+	signerCert, signerKey := tmpl, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, key.Public(), signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &issued{cert: cert, key: key}
+}
+
+func ecKey(t *testing.T, curve elliptic.Curve) crypto.Signer {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func testChain(t *testing.T, leafKey crypto.Signer, mutate func(c *x509.Certificate)) []*x509.Certificate {
+	t.Helper()
+
+	intermediate := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Partners Issuing CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, ecKey(t, elliptic.P256()), nil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "partner-a", Organization: []string{"Partner A"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: "partners.mygaru.com", Path: "/partner-a"}},
+	}
+	if mutate != nil {
+		mutate(tmpl)
+	}
+
+	leaf := issue(t, tmpl, leafKey, intermediate)
+	return []*x509.Certificate{leaf.cert, intermediate.cert}
+}
+
+func TestEvaluate(t *testing.T) {
+	p := &Policy{
+		KeyAlgorithms:        []string{AlgECDSA, AlgRSA},
+		MinRSABits:           2048,
+		MinECDSABits:         256,
+		RequireClientAuthEKU: true,
+		MaxValidityDays:      398,
+		Fields: []FieldRule{
+			{Field: "subject.O", Require: true, Pattern: "Partner .+"},
+			{Field: "subject.OU", Forbid: true},
+			{Field: "san.uri", Pattern: `spiffe://partners\.mygaru\.com/.+`},
+			{Field: "san.dns", Forbid: true},
+		},
+		AllowedIssuerCNs: []string{"Partners Issuing CA"},
+	}
+	require.NoError(t, p.compile())
+
+	require.Nil(t, p.Evaluate(testChain(t, ecKey(t, elliptic.P256()), nil)))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name   string
+		key    crypto.Signer
+		mutate func(c *x509.Certificate)
+		reason string
+	}{
+		{"small rsa key", rsaKey, nil, ReasonKeySize},
+		{"small ecdsa key", ecKey(t, elliptic.P224()), nil, ReasonKeySize},
+		{"no eku", nil, func(c *x509.Certificate) { c.ExtKeyUsage = nil }, ReasonEKU},
+		{"long validity", nil, func(c *x509.Certificate) { c.NotAfter = c.NotBefore.Add(800 * 24 * time.Hour) }, ReasonValidity},
+		{"missing O", nil, func(c *x509.Certificate) { c.Subject.Organization = nil }, ReasonSubject},
+		{"wrong O", nil, func(c *x509.Certificate) { c.Subject.Organization = []string{"Someone"} }, ReasonSubject},
+		{"forbidden OU", nil, func(c *x509.Certificate) { c.Subject.OrganizationalUnit = []string{"Ops"} }, ReasonSubject},
+		{"foreign spiffe id", nil, func(c *x509.Certificate) { c.URIs[0].Host = "evil.example" }, ReasonSAN},
+		{"dns san", nil, func(c *x509.Certificate) { c.DNSNames = []string{"partner-a.example"} }, ReasonSAN},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			key := c.key
+			if key == nil {
+				key = ecKey(t, elliptic.P256())
+			}
+			v := p.Evaluate(testChain(t, key, c.mutate))
+			require.NotNil(t, v)
+			require.Equal(t, c.reason, v.Reason)
+		})
+	}
+
+	p.KeyAlgorithms = []string{AlgRSA}
+	v := p.Evaluate(testChain(t, ecKey(t, elliptic.P256()), nil))
+	require.NotNil(t, v)
+	require.Equal(t, ReasonKeyType, v.Reason)
+
+	p.KeyAlgorithms = nil
+	p.AllowedIssuerCNs = []string{"Other CA"}
+	v = p.Evaluate(testChain(t, ecKey(t, elliptic.P256()), nil))
+	require.NotNil(t, v)
+	require.Equal(t, ReasonIssuer, v.Reason)
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.json")
+	require.NoError(t, os.WriteFile(valid, []byte(`{"minRsaBits":2048,"fields":[{"field":"subject.O","pattern":"A|B"}]}`), 0o644))
+	p, err := Load(valid)
+	require.NoError(t, err)
+	require.True(t, p.Fields[0].re.MatchString("B"))
+	require.False(t, p.Fields[0].re.MatchString("AB"))
+
+	for name, content := range map[string]string{
+		"field.json":   `{"fields":[{"field":"subject.serial"}]}`,
+		"both.json":    `{"fields":[{"field":"subject.OU","require":true,"forbid":true}]}`,
+		"pattern.json": `{"fields":[{"field":"subject.OU","pattern":"("}]}`,
+		"alg.json":     `{"keyAlgorithms":["dsa"]}`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err := Load(path)
+		require.Error(t, err, name)
+	}
+}
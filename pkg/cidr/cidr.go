@@ -0,0 +1,66 @@
+package cidr
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// List is a set of network prefixes.
+type List []netip.Prefix
+
+// Parse parses a comma-separated list of CIDRs; bare addresses are single-host prefixes.
+func Parse(list string) (List, error) {
+	var out List
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Contains reports whether ip is within any prefix of l.
+func (l List) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP of a TCP or UDP address is within any prefix of l.
+func (l List) ContainsAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return l.Contains(a.IP)
+	case *net.UDPAddr:
+		return l.Contains(a.IP)
+	case *net.IPAddr:
+		return l.Contains(a.IP)
+	}
+	return false
+}
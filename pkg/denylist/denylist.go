@@ -0,0 +1,417 @@
+package denylist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentDenylist)
+
+var (
+	denylistPath = flag.String("denylistPath", "", "Path to JSON file with denied certificate serials, SPKI fingerprints, SPIFFE IDs and CNs, checked at handshake and on every request; "+
+		"empty disables the denylist")
+	denylistReloadInterval = flag.Duration("denylistReloadInterval", 5*time.Second, "How often denylistPath is checked for changes")
+)
+
+var hits = metrics.NewCounterVec("idcheck_denylist_hits_total", "Handshakes and requests rejected by the denylist", "stage")
+
+// Stages at which the denylist is consulted.
+const (
+	StageHandshake = "handshake"
+	StageRequest   = "request"
+)
+
+// Kinds of certificate attributes an entry matches on.
+const (
+	KindCN     = "cn"
+	KindSPIFFE = "spiffe"
+	KindSerial = "serial"
+	KindSPKI   = "spki"
+)
+
+// Entry denies the certificates matching exactly one of CommonName, SPIFFEID, Serial or SPKI.
+// CommonName only matches certificates without a SPIFFE ID. With Domain set, it only denies certificates
+// issued within that trust bundle.
+type Entry struct {
+	CommonName string    `json:"cn,omitempty"`
+	SPIFFEID   string    `json:"spiffe,omitempty"`
+	Serial     string    `json:"serial,omitempty"`
+	SPKI       string    `json:"spki,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	AddedAt    time.Time `json:"addedAt,omitempty"`
+}
+
+// Config is the content of denylistPath.
+type Config struct {
+	Entries []Entry `json:"entries"`
+}
+
+// key returns the kind and value the entry matches on.
+func (e Entry) key() (kind, value string, err error) {
+	set := 0
+	for _, k := range []struct{ kind, value string }{{KindCN, e.CommonName}, {KindSPIFFE, e.SPIFFEID}, {KindSerial, e.Serial}, {KindSPKI, e.SPKI}} {
+		if k.value != "" {
+			kind, value = k.kind, k.value
+			set++
+		}
+	}
+	if set != 1 {
+		return "", "", fmt.Errorf("set exactly one of cn, spiffe, serial or spki")
+	}
+
+	switch kind {
+	case KindSPIFFE:
+		id, err := spiffe.Parse(value)
+		if err != nil {
+			return "", "", err
+		}
+		value = id.String()
+	case KindSPKI:
+		value = strings.ToLower(value)
+	}
+	return kind, value, nil
+}
+
+// mapKey returns the key of the entry in entries.
+func (e Entry) mapKey() (string, error) {
+	kind, value, err := e.key()
+	if err != nil {
+		return "", err
+	}
+	return entryKey(kind, value, e.Domain), nil
+}
+
+// entryKey returns the key of the entry matching value of kind within domain, empty for any issuer.
+func entryKey(kind, value, domain string) string {
+	if domain == "" {
+		return kind + "\x00" + value
+	}
+	return kind + "\x00" + value + "\x00" + domain
+}
+
+// equal compares entries regardless of the location and monotonic clock reading of AddedAt.
+func (e Entry) equal(o Entry) bool {
+	return e.CommonName == o.CommonName && e.SPIFFEID == o.SPIFFEID && e.Serial == o.Serial && e.SPKI == o.SPKI &&
+		e.Domain == o.Domain && e.Reason == o.Reason && e.AddedAt.Equal(o.AddedAt)
+}
+
+var (
+	mu             sync.RWMutex
+	entries        = map[string]Entry{} // entryKey -> entry
+	listeners      []func()
+	localListeners []func(e Entry, removed bool)
+)
+
+// Enabled reports whether the denylist is configured.
+func Enabled() bool {
+	return *denylistPath != ""
+}
+
+// Init loads the denylist and reloads it when the file changes. A missing file is an empty denylist.
+// It is a no-op when the denylist is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	filewatch.Watch(*denylistPath, *denylistReloadInterval, reload, func(err error) {
+		log.Error("Failed to reload denylist, keeping the previous one", "err", err)
+	})
+
+	return nil
+}
+
+// OnChange registers f to be called after the denylist changed, e.g. to close connections of newly denied identities.
+func OnChange(f func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	listeners = append(listeners, f)
+}
+
+// OnLocalChange registers f to be called for every entry added or removed on this instance,
+// through the admin API, Add, Remove or an edit of denylistPath, but not by ApplyRemote.
+func OnLocalChange(f func(e Entry, removed bool)) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	localListeners = append(localListeners, f)
+}
+
+type change struct {
+	entry   Entry
+	removed bool
+}
+
+// notify calls the OnChange listeners, and the OnLocalChange listeners with local changes.
+func notify(local []change) {
+	mu.RLock()
+	fs, lfs := listeners, localListeners
+	mu.RUnlock()
+
+	for _, f := range fs {
+		f()
+	}
+	for _, c := range local {
+		for _, f := range lfs {
+			f(c.entry, c.removed)
+		}
+	}
+}
+
+func reload() error {
+	loaded, err := load(*denylistPath)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	var changes []change
+	for k, e := range loaded {
+		if prev, ok := entries[k]; !ok || !prev.equal(e) {
+			changes = append(changes, change{entry: e})
+		}
+	}
+	for k, e := range entries {
+		if _, ok := loaded[k]; !ok {
+			changes = append(changes, change{entry: e, removed: true})
+		}
+	}
+	entries = loaded
+	mu.Unlock()
+
+	log.Info("Loaded denylist", "entries", len(loaded))
+	notify(changes)
+
+	return nil
+}
+
+func load(path string) (map[string]Entry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]Entry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read denylist %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse denylist %s: %w", path, err)
+	}
+
+	out := make(map[string]Entry, len(cfg.Entries))
+	for i, e := range cfg.Entries {
+		k, err := e.mapKey()
+		if err != nil {
+			return nil, fmt.Errorf("entry #%d in %s: %w", i, path, err)
+		}
+		out[k] = e
+	}
+
+	return out, nil
+}
+
+// persist writes the entries to denylistPath. The caller must hold mu.
+func persist() error {
+	data, err := json.MarshalIndent(Config{Entries: sortedEntries()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(*denylistPath, data, 0o644)
+}
+
+// sortedEntries returns the entries in a stable order. The caller must hold mu.
+func sortedEntries() []Entry {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, entries[k])
+	}
+	return out
+}
+
+// Lookup returns the entry denying id, if any, matching its serial, SPKI fingerprint and name (SPIFFE ID or CN)
+// in that order. For each of them an entry of the issuer domain of id wins over one for any issuer.
+func Lookup(id identity.Identity) (Entry, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	name := struct{ kind, value string }{KindCN, id.CommonName}
+	if !id.SPIFFEID.IsZero() {
+		name = struct{ kind, value string }{KindSPIFFE, id.SPIFFEID.String()}
+	}
+
+	for _, k := range []struct{ kind, value string }{{KindSerial, id.Serial}, {KindSPKI, id.Fingerprint}, name} {
+		if k.value == "" {
+			continue
+		}
+		for _, domain := range []string{id.IssuerDomain, ""} {
+			if e, ok := entries[entryKey(k.kind, k.value, domain)]; ok {
+				return e, true
+			}
+		}
+	}
+	return Entry{}, false
+}
+
+// Check reports whether id may connect, counting and logging denials at stage with the attributes of ctx.
+func Check(ctx context.Context, id identity.Identity, stage string) bool {
+	if !Enabled() {
+		return true
+	}
+
+	e, denied := Lookup(id)
+	if !denied {
+		return true
+	}
+
+	hits.With(stage).Inc()
+	log.WarnContext(ctx, "Denied certificate", "stage", stage, "identity", id.Name(), "issuerDomain", id.IssuerDomain, "serial", id.Serial, "spki", id.Fingerprint, "reason", e.Reason)
+
+	return false
+}
+
+// Add denies the certificates matching e, persisting the denylist before the change takes effect.
+// An existing entry for the same certificate attribute is replaced.
+func Add(e Entry) error {
+	if e.AddedAt.IsZero() {
+		e.AddedAt = time.Now().UTC()
+	}
+	return apply(e, false, true)
+}
+
+// Remove lifts the denial of the entry for the certificate attribute set in e. Removing a missing entry is a no-op.
+func Remove(e Entry) error {
+	return apply(e, true, true)
+}
+
+// ApplyRemote adds or removes e as learned from another id-check instance. It is not reported to OnLocalChange listeners,
+// so changes are not sent back.
+func ApplyRemote(e Entry, removed bool) error {
+	return apply(e, removed, false)
+}
+
+// ReplaceRemote replaces the denylist with entries, the complete denylist of another id-check instance,
+// so entries it removed while the instances were out of sync are lifted here too. Like ApplyRemote,
+// it is not reported to OnLocalChange listeners.
+func ReplaceRemote(list []Entry) error {
+	next := make(map[string]Entry, len(list))
+	for i, e := range list {
+		k, err := e.mapKey()
+		if err != nil {
+			return fmt.Errorf("entry #%d: %w", i, err)
+		}
+		next[k] = e
+	}
+
+	mu.Lock()
+	unchanged := len(next) == len(entries)
+	for k, e := range next {
+		if prev, ok := entries[k]; !ok || !prev.equal(e) {
+			unchanged = false
+			break
+		}
+	}
+	if unchanged {
+		mu.Unlock()
+		return nil
+	}
+
+	prev := entries
+	entries = next
+	if err := persist(); err != nil {
+		entries = prev
+		mu.Unlock()
+		return err
+	}
+	mu.Unlock()
+
+	notify(nil)
+	return nil
+}
+
+// Entries returns the current entries.
+func Entries() []Entry {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return sortedEntries()
+}
+
+func apply(e Entry, removed, local bool) error {
+	key, err := e.mapKey()
+	if err != nil {
+		return err
+	}
+
+	mu.RLock()
+	prev, ok := entries[key]
+	mu.RUnlock()
+	if removed && !ok || !removed && ok && prev.equal(e) {
+		return nil
+	}
+
+	if removed {
+		return update(key, nil, local)
+	}
+	return update(key, &e, local)
+}
+
+// update adds (e != nil) or removes the entry under key, persisting the denylist before the change takes effect.
+// Local changes are reported to the OnLocalChange listeners.
+func update(key string, e *Entry, local bool) error {
+	mu.Lock()
+
+	next := make(map[string]Entry, len(entries)+1)
+	for k, v := range entries {
+		next[k] = v
+	}
+	var changes []change
+	if e != nil {
+		next[key] = *e
+		changes = append(changes, change{entry: *e})
+	} else {
+		changes = append(changes, change{entry: entries[key], removed: true})
+		delete(next, key)
+	}
+
+	prev := entries
+	entries = next
+	if err := persist(); err != nil {
+		entries = prev
+		mu.Unlock()
+		return err
+	}
+	mu.Unlock()
+
+	if !local {
+		changes = nil
+	}
+	notify(changes)
+	return nil
+}
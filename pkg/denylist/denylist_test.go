@@ -0,0 +1,171 @@
+package denylist
+
+import (
+	"context"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/problem"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useDenylist(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	if content != "" {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	prevPath, prevInterval := *denylistPath, *denylistReloadInterval
+	*denylistPath, *denylistReloadInterval = path, 10*time.Millisecond
+	t.Cleanup(func() {
+		*denylistPath, *denylistReloadInterval = prevPath, prevInterval
+		mu.Lock()
+		entries, listeners = map[string]Entry{}, nil
+		mu.Unlock()
+	})
+
+	require.NoError(t, Init())
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	useDenylist(t, `{"entries": [{"serial": "42", "reason": "key leaked"}, {"spki": "ABCD"}, {"cn": "partner-x"}]}`)
+
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Serial: "42"}, StageRequest))
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Fingerprint: "abcd"}, StageRequest))
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-x"}, StageHandshake))
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Serial: "43"}, StageRequest))
+
+	e, _ := Lookup(identity.Identity{Serial: "42"})
+	require.Equal(t, "key leaked", e.Reason)
+
+	_, err := load(writeFile(t, `{"entries": [{"cn": "a", "serial": "1"}]}`))
+	require.Error(t, err)
+}
+
+func TestCheck_SPIFFEAndDomain(t *testing.T) {
+	useDenylist(t, `{"entries": [
+		{"spiffe": "spiffe://prod.mygaru.internal/ns/eu/sa/billing"},
+		{"cn": "partner-a", "domain": "partner-ca"},
+		{"serial": "7", "domain": "mygaru"}
+	]}`)
+
+	billing, err := spiffe.Parse("spiffe://prod.mygaru.internal/ns/eu/sa/billing")
+	require.NoError(t, err)
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "any", SPIFFEID: billing, IssuerDomain: "prod.mygaru.internal"}, StageRequest))
+
+	// the CN of an SVID is not its identity
+	web, err := spiffe.Parse("spiffe://prod.mygaru.internal/ns/eu/sa/web")
+	require.NoError(t, err)
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", SPIFFEID: web, IssuerDomain: "partner-ca"}, StageRequest))
+
+	// entries with a domain only deny certificates of that issuer domain
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "partner-ca"}, StageRequest))
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "mygaru"}, StageRequest))
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", Serial: "7", IssuerDomain: "mygaru"}, StageRequest))
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", Serial: "7", IssuerDomain: "partner-ca"}, StageRequest))
+
+	_, err = load(writeFile(t, `{"entries": [{"spiffe": "spiffe://Prod/ns"}]}`))
+	require.Error(t, err)
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func adminRequest(method, uri, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	AdminHandler(ctx)
+	return ctx
+}
+
+func TestAdminHandler(t *testing.T) {
+	// the file does not exist yet
+	path := useDenylist(t, "")
+
+	var changes atomic.Int32
+	OnChange(func() { changes.Add(1) })
+
+	leaked := identity.Identity{CommonName: "partner-a", Serial: "42", Fingerprint: "abcd"}
+	require.True(t, Check(context.Background(), leaked, StageRequest))
+
+	ctx := adminRequest(fasthttp.MethodPut, "/denylist/spki/ABCD", `{"reason": "key leaked"}`)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.False(t, Check(context.Background(), leaked, StageRequest))
+	require.GreaterOrEqual(t, changes.Load(), int32(1))
+
+	persisted, err := load(path)
+	require.NoError(t, err)
+	require.Equal(t, "key leaked", persisted[KindSPKI+"\x00abcd"].Reason)
+
+	require.Equal(t, fasthttp.StatusNotFound, adminRequest(fasthttp.MethodDelete, "/denylist/cn/partner-a", "").Response.StatusCode())
+	require.Equal(t, fasthttp.StatusNoContent, adminRequest(fasthttp.MethodDelete, "/denylist/spki/abcd", "").Response.StatusCode())
+	require.True(t, Check(context.Background(), leaked, StageRequest))
+
+	require.Equal(t, fasthttp.StatusBadRequest, adminRequest(fasthttp.MethodPut, "/denylist/cn/partner-a", `{`).Response.StatusCode())
+
+	// the normalized path of a SPIFFE ID loses a slash of the scheme, which may also be left out
+	require.Equal(t, fasthttp.StatusOK, adminRequest(fasthttp.MethodPut, "/denylist/spiffe/spiffe://prod.mygaru.internal/ns/ops?domain=prod.mygaru.internal", "").Response.StatusCode())
+	persisted, err = load(path)
+	require.NoError(t, err)
+	require.Contains(t, persisted, KindSPIFFE+"\x00spiffe://prod.mygaru.internal/ns/ops\x00prod.mygaru.internal")
+	require.Equal(t, fasthttp.StatusNotFound, adminRequest(fasthttp.MethodDelete, "/denylist/spiffe/prod.mygaru.internal/ns/ops", "").Response.StatusCode())
+	require.Equal(t, fasthttp.StatusNoContent, adminRequest(fasthttp.MethodDelete, "/denylist/spiffe/prod.mygaru.internal/ns/ops?domain=prod.mygaru.internal", "").Response.StatusCode())
+
+	ctx = adminRequest(fasthttp.MethodPut, "/denylist/email/x", "")
+	require.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	require.Equal(t, problem.ContentType, string(ctx.Response.Header.ContentType()))
+}
+
+func TestHotReload(t *testing.T) {
+	path := useDenylist(t, `{"entries": []}`)
+
+	changed := make(chan struct{}, 10)
+	OnChange(func() { changed <- struct{}{} })
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"entries": [{"cn": "partner-a"}]}`), 0o644))
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("denylist was not reloaded")
+	}
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-a"}, StageRequest))
+}
+
+func TestOnLocalChange(t *testing.T) {
+	useDenylist(t, `{"entries": []}`)
+
+	var local []string
+	OnLocalChange(func(e Entry, removed bool) {
+		if removed {
+			local = append(local, "-"+e.Serial)
+		} else {
+			local = append(local, "+"+e.Serial)
+		}
+	})
+
+	require.NoError(t, Add(Entry{Serial: "1"}))
+	require.NoError(t, ApplyRemote(Entry{Serial: "2", AddedAt: time.Now()}, false))
+	require.NoError(t, Remove(Entry{Serial: "1"}))
+	require.NoError(t, Remove(Entry{Serial: "1"}))
+	require.Equal(t, []string{"+1", "-1"}, local)
+	require.Len(t, Entries(), 1)
+
+	// reloading the persisted file is not a change
+	require.NoError(t, reload())
+	require.Equal(t, []string{"+1", "-1"}, local)
+}
@@ -0,0 +1,111 @@
+package denylist
+
+import (
+	"encoding/json"
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/mygaru/id-check/pkg/problem"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"time"
+)
+
+// AdminHandler manages the denylist:
+//
+//	GET    /denylist                              lists every entry
+//	PUT    /denylist/{cn|spiffe|serial|spki}/{v}  denies certificates, with an optional {"reason": "..."} body
+//	DELETE /denylist/{cn|spiffe|serial|spki}/{v}  lifts the denial
+//
+// ?domain= addresses the entry limited to certificates of that issuer domain. SPIFFE IDs may be given without
+// their scheme, e.g. /denylist/spiffe/prod.mygaru.internal/ns/eu/sa/billing.
+// Changes are written to denylistPath before they take effect; open connections of newly denied certificates are closed.
+func AdminHandler(ctx *fasthttp.RequestCtx) {
+	if !Enabled() {
+		problem.Write(ctx, fasthttp.StatusNotFound, "Not Found", "denylist is disabled")
+		return
+	}
+
+	sub := admin.Subpath(ctx, "/denylist")
+	if sub == "" {
+		if !ctx.IsGet() {
+			problem.Write(ctx, fasthttp.StatusMethodNotAllowed, "Method Not Allowed", "")
+			return
+		}
+		mu.RLock()
+		defer mu.RUnlock()
+		admin.WriteJSON(ctx, Config{Entries: sortedEntries()})
+		return
+	}
+
+	kind, value, ok := strings.Cut(sub, "/")
+	if !ok || value == "" || (kind != KindCN && kind != KindSPIFFE && kind != KindSerial && kind != KindSPKI) {
+		problem.Write(ctx, fasthttp.StatusNotFound, "Not Found", "want /denylist/{cn|spiffe|serial|spki}/{value}")
+		return
+	}
+	switch kind {
+	case KindSPIFFE:
+		id, err := spiffe.FromPath(value)
+		if err != nil {
+			problem.Write(ctx, fasthttp.StatusBadRequest, "Bad Request", err.Error())
+			return
+		}
+		value = id.String()
+	case KindSPKI:
+		value = strings.ToLower(value)
+	}
+	domain := string(ctx.QueryArgs().Peek("domain"))
+	key := entryKey(kind, value, domain)
+
+	switch {
+	case ctx.IsPut():
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if len(ctx.PostBody()) > 0 {
+			if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
+				problem.Write(ctx, fasthttp.StatusBadRequest, "Bad Request", "want {\"reason\": \"...\"}")
+				return
+			}
+		}
+
+		e := Entry{Domain: domain, Reason: body.Reason, AddedAt: time.Now().UTC()}
+		switch kind {
+		case KindCN:
+			e.CommonName = value
+		case KindSPIFFE:
+			e.SPIFFEID = value
+		case KindSerial:
+			e.Serial = value
+		case KindSPKI:
+			e.SPKI = value
+		}
+
+		if err := update(key, &e, true); err != nil {
+			log.Error("Failed to persist denylist", "err", err)
+			problem.Write(ctx, fasthttp.StatusInternalServerError, "Internal Server Error", "failed to persist denylist")
+			return
+		}
+		log.Warn("Certificate denied", "kind", kind, "value", value, "domain", domain, "reason", e.Reason)
+		admin.WriteJSON(ctx, e)
+
+	case ctx.IsDelete():
+		mu.RLock()
+		_, ok := entries[key]
+		mu.RUnlock()
+		if !ok {
+			problem.Write(ctx, fasthttp.StatusNotFound, "Not Found", "no such denylist entry")
+			return
+		}
+
+		if err := update(key, nil, true); err != nil {
+			log.Error("Failed to persist denylist", "err", err)
+			problem.Write(ctx, fasthttp.StatusInternalServerError, "Internal Server Error", "failed to persist denylist")
+			return
+		}
+		log.Info("Denial lifted", "kind", kind, "value", value, "domain", domain)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+
+	default:
+		problem.Write(ctx, fasthttp.StatusMethodNotAllowed, "Method Not Allowed", "")
+	}
+}
@@ -0,0 +1,70 @@
+// Package diskcache persists cache state as JSON files carrying a checksum of their content,
+// written atomically so a crash never leaves a half-written cache behind.
+package diskcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"os"
+)
+
+// version is bumped when the envelope changes incompatibly.
+const version = 1
+
+// ErrCorrupt is returned by Load for files whose checksum does not match their content.
+var ErrCorrupt = errors.New("cache file is corrupt")
+
+type envelope struct {
+	Version int             `json:"version"`
+	SHA256  string          `json:"sha256"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Save writes v as JSON to path.
+func Save(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.Marshal(envelope{Version: version, SHA256: checksum(data), Data: data})
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, out, 0o600)
+}
+
+// Load reads a file written by Save into v. A missing file is reported as os.ErrNotExist,
+// a damaged one as ErrCorrupt.
+func Load(path string, v any) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupt, path, err)
+	}
+	if env.Version != version {
+		return fmt.Errorf("%w: %s: unsupported version %d", ErrCorrupt, path, env.Version)
+	}
+	if checksum(env.Data) != env.SHA256 {
+		return fmt.Errorf("%w: %s: checksum mismatch", ErrCorrupt, path)
+	}
+
+	if err := json.Unmarshal(env.Data, v); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupt, path, err)
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
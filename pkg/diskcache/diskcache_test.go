@@ -0,0 +1,29 @@
+package diskcache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, Save(path, map[string]int{"a": 1}))
+
+	var got map[string]int
+	require.NoError(t, Load(path, &got))
+	require.Equal(t, map[string]int{"a": 1}, got)
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, bytes.Replace(raw, []byte(`"a":1`), []byte(`"a":2`), 1), 0o600))
+	require.True(t, errors.Is(Load(path, &got), ErrCorrupt))
+
+	require.NoError(t, os.WriteFile(path, raw[:len(raw)/2], 0o600))
+	require.True(t, errors.Is(Load(path, &got), ErrCorrupt))
+
+	require.True(t, errors.Is(Load(filepath.Join(t.TempDir(), "missing.json"), &got), os.ErrNotExist))
+}
@@ -0,0 +1,42 @@
+package filewatch
+
+import (
+	"os"
+	"time"
+)
+
+// Watch polls path every interval and calls reload after its modification time or size changed.
+// A file that disappears is reloaded again once it comes back. Errors of reload are passed to onError
+// and the change is retried on the next poll. The current state of the file is taken before Watch returns,
+// so a change made right after the initial load is not missed.
+func Watch(path string, interval time.Duration, reload func() error, onError func(err error)) {
+	last, _ := stat(path)
+
+	go func() {
+		for range time.Tick(interval) {
+			cur, err := stat(path)
+			if err != nil || cur == last {
+				continue
+			}
+
+			if err := reload(); err != nil {
+				onError(err)
+				continue
+			}
+			last = cur
+		}
+	}()
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func stat(path string) (fileState, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: st.ModTime(), size: st.Size()}, nil
+}
@@ -0,0 +1,162 @@
+package forwarded
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/valyala/fasthttp"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	forwardedHeaders        = flag.String("forwardedHeaders", StyleXForwarded, "Comma-separated forwarding headers sent upstream: forwarded (RFC 7239), x-forwarded (X-Forwarded-For/Proto/Host); empty sends none")
+	forwardedTrustedProxies = flag.String("forwardedTrustedProxies", "", "Comma-separated CIDRs of proxies in front of id-check whose inbound forwarding headers are appended to; "+
+		"inbound values from other clients are replaced")
+	forwardedTLSHeaders = flag.Bool("forwardedTLSHeaders", false, "Send the negotiated TLS version, cipher suite, ALPN protocol and session resumption upstream in X-Forwarded-TLS-* headers")
+)
+
+const (
+	StyleForwarded  = "forwarded"
+	StyleXForwarded = "x-forwarded"
+)
+
+const (
+	HeaderForwarded       = "Forwarded"
+	HeaderXForwardedFor   = "X-Forwarded-For"
+	HeaderXForwardedHost  = "X-Forwarded-Host"
+	HeaderXForwardedProto = "X-Forwarded-Proto"
+
+	HeaderTLSVersion = "X-Forwarded-TLS-Version"
+	HeaderTLSCipher  = "X-Forwarded-TLS-Cipher"
+	HeaderTLSALPN    = "X-Forwarded-TLS-ALPN"
+	HeaderTLSResumed = "X-Forwarded-TLS-Resumed"
+)
+
+var (
+	emitForwarded  bool
+	emitXForwarded bool
+	trustedProxies cidr.List
+)
+
+// Init parses the forwarding header flags.
+func Init() error {
+	emitForwarded, emitXForwarded = false, false
+	for _, style := range strings.Split(*forwardedHeaders, ",") {
+		switch strings.ToLower(strings.TrimSpace(style)) {
+		case "":
+		case StyleForwarded:
+			emitForwarded = true
+		case StyleXForwarded:
+			emitXForwarded = true
+		default:
+			return fmt.Errorf("unsupported forwardedHeaders entry %q, want %s or %s", style, StyleForwarded, StyleXForwarded)
+		}
+	}
+
+	prefixes, err := cidr.Parse(*forwardedTrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid forwardedTrustedProxies: %w", err)
+	}
+	trustedProxies = prefixes
+
+	return nil
+}
+
+// Apply sets the forwarding headers of the upstream request req describing the client of ctx.
+// Inbound forwarding headers are kept and appended to only when the client is a trusted proxy.
+// Requests passed by a front proxy describe the client behind it, which connected over TLS.
+func Apply(ctx *fasthttp.RequestCtx, req *fasthttp.Request) {
+	clientIP := mtls.ClientIP(ctx)
+	trusted := trustedProxies.Contains(clientIP)
+
+	proto := "http"
+	if ctx.IsTLS() || mtls.ViaFrontProxy(ctx) {
+		proto = "https"
+	}
+	host := string(ctx.Host())
+
+	inForwarded := string(ctx.Request.Header.Peek(HeaderForwarded))
+	inFor := string(ctx.Request.Header.Peek(HeaderXForwardedFor))
+	if mtls.ViaFrontProxy(ctx) {
+		inFor = withoutHop(inFor, clientIP)
+	}
+	inHost := string(ctx.Request.Header.Peek(HeaderXForwardedHost))
+	inProto := string(ctx.Request.Header.Peek(HeaderXForwardedProto))
+
+	for _, h := range []string{HeaderForwarded, HeaderXForwardedFor, HeaderXForwardedHost, HeaderXForwardedProto,
+		HeaderTLSVersion, HeaderTLSCipher, HeaderTLSALPN, HeaderTLSResumed} {
+		req.Header.Del(h)
+	}
+
+	if emitForwarded {
+		element := "for=" + node(clientIP) + ";host=" + quote(host) + ";proto=" + proto
+		if trusted && inForwarded != "" {
+			element = inForwarded + ", " + element
+		}
+		req.Header.Set(HeaderForwarded, element)
+	}
+
+	if emitXForwarded {
+		xff := clientIP.String()
+		if trusted && inFor != "" {
+			xff = inFor + ", " + xff
+		}
+		req.Header.Set(HeaderXForwardedFor, xff)
+
+		if trusted && inHost != "" {
+			host = inHost
+		}
+		req.Header.Set(HeaderXForwardedHost, host)
+
+		if trusted && inProto != "" {
+			proto = inProto
+		}
+		req.Header.Set(HeaderXForwardedProto, proto)
+	}
+
+	if *forwardedTLSHeaders {
+		if cs := ctx.TLSConnectionState(); cs != nil {
+			req.Header.Set(HeaderTLSVersion, tls.VersionName(cs.Version))
+			req.Header.Set(HeaderTLSCipher, tls.CipherSuiteName(cs.CipherSuite))
+			if cs.NegotiatedProtocol != "" {
+				req.Header.Set(HeaderTLSALPN, cs.NegotiatedProtocol)
+			}
+			req.Header.Set(HeaderTLSResumed, strconv.FormatBool(cs.DidResume))
+		}
+	}
+}
+
+// withoutHop drops ip from the end of an X-Forwarded-For value, where a front proxy appended its client.
+func withoutHop(xff string, ip net.IP) string {
+	rest, last := "", xff
+	if i := strings.LastIndexByte(xff, ','); i >= 0 {
+		rest, last = strings.TrimSpace(xff[:i]), xff[i+1:]
+	}
+	if ip.Equal(net.ParseIP(strings.TrimSpace(last))) {
+		return rest
+	}
+	return xff
+}
+
+// node formats ip as an RFC 7239 node, IPv6 addresses are bracketed and quoted.
+func node(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// quote returns v as an RFC 7239 value, quoted unless it is a token.
+func quote(v string) string {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,109 @@
+package forwarded
+
+import (
+	"crypto/x509"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"net"
+	"testing"
+)
+
+func setup(t *testing.T, headers, trusted string) {
+	t.Helper()
+	prevHeaders, prevTrusted := *forwardedHeaders, *forwardedTrustedProxies
+	*forwardedHeaders, *forwardedTrustedProxies = headers, trusted
+	t.Cleanup(func() {
+		*forwardedHeaders, *forwardedTrustedProxies = prevHeaders, prevTrusted
+		require.NoError(t, Init())
+	})
+	require.NoError(t, Init())
+}
+
+func request(remote string, headers map[string]string) (*fasthttp.RequestCtx, *fasthttp.Request) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(remote), Port: 40000}, nil)
+	ctx.Request.Header.SetHost("api.example.com")
+	for k, v := range headers {
+		ctx.Request.Header.Set(k, v)
+	}
+
+	req := &fasthttp.Request{}
+	ctx.Request.CopyTo(req)
+	return ctx, req
+}
+
+func TestUntrustedClientIsReplaced(t *testing.T) {
+	setup(t, "forwarded,x-forwarded", "10.0.0.0/8")
+
+	ctx, req := request("203.0.113.7", map[string]string{
+		HeaderForwarded:      "for=1.2.3.4",
+		HeaderXForwardedFor:  "1.2.3.4",
+		HeaderXForwardedHost: "evil.example.com",
+	})
+	Apply(ctx, req)
+
+	require.Equal(t, "for=203.0.113.7;host=api.example.com;proto=http", string(req.Header.Peek(HeaderForwarded)))
+	require.Equal(t, "203.0.113.7", string(req.Header.Peek(HeaderXForwardedFor)))
+	require.Equal(t, "api.example.com", string(req.Header.Peek(HeaderXForwardedHost)))
+	require.Equal(t, "http", string(req.Header.Peek(HeaderXForwardedProto)))
+}
+
+func TestTrustedProxyIsAppended(t *testing.T) {
+	setup(t, "forwarded,x-forwarded", "10.0.0.0/8, 2001:db8::1")
+
+	ctx, req := request("10.1.2.3", map[string]string{
+		HeaderForwarded:       "for=198.51.100.1",
+		HeaderXForwardedFor:   "198.51.100.1",
+		HeaderXForwardedProto: "https",
+	})
+	Apply(ctx, req)
+
+	require.Equal(t, "for=198.51.100.1, for=10.1.2.3;host=api.example.com;proto=http", string(req.Header.Peek(HeaderForwarded)))
+	require.Equal(t, "198.51.100.1, 10.1.2.3", string(req.Header.Peek(HeaderXForwardedFor)))
+	require.Equal(t, "https", string(req.Header.Peek(HeaderXForwardedProto)))
+
+	ctx, req = request("2001:db8::1", nil)
+	Apply(ctx, req)
+	require.Equal(t, `for="[2001:db8::1]";host=api.example.com;proto=http`, string(req.Header.Peek(HeaderForwarded)))
+}
+
+func TestViaFrontProxy(t *testing.T) {
+	setup(t, "forwarded,x-forwarded", "198.51.100.0/24")
+
+	// the front proxy at 10.0.0.5 appended its client to X-Forwarded-For
+	ctx, req := request("10.0.0.5", map[string]string{HeaderXForwardedFor: "1.2.3.4, 203.0.113.7"})
+	mtls.SetFrontProxyPeer(ctx, []*x509.Certificate{}, "mygaru")
+	Apply(ctx, req)
+
+	require.Equal(t, "for=203.0.113.7;host=api.example.com;proto=https", string(req.Header.Peek(HeaderForwarded)))
+	require.Equal(t, "203.0.113.7", string(req.Header.Peek(HeaderXForwardedFor)))
+	require.Equal(t, "https", string(req.Header.Peek(HeaderXForwardedProto)))
+
+	// a trusted proxy behind the front proxy is appended to once
+	ctx, req = request("10.0.0.5", map[string]string{HeaderXForwardedFor: "192.0.2.9, 198.51.100.1"})
+	mtls.SetFrontProxyPeer(ctx, []*x509.Certificate{}, "mygaru")
+	Apply(ctx, req)
+
+	require.Equal(t, "192.0.2.9, 198.51.100.1", string(req.Header.Peek(HeaderXForwardedFor)))
+}
+
+func TestDisabledStillStripsInbound(t *testing.T) {
+	setup(t, "", "")
+
+	ctx, req := request("203.0.113.7", map[string]string{HeaderXForwardedFor: "1.2.3.4", HeaderTLSVersion: "TLS 1.0"})
+	Apply(ctx, req)
+
+	require.Empty(t, req.Header.Peek(HeaderXForwardedFor))
+	require.Empty(t, req.Header.Peek(HeaderTLSVersion))
+}
+
+func TestInvalidFlags(t *testing.T) {
+	setup(t, "", "")
+
+	*forwardedHeaders = "via"
+	require.Error(t, Init())
+
+	*forwardedHeaders, *forwardedTrustedProxies = "", "10.0.0.0/33"
+	require.Error(t, Init())
+}
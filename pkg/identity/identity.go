@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/mygaru/id-check/pkg/scopes"
+	"github.com/mygaru/id-check/pkg/spiffe"
+)
+
+// Identity describes the caller behind a verified client certificate.
+type Identity struct {
+	CommonName  string
+	Serial      string
+	Fingerprint string    // hex encoded SHA-256 of the certificate's SubjectPublicKeyInfo
+	SPIFFEID    spiffe.ID // set when the certificate is an X.509 SVID
+	// IssuerDomain is the trust bundle (or SPIFFE trust domain) that issued the certificate, set by the caller
+	IssuerDomain string
+	// Scopes are the entitlements encoded in the certificate's scope extensions
+	Scopes []string
+}
+
+// FromCertificate extracts the identity of the given client certificate.
+func FromCertificate(cert *x509.Certificate) Identity {
+	// invalid SVIDs and scope extensions are rejected during the handshake
+	svid, _, _ := spiffe.FromCertificate(cert)
+	if _, configured := spiffe.BundleFor(svid.TrustDomain); !configured {
+		// without SPIFFE trust bundles the SVID was verified like any certificate, its SAN vouches for nothing
+		svid = spiffe.ID{}
+	}
+	granted, _ := scopes.FromCertificate(cert)
+
+	return Identity{
+		CommonName:  cert.Subject.CommonName,
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: SPKIFingerprint(cert),
+		SPIFFEID:    svid,
+		Scopes:      granted,
+	}
+}
+
+// Name returns the name the identity is known by upstream and in per-partner settings:
+// the SPIFFE ID of SVIDs, the CommonName otherwise.
+func (id Identity) Name() string {
+	if !id.SPIFFEID.IsZero() {
+		return id.SPIFFEID.String()
+	}
+	return id.CommonName
+}
+
+// InDomain reports whether the identity was issued within domain. An empty domain stands for any issuer.
+func (id Identity) InDomain(domain string) bool {
+	return domain == "" || domain == id.IssuerDomain
+}
+
+// SPKIFingerprint returns the hex encoded SHA-256 of cert's SubjectPublicKeyInfo.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 of the DER encoded certificate.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,268 @@
+package logger
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	logLevel           = flag.String("logLevel", "INFO", "Minimum level of log messages: DEBUG, INFO, WARN or ERROR")
+	logFormat          = flag.String("logFormat", FormatText, "Log output format: text or json")
+	logComponentLevels = flag.String("logComponentLevels", "", "Comma-separated per-component overrides of logLevel, e.g. mtls=DEBUG,reputation=WARN. "+
+		"Components: mtls, reputation, proxy, forwarding, admin, quota, metering, audit, tracing, accesslog, allowlist, pinning, authz, tenant, denylist, peers")
+	logSampleInterval = flag.Duration("logSampleInterval", 10*time.Second, "Interval within which repetitive messages below WARN are rate limited")
+	logSampleBurst    = flag.Int("logSampleBurst", 20, "How many identical messages below WARN per component are logged within logSampleInterval; 0 disables sampling")
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Components of id-check with their own log level.
+const (
+	ComponentMain       = "main"
+	ComponentMTLS       = "mtls"
+	ComponentReputation = "reputation"
+	ComponentProxy      = "proxy"
+	ComponentForwarding = "forwarding"
+	ComponentAdmin      = "admin"
+	ComponentQuota      = "quota"
+	ComponentMetering   = "metering"
+	ComponentAudit      = "audit"
+	ComponentTracing    = "tracing"
+	ComponentAccessLog  = "accesslog"
+	ComponentAllowlist  = "allowlist"
+	ComponentPinning    = "pinning"
+	ComponentAuthz      = "authz"
+	ComponentTenant     = "tenant"
+	ComponentDenylist   = "denylist"
+	ComponentPeers      = "peers"
+)
+
+// config is replaced as a whole by Init; loggers created before Init pick it up on their next message.
+type config struct {
+	base            slog.Handler
+	level           slog.Level
+	componentLevels map[string]slog.Level
+}
+
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(&config{
+		base:            slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:           slog.LevelInfo,
+		componentLevels: map[string]slog.Level{},
+	})
+}
+
+// Init applies the log flags and routes the standard log package through the configured output.
+func Init() error {
+	return initOutput(os.Stderr)
+}
+
+func initOutput(w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid logLevel %q: %w", *logLevel, err)
+	}
+
+	componentLevels := map[string]slog.Level{}
+	for _, kv := range strings.Split(*logComponentLevels, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+
+		name, lvl, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("invalid logComponentLevels entry %q, want component=LEVEL", kv)
+		}
+
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(strings.TrimSpace(lvl))); err != nil {
+			return fmt.Errorf("invalid level for component %s: %w", name, err)
+		}
+		componentLevels[strings.TrimSpace(name)] = l
+	}
+
+	// levels are enforced per component, the base handler lets everything through
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var base slog.Handler
+	switch *logFormat {
+	case FormatText:
+		base = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		base = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unsupported logFormat %q, want %s or %s", *logFormat, FormatText, FormatJSON)
+	}
+
+	current.Store(&config{base: base, level: level, componentLevels: componentLevels})
+	resetSamplers()
+
+	// messages of the log package (third-party code) are logged by the main component
+	slog.SetDefault(For(ComponentMain))
+	log.SetFlags(0)
+
+	return nil
+}
+
+// For returns the logger of a component. It may be called before Init.
+func For(component string) *slog.Logger {
+	return slog.New(&handler{component: component})
+}
+
+// Fatal logs msg at ERROR level and exits.
+func Fatal(l *slog.Logger, msg string, args ...any) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+// handler resolves the current config on every record, so loggers can be package level variables.
+type handler struct {
+	component string
+	// ops are the WithAttrs/WithGroup calls made on this logger, replayed on the base handler
+	ops []func(slog.Handler) slog.Handler
+
+	cache atomic.Pointer[cachedHandler]
+}
+
+type cachedHandler struct {
+	cfg *config
+	h   slog.Handler
+}
+
+func (h *handler) resolve() (*config, slog.Handler) {
+	cfg := current.Load()
+	if c := h.cache.Load(); c != nil && c.cfg == cfg {
+		return cfg, c.h
+	}
+
+	out := cfg.base.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	h.cache.Store(&cachedHandler{cfg: cfg, h: out})
+
+	return cfg, out
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	cfg := current.Load()
+	minLevel, ok := cfg.componentLevels[h.component]
+	if !ok {
+		minLevel = cfg.level
+	}
+	return level >= minLevel
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && !isUnsampled(ctx) {
+		suppressed, ok := sample(h.component, r.Message, r.Time)
+		if !ok {
+			return nil
+		}
+		if suppressed > 0 {
+			r.AddAttrs(slog.Int("suppressed", suppressed))
+		}
+	}
+
+	if ctx != nil {
+		if attrs, ok := ctx.Value(requestAttrsKey).([]slog.Attr); ok {
+			r.AddAttrs(attrs...)
+		}
+	}
+
+	_, out := h.resolve()
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, 0, len(h.ops)+1)
+	ops = append(append(ops, h.ops...), op)
+	return &handler{component: h.component, ops: ops}
+}
+
+type unsampledKey struct{}
+
+// Unsampled returns a context whose messages are never sampled, for output that must be complete
+// such as the configuration logged at startup.
+func Unsampled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unsampledKey{}, true)
+}
+
+func isUnsampled(ctx context.Context) bool {
+	return ctx != nil && ctx.Value(unsampledKey{}) != nil
+}
+
+// sampler rate limits identical messages of a component within logSampleInterval.
+type sampler struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+var (
+	samplersMu sync.Mutex
+	samplers   = map[string]*sampler{}
+)
+
+func resetSamplers() {
+	samplersMu.Lock()
+	samplers = map[string]*sampler{}
+	samplersMu.Unlock()
+}
+
+// sample reports whether a message may be logged and how many identical ones were dropped before it.
+func sample(component, msg string, now time.Time) (int, bool) {
+	burst := *logSampleBurst
+	if burst <= 0 {
+		return 0, true
+	}
+
+	samplersMu.Lock()
+	defer samplersMu.Unlock()
+
+	key := component + "\x00" + msg
+	s := samplers[key]
+	if s == nil {
+		s = &sampler{windowStart: now}
+		samplers[key] = s
+	}
+
+	if now.Sub(s.windowStart) >= *logSampleInterval {
+		s.windowStart = now
+		s.count = 0
+	}
+
+	if s.count >= burst {
+		s.suppressed++
+		return 0, false
+	}
+
+	s.count++
+	suppressed := s.suppressed
+	s.suppressed = 0
+
+	return suppressed, true
+}
@@ -0,0 +1,109 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setFlags(t *testing.T, kv map[string]string) {
+	t.Helper()
+	for k, v := range kv {
+		prev := flag.Lookup(k).Value.String()
+		require.NoError(t, flag.Set(k, v))
+		t.Cleanup(func() { _ = flag.Set(k, prev) })
+	}
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestComponentLevels(t *testing.T) {
+	setFlags(t, map[string]string{
+		"logFormat":          FormatJSON,
+		"logLevel":           "WARN",
+		"logComponentLevels": "mtls=DEBUG",
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, initOutput(&buf))
+
+	For(ComponentMTLS).Debug("mtls debug", "serial", "01")
+	For(ComponentQuota).Info("quota info")
+	For(ComponentQuota).Warn("quota warn")
+
+	lines := decodeLines(t, &buf)
+	require.Len(t, lines, 2)
+	require.Equal(t, "mtls debug", lines[0]["msg"])
+	require.Equal(t, "mtls", lines[0]["component"])
+	require.Equal(t, "01", lines[0]["serial"])
+	require.Equal(t, "quota warn", lines[1]["msg"])
+}
+
+func TestInvalidFlags(t *testing.T) {
+	setFlags(t, map[string]string{"logLevel": "LOUD"})
+	require.Error(t, initOutput(&bytes.Buffer{}))
+
+	setFlags(t, map[string]string{"logLevel": "INFO", "logComponentLevels": "mtls"})
+	require.Error(t, initOutput(&bytes.Buffer{}))
+}
+
+func TestSampling(t *testing.T) {
+	setFlags(t, map[string]string{
+		"logFormat":         FormatJSON,
+		"logLevel":          "DEBUG",
+		"logSampleBurst":    "2",
+		"logSampleInterval": "1h",
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, initOutput(&buf))
+
+	l := For(ComponentReputation)
+	for i := 0; i < 5; i++ {
+		l.Info("checking")
+		l.Warn("failing")
+	}
+	require.Len(t, decodeLines(t, &buf), 2+5)
+
+	// a new window reports what was dropped in the previous one
+	now := time.Now().Add(2 * time.Hour)
+	suppressed, ok := sample(ComponentReputation, "checking", now)
+	require.True(t, ok)
+	require.Equal(t, 3, suppressed)
+}
+
+func TestSampling_Unsampled(t *testing.T) {
+	setFlags(t, map[string]string{
+		"logFormat":         FormatJSON,
+		"logSampleBurst":    "2",
+		"logSampleInterval": "1h",
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, initOutput(&buf))
+
+	// every flag is logged with the same message at startup
+	ctx := Unsampled(context.Background())
+	l := For(ComponentMain)
+	for i := 0; i < 5; i++ {
+		l.InfoContext(ctx, "FLAG", "name", i)
+	}
+	require.Len(t, decodeLines(t, &buf), 5)
+}
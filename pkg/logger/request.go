@@ -0,0 +1,17 @@
+package logger
+
+import (
+	"github.com/valyala/fasthttp"
+	"log/slog"
+)
+
+// requestAttrsKey is the user value holding request-scoped log attributes.
+// fasthttp.RequestCtx.Value only resolves string keys.
+const requestAttrsKey = "idcheck.logAttrs"
+
+// AddRequestAttrs attaches attrs (request ID, CN, serial...) to every message logged
+// with the request as context, e.g. l.InfoContext(ctx, ...).
+func AddRequestAttrs(ctx *fasthttp.RequestCtx, attrs ...slog.Attr) {
+	prev, _ := ctx.UserValue(requestAttrsKey).([]slog.Attr)
+	ctx.SetUserValue(requestAttrsKey, append(prev[:len(prev):len(prev)], attrs...))
+}
@@ -0,0 +1,198 @@
+package metering
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	filePrefix       = "usage-"
+	hourLayout       = "2006010215"
+	checkpointSuffix = ".part"
+	pushedSuffix     = ".pushed"
+)
+
+var csvHeader = []string{
+	"hour", "identity", "issuer_domain", "cn", "serial", "route", "method", "status",
+	"requests", "request_bytes", "response_bytes", "upstream_latency_sum_ms", "upstream_latency_max_ms",
+}
+
+// rollupRow is the JSONL form of a rollup entry as well as the checkpoint form.
+type rollupRow struct {
+	Hour time.Time `json:"hour"`
+	Key
+	Totals
+}
+
+func closedPath(hour time.Time) string {
+	return filepath.Join(*meteringDir, filePrefix+hour.Format(hourLayout)+"."+*meteringFormat)
+}
+
+func checkpointPath(hour time.Time) string {
+	return filepath.Join(*meteringDir, filePrefix+hour.Format(hourLayout)+checkpointSuffix)
+}
+
+func rows(r *Rollup) []rollupRow {
+	out := make([]rollupRow, 0, len(r.Totals))
+	for k, t := range r.Totals {
+		out = append(out, rollupRow{Hour: r.Hour, Key: k, Totals: *t})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Key, out[j].Key
+		if a.IssuerDomain != b.IssuerDomain {
+			return a.IssuerDomain < b.IssuerDomain
+		}
+		if a.Identity != b.Identity {
+			return a.Identity < b.Identity
+		}
+		if a.CommonName != b.CommonName {
+			return a.CommonName < b.CommonName
+		}
+		if a.Serial != b.Serial {
+			return a.Serial < b.Serial
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Status < b.Status
+	})
+
+	return out
+}
+
+func encodeJSONL(r *Rollup) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range rows(r) {
+		if err := enc.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCSV(r *Rollup) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(csvHeader)
+
+	for _, row := range rows(r) {
+		_ = w.Write([]string{
+			row.Hour.Format(time.RFC3339),
+			row.Identity,
+			row.IssuerDomain,
+			row.CommonName,
+			row.Serial,
+			row.Route,
+			row.Method,
+			strconv.Itoa(row.Status),
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.RequestBytes, 10),
+			strconv.FormatInt(row.ResponseBytes, 10),
+			strconv.FormatInt(row.UpstreamLatencySumMs, 10),
+			strconv.FormatInt(row.UpstreamLatencyMaxMs, 10),
+		})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func writeClosed(r *Rollup) error {
+	var data []byte
+	var err error
+	if *meteringFormat == FormatJSONL {
+		data, err = encodeJSONL(r)
+	} else {
+		data, err = encodeCSV(r)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode rollup: %w", err)
+	}
+
+	return atomicfile.WriteFile(closedPath(r.Hour), data, 0o644)
+}
+
+func writeCheckpoint(r *Rollup) error {
+	data, err := encodeJSONL(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode rollup checkpoint: %w", err)
+	}
+
+	return atomicfile.WriteFile(checkpointPath(r.Hour), data, 0o644)
+}
+
+func removeCheckpoint(hour time.Time) {
+	if err := os.Remove(checkpointPath(hour)); err != nil && !os.IsNotExist(err) {
+		log.Error("Failed to remove usage checkpoint", "err", err)
+	}
+}
+
+func readCheckpoint(path string) (*Rollup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hour, err := time.Parse(hourLayout, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), filePrefix), checkpointSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected checkpoint name %s: %w", path, err)
+	}
+
+	r := &Rollup{Hour: hour, Totals: map[Key]*Totals{}}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var row rollupRow
+		if err := dec.Decode(&row); err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+		}
+		t := row.Totals
+		r.Totals[row.Key] = &t
+	}
+
+	return r, nil
+}
+
+// recoverCheckpoints closes checkpoints of past hours left by a previous run and
+// returns the checkpointed rollup of the current hour, if any.
+func recoverCheckpoints(now time.Time) (*Rollup, error) {
+	paths, err := filepath.Glob(filepath.Join(*meteringDir, filePrefix+"*"+checkpointSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	hour := now.UTC().Truncate(time.Hour)
+	resumed := &Rollup{Hour: hour, Totals: map[Key]*Totals{}}
+
+	for _, path := range paths {
+		r, err := readCheckpoint(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Hour.Equal(hour) {
+			resumed = r
+			continue
+		}
+
+		if err := writeClosed(r); err != nil {
+			return nil, fmt.Errorf("failed to close recovered rollup %s: %w", path, err)
+		}
+		removeCheckpoint(r.Hour)
+	}
+
+	return resumed, nil
+}
@@ -0,0 +1,228 @@
+package metering
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
+	"os"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentMetering)
+
+var (
+	meteringDir           = flag.String("meteringDir", "", "Directory where hourly usage rollups are written; empty disables usage metering")
+	meteringFormat        = flag.String("meteringFormat", FormatCSV, "Format of usage rollup files: csv or jsonl")
+	meteringFlushInterval = flag.Duration("meteringFlushInterval", time.Minute, "How often the rollup of the current hour is checkpointed to meteringDir")
+	meteringPushURL       = flag.String("meteringPushURL", "", "Collector endpoint closed rollup files are POSTed to; empty disables the push")
+	meteringPushTimeout   = flag.Duration("meteringPushTimeout", 30*time.Second, "How long to wait for the collector to accept a rollup file")
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// Record describes a single authenticated request.
+type Record struct {
+	Timestamp time.Time
+	// Identity is the name the caller is known by, its SPIFFE ID for SVIDs, and IssuerDomain the trust bundle that issued it
+	Identity        string
+	IssuerDomain    string
+	CommonName      string
+	Serial          string
+	Route           string
+	Method          string
+	Status          int
+	RequestBytes    int64
+	ResponseBytes   int64
+	UpstreamLatency time.Duration
+}
+
+// Key groups records within one hourly rollup. The same name issued by two trust bundles is billed apart.
+type Key struct {
+	Identity     string `json:"identity"`
+	IssuerDomain string `json:"issuerDomain"`
+	CommonName   string `json:"cn"`
+	Serial       string `json:"serial"`
+	Route        string `json:"route"`
+	Method       string `json:"method"`
+	Status       int    `json:"status"`
+}
+
+// Totals is the aggregate of all records sharing a Key.
+type Totals struct {
+	Requests             int64 `json:"requests"`
+	RequestBytes         int64 `json:"requestBytes"`
+	ResponseBytes        int64 `json:"responseBytes"`
+	UpstreamLatencySumMs int64 `json:"upstreamLatencySumMs"`
+	UpstreamLatencyMaxMs int64 `json:"upstreamLatencyMaxMs"`
+}
+
+// Rollup aggregates the records of one hour.
+type Rollup struct {
+	Hour   time.Time
+	Totals map[Key]*Totals
+}
+
+var (
+	mu      sync.Mutex
+	current *Rollup
+	// writeMu serializes writing rollup files outside of mu, so a checkpoint never lands after its hour was closed
+	writeMu sync.Mutex
+)
+
+// Enabled reports whether usage metering is configured.
+func Enabled() bool {
+	return *meteringDir != ""
+}
+
+// Init validates settings, finalizes rollups left over by a previous run and starts
+// the periodic checkpoint. It is a no-op when metering is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if *meteringFormat != FormatCSV && *meteringFormat != FormatJSONL {
+		return fmt.Errorf("unsupported meteringFormat %q, want %s or %s", *meteringFormat, FormatCSV, FormatJSONL)
+	}
+
+	if err := os.MkdirAll(*meteringDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create meteringDir %s: %w", *meteringDir, err)
+	}
+
+	resumed, err := recoverCheckpoints(time.Now())
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = resumed
+	mu.Unlock()
+
+	go func() {
+		for range time.Tick(*meteringFlushInterval) {
+			if err := Flush(time.Now()); err != nil {
+				log.Error("Failed to flush usage rollup", "err", err)
+			}
+			pushPending()
+		}
+	}()
+
+	go pushPending()
+
+	return nil
+}
+
+// Add accounts rec in the rollup of its hour.
+func Add(rec Record) {
+	if !Enabled() {
+		return
+	}
+
+	hour := rec.Timestamp.UTC().Truncate(time.Hour)
+	key := Key{
+		Identity:     rec.Identity,
+		IssuerDomain: rec.IssuerDomain,
+		CommonName:   rec.CommonName,
+		Serial:       rec.Serial,
+		Route:        rec.Route,
+		Method:       rec.Method,
+		Status:       rec.Status,
+	}
+	latencyMs := rec.UpstreamLatency.Milliseconds()
+
+	mu.Lock()
+
+	var closed *Rollup
+	if current == nil || !current.Hour.Equal(hour) {
+		if current != nil && hour.Before(current.Hour) {
+			// request started before the hour was closed; account it in the open rollup
+			hour = current.Hour
+		} else {
+			closed = rotate(hour)
+		}
+	}
+
+	t := current.Totals[key]
+	if t == nil {
+		t = &Totals{}
+		current.Totals[key] = t
+	}
+
+	t.Requests++
+	t.RequestBytes += rec.RequestBytes
+	t.ResponseBytes += rec.ResponseBytes
+	t.UpstreamLatencySumMs += latencyMs
+	t.UpstreamLatencyMaxMs = max(t.UpstreamLatencyMaxMs, latencyMs)
+
+	mu.Unlock()
+
+	if closed != nil {
+		writeMu.Lock()
+		closeRollup(closed)
+		writeMu.Unlock()
+	}
+}
+
+// Flush closes the current rollup when its hour has passed, otherwise checkpoints it.
+func Flush(now time.Time) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	mu.Lock()
+	if current == nil {
+		mu.Unlock()
+		return nil
+	}
+
+	if hour := now.UTC().Truncate(time.Hour); hour.After(current.Hour) {
+		closed := rotate(hour)
+		mu.Unlock()
+
+		closeRollup(closed)
+		return nil
+	}
+
+	snapshot := current.clone()
+	mu.Unlock()
+
+	return writeCheckpoint(snapshot)
+}
+
+// rotate opens a new rollup for hour and returns the previous one, nil if there was none.
+// The caller must hold mu.
+func rotate(hour time.Time) *Rollup {
+	prev := current
+	current = &Rollup{Hour: hour, Totals: map[Key]*Totals{}}
+	return prev
+}
+
+// closeRollup writes r as a closed file and removes its checkpoint. The caller must hold writeMu.
+func closeRollup(r *Rollup) {
+	if r == nil {
+		return
+	}
+
+	if err := writeClosed(r); err != nil {
+		log.Error("Failed to write usage rollup", "hour", r.Hour.Format(time.RFC3339), "err", err)
+		return
+	}
+
+	removeCheckpoint(r.Hour)
+	if *meteringPushURL != "" {
+		go pushPending()
+	}
+}
+
+// clone returns a copy of r that can be used without holding mu.
+func (r *Rollup) clone() *Rollup {
+	c := &Rollup{Hour: r.Hour, Totals: make(map[Key]*Totals, len(r.Totals))}
+	for k, t := range r.Totals {
+		copied := *t
+		c.Totals[k] = &copied
+	}
+	return c
+}
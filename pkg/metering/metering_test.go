@@ -0,0 +1,192 @@
+package metering
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var hour = time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+func setup(t *testing.T, format string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	prevDir, prevFormat, prevPushURL := *meteringDir, *meteringFormat, *meteringPushURL
+	*meteringDir, *meteringFormat, *meteringPushURL = dir, format, ""
+	t.Cleanup(func() {
+		*meteringDir, *meteringFormat, *meteringPushURL = prevDir, prevFormat, prevPushURL
+		mu.Lock()
+		current = nil
+		mu.Unlock()
+	})
+
+	mu.Lock()
+	current = nil
+	mu.Unlock()
+
+	return dir
+}
+
+func record(at time.Time, cn string, status int, latency time.Duration) Record {
+	return Record{
+		Timestamp:       at,
+		Identity:        cn,
+		IssuerDomain:    "mygaru",
+		CommonName:      cn,
+		Serial:          "42",
+		Route:           "/api",
+		Method:          "POST",
+		Status:          status,
+		RequestBytes:    100,
+		ResponseBytes:   1000,
+		UpstreamLatency: latency,
+	}
+}
+
+func key(cn string, status int) Key {
+	return Key{Identity: cn, IssuerDomain: "mygaru", CommonName: cn, Serial: "42", Route: "/api", Method: "POST", Status: status}
+}
+
+func TestAdd_HourlyRollup(t *testing.T) {
+	setup(t, FormatCSV)
+
+	Add(record(hour.Add(time.Minute), "partner-a", 200, 30*time.Millisecond))
+	Add(record(hour.Add(59*time.Minute), "partner-a", 200, 10*time.Millisecond))
+	Add(record(hour.Add(2*time.Minute), "partner-a", 502, 0))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.True(t, current.Hour.Equal(hour))
+	require.Len(t, current.Totals, 2)
+	require.Equal(t, Totals{
+		Requests:             2,
+		RequestBytes:         200,
+		ResponseBytes:        2000,
+		UpstreamLatencySumMs: 40,
+		UpstreamLatencyMaxMs: 30,
+	}, *current.Totals[key("partner-a", 200)])
+	require.Equal(t, int64(1), current.Totals[key("partner-a", 502)].Requests)
+}
+
+func TestAdd_IssuerDomains(t *testing.T) {
+	setup(t, FormatCSV)
+
+	Add(record(hour, "partner-a", 200, 0))
+	other := record(hour, "partner-a", 200, 0)
+	other.IssuerDomain = "partner-ca"
+	Add(other)
+	svid := record(hour, "", 200, 0)
+	svid.Identity = "spiffe://prod.mygaru.internal/ns/eu/sa/billing"
+	Add(svid)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the same CN of another trust bundle is a billing line of its own, SVIDs are billed by SPIFFE ID
+	require.Len(t, current.Totals, 3)
+	require.Equal(t, int64(1), current.Totals[key("partner-a", 200)].Requests)
+	svidKey := key("", 200)
+	svidKey.Identity = svid.Identity
+	require.Equal(t, int64(1), current.Totals[svidKey].Requests)
+}
+
+func TestAdd_RotatesOnNextHour(t *testing.T) {
+	dir := setup(t, FormatCSV)
+
+	Add(record(hour.Add(time.Minute), "partner-a", 200, 0))
+	require.NoError(t, Flush(hour.Add(2*time.Minute)))
+	require.FileExists(t, filepath.Join(dir, "usage-2026030110.part"))
+
+	Add(record(hour.Add(time.Hour), "partner-b", 200, 0))
+	// a request started before the hour was closed is accounted in the open one
+	Add(record(hour.Add(30*time.Minute), "partner-c", 200, 0))
+
+	require.NoFileExists(t, filepath.Join(dir, "usage-2026030110.part"))
+
+	data, err := os.ReadFile(filepath.Join(dir, "usage-2026030110.csv"))
+	require.NoError(t, err)
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		csvHeader,
+		{"2026-03-01T10:00:00Z", "partner-a", "mygaru", "partner-a", "42", "/api", "POST", "200", "1", "100", "1000", "0", "0"},
+	}, rows)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, current.Hour.Equal(hour.Add(time.Hour)))
+	require.Len(t, current.Totals, 2)
+}
+
+func TestFlush_ClosesPastHourAsJSONL(t *testing.T) {
+	dir := setup(t, FormatJSONL)
+
+	Add(record(hour.Add(time.Minute), "partner-a", 200, 25*time.Millisecond))
+	require.NoError(t, Flush(hour.Add(time.Hour+time.Second)))
+
+	data, err := os.ReadFile(filepath.Join(dir, "usage-2026030110.jsonl"))
+	require.NoError(t, err)
+
+	var row rollupRow
+	dec := json.NewDecoder(bytes.NewReader(data))
+	require.NoError(t, dec.Decode(&row))
+	require.False(t, dec.More())
+	require.True(t, row.Hour.Equal(hour))
+	require.Equal(t, "partner-a", row.Identity)
+	require.Equal(t, "mygaru", row.IssuerDomain)
+	require.Equal(t, Totals{Requests: 1, RequestBytes: 100, ResponseBytes: 1000, UpstreamLatencySumMs: 25, UpstreamLatencyMaxMs: 25}, row.Totals)
+
+	// checkpoints of the new hour are resumed after a restart
+	Add(record(hour.Add(time.Hour+time.Minute), "partner-b", 200, 0))
+	require.NoError(t, Flush(hour.Add(time.Hour+2*time.Minute)))
+
+	resumed, err := recoverCheckpoints(hour.Add(time.Hour + 3*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), resumed.Totals[key("partner-b", 200)].Requests)
+}
+
+func TestPushOnClose(t *testing.T) {
+	dir := setup(t, FormatCSV)
+
+	var (
+		pushedMu sync.Mutex
+		pushed   = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushedMu.Lock()
+		pushed[r.Header.Get("X-Usage-File")] = r.Header.Get("Content-Type") + "\n" + string(body)
+		pushedMu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	*meteringPushURL = srv.URL
+
+	Add(record(hour.Add(time.Minute), "partner-a", 200, 0))
+	Add(record(hour.Add(time.Hour), "partner-a", 200, 0))
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "usage-2026030110.csv"+pushedSuffix))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// the pusher holds pushMu until it is done with the files
+	pushMu.Lock()
+	pushMu.Unlock()
+
+	closed, err := os.ReadFile(filepath.Join(dir, "usage-2026030110.csv"))
+	require.NoError(t, err)
+
+	pushedMu.Lock()
+	defer pushedMu.Unlock()
+	require.Equal(t, "text/csv\n"+string(closed), pushed["usage-2026030110.csv"])
+}
@@ -0,0 +1,85 @@
+package metering
+
+import (
+	"fmt"
+	"github.com/mygaru/id-check/pkg/proxy"
+	"github.com/valyala/fasthttp"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var pushMu sync.Mutex
+
+// pushPending POSTs every closed rollup file that has not been accepted by the collector yet.
+func pushPending() {
+	if *meteringPushURL == "" {
+		return
+	}
+
+	// a single pusher at a time; a concurrent call will be picked up by the next tick
+	if !pushMu.TryLock() {
+		return
+	}
+	defer pushMu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(*meteringDir, filePrefix+"*."+*meteringFormat))
+	if err != nil {
+		log.Error("Failed to list usage rollups", "err", err)
+		return
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path + pushedSuffix); err == nil {
+			continue
+		}
+
+		if err := push(path); err != nil {
+			log.Warn("Failed to push usage rollup", "path", path, "err", err)
+			return
+		}
+
+		if err := os.WriteFile(path+pushedSuffix, nil, 0o644); err != nil {
+			log.Error("Failed to mark usage rollup as pushed", "path", path, "err", err)
+		}
+	}
+}
+
+func push(path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+
+	client, err := proxy.GetClient(req, *meteringPushURL)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy client: %w", err)
+	}
+
+	req.SetRequestURI(*meteringPushURL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.Set("X-Usage-File", filepath.Base(path))
+	if *meteringFormat == FormatJSONL {
+		req.Header.SetContentType("application/x-ndjson")
+	} else {
+		req.Header.SetContentType("text/csv")
+	}
+	req.SetBody(body)
+
+	if err := client.DoTimeout(req, resp, *meteringPushTimeout); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
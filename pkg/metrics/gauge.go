@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Get() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	vec[*Gauge]
+}
+
+// NewGaugeVec creates and registers a gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec: newVec(name, help, labels, func() *Gauge { return &Gauge{} })}
+	register(v)
+	return v
+}
+
+// NewGauge creates and registers a gauge without labels.
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func (v *GaugeVec) writeTo(w io.Writer) {
+	writeHeader(w, v.n, v.help, "gauge")
+	v.each(func(labels string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", v.n, labels, formatFloat(g.Get()))
+	})
+}
+
+// gaugeFunc is a gauge whose value is computed on every scrape.
+type gaugeFunc struct {
+	n    string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is obtained by calling f on every scrape.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(&gaugeFunc{n: name, help: help, f: f})
+}
+
+func (g *gaugeFunc) name() string {
+	return g.n
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.n, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.n, formatFloat(g.f()))
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DurationBuckets suit latencies from sub-millisecond up to the default forward timeout.
+	DurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// SizeBuckets suit body sizes from 100 bytes up to the default max request body size.
+	SizeBuckets = []float64{100, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 5e8}
+)
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	vec[*Histogram]
+}
+
+// NewHistogramVec creates and registers a histogram family with the given upper bucket bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{vec: newVec(name, help, labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	register(v)
+	return v
+}
+
+// NewHistogram creates and registers a histogram without labels.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
+
+func (v *HistogramVec) writeTo(w io.Writer) {
+	writeHeader(w, v.n, v.help, "histogram")
+	v.each(func(labels string, h *Histogram) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.n, withLabel(labels, "le", formatFloat(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.n, withLabel(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.n, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.n, labels, h.count)
+	})
+}
+
+// withLabel appends name="value" to a rendered label set.
+func withLabel(labels, name, value string) string {
+	l := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + l + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import "sync"
+
+// Other replaces label values beyond the limit of a LabelLimiter.
+const Other = "other"
+
+// LabelLimiter bounds the cardinality of a label: the first Max distinct values are kept,
+// any further value is reported as Other. Max == 0 reports every value as Other.
+type LabelLimiter struct {
+	Max int
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+func (l *LabelLimiter) Value(v string) string {
+	l.mu.RLock()
+	_, ok := l.seen[v]
+	l.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.Max {
+		return Other
+	}
+	if l.seen == nil {
+		l.seen = map[string]struct{}{}
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can write itself in the Prometheus text exposition format.
+type metric interface {
+	name() string
+	writeTo(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, r := range registry {
+		if r.name() == m.name() {
+			panic(fmt.Sprintf("BUG: metric %s registered twice", m.name()))
+		}
+	}
+	registry = append(registry, m)
+}
+
+// WritePrometheus writes every registered metric in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer) {
+	registryMu.Lock()
+	ms := append([]metric{}, registry...)
+	registryMu.Unlock()
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].name() < ms[j].name()
+	})
+
+	for _, m := range ms {
+		m.writeTo(w)
+	}
+}
+
+// Handler serves the registered metrics, to be mounted on the admin listener.
+func Handler(ctx *fasthttp.RequestCtx) {
+	var buf bytes.Buffer
+	WritePrometheus(&buf)
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetBody(buf.Bytes())
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Get() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	vec[*Counter]
+}
+
+// NewCounterVec creates and registers a counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec: newVec(name, help, labels, func() *Counter { return &Counter{} })}
+	register(v)
+	return v
+}
+
+func (v *CounterVec) writeTo(w io.Writer) {
+	writeHeader(w, v.n, v.help, "counter")
+	v.each(func(labels string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %d\n", v.n, labels, c.Get())
+	})
+}
+
+// vec holds the children of a metric family keyed by their rendered label set.
+type vec[T any] struct {
+	n      string
+	help   string
+	labels []string
+	newT   func() T
+
+	mu       sync.RWMutex
+	children map[string]T
+}
+
+func newVec[T any](name, help string, labels []string, newT func() T) vec[T] {
+	return vec[T]{n: name, help: help, labels: labels, newT: newT, children: map[string]T{}}
+}
+
+func (v *vec[T]) name() string {
+	return v.n
+}
+
+// With returns the child for the given label values, creating it on first use.
+func (v *vec[T]) With(values ...string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("BUG: metric %s wants %d label values, got %d", v.n, len(v.labels), len(values)))
+	}
+
+	key := renderLabels(v.labels, values)
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c = v.newT()
+	v.children[key] = c
+	return c
+}
+
+func (v *vec[T]) each(f func(labels string, child T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v.mu.RLock()
+		c := v.children[k]
+		v.mu.RUnlock()
+		f(k, c)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(n)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
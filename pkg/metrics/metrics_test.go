@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests", "route", "status")
+	c.With("/lookup", "200").Add(2)
+	c.With("/lookup", `4"0`).Inc()
+
+	h := NewHistogram("test_duration_seconds", "Duration", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	NewGauge("test_in_flight", "In flight").Set(3)
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE test_requests_total counter\n")
+	assert.Contains(t, out, `test_requests_total{route="/lookup",status="200"} 2`+"\n")
+	assert.Contains(t, out, `test_requests_total{route="/lookup",status="4\"0"} 1`+"\n")
+
+	assert.Contains(t, out, `test_duration_seconds_bucket{le="0.1"} 1`+"\n")
+	assert.Contains(t, out, `test_duration_seconds_bucket{le="1"} 2`+"\n")
+	assert.Contains(t, out, `test_duration_seconds_bucket{le="+Inf"} 3`+"\n")
+	assert.Contains(t, out, "test_duration_seconds_sum 5.55\n")
+	assert.Contains(t, out, "test_duration_seconds_count 3\n")
+
+	assert.Contains(t, out, "test_in_flight 3\n")
+}
+
+func TestLabelLimiter(t *testing.T) {
+	l := &LabelLimiter{Max: 2}
+
+	assert.Equal(t, "a", l.Value("a"))
+	assert.Equal(t, "b", l.Value("b"))
+	assert.Equal(t, Other, l.Value("c"))
+	assert.Equal(t, "a", l.Value("a"))
+
+	assert.Equal(t, Other, (&LabelLimiter{}).Value("a"))
+}
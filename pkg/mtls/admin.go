@@ -0,0 +1,45 @@
+package mtls
+
+import (
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/valyala/fasthttp"
+	"strconv"
+)
+
+// HandshakeFailuresHandler lists recorded failed handshakes, newest first.
+// Supported filters: ?ip=, ?cn=, ?serial=, ?reason= and ?limit=.
+func HandshakeFailuresHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	ip := string(args.Peek("ip"))
+	cn := string(args.Peek("cn"))
+	serial := string(args.Peek("serial"))
+	reason := string(args.Peek("reason"))
+
+	limit := 0
+	if l := args.Peek("limit"); len(l) > 0 {
+		n, err := strconv.Atoi(string(l))
+		if err != nil || n < 0 {
+			ctx.Error("invalid limit", fasthttp.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	out := HandshakeFailures(func(f *HandshakeFailure) bool {
+		return (ip == "" || f.ClientIP == ip) &&
+			(cn == "" || f.CommonName == cn) &&
+			(serial == "" || f.Serial == serial) &&
+			(reason == "" || f.Reason == reason)
+	})
+
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+
+	admin.WriteJSON(ctx, out)
+}
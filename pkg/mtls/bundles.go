@@ -0,0 +1,233 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/certpolicy"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	mtlsTrustBundlesPath = flag.String("mtlsTrustBundlesPath", "", "Path to JSON file with named trust bundles, each with its own CA source, revocation backend and certificate policy; "+
+		"empty uses a single bundle built from mtlsCaCertPath/mtlsCaCertURL, mtlsReputationUrl and mtlsCertPolicyPath")
+	mtlsDefaultBundleName = flag.String("mtlsDefaultBundleName", "mygaru", "Name of the trust bundle built from mtlsCaCertPath/mtlsCaCertURL when mtlsTrustBundlesPath is not set")
+)
+
+const (
+	RevocationReputation = "reputation"
+	RevocationCRL        = "crl"
+	RevocationSnapshot   = "snapshot"
+	RevocationNone       = "none"
+)
+
+// BundleConfig is a named set of CAs whose certificates share a revocation backend and policy.
+type BundleConfig struct {
+	Name       string           `json:"name"`
+	CACertPath string           `json:"caCertPath,omitempty"`
+	CACertURL  string           `json:"caCertURL,omitempty"`
+	Revocation RevocationConfig `json:"revocation"`
+	// PolicyPath is a certificate policy for this bundle; empty uses mtlsCertPolicyPath.
+	PolicyPath string `json:"policyPath,omitempty"`
+	// TrustScopes honors the scope extensions of certificates of this bundle. Certificates of other bundles
+	// carrying a scope extension are rejected.
+	TrustScopes bool `json:"trustScopes,omitempty"`
+}
+
+// RevocationConfig selects how certificates of a bundle are checked for revocation.
+type RevocationConfig struct {
+	// Type is reputation (the default), crl, snapshot or none.
+	Type string `json:"type"`
+	// URL is the reputation service, or the CRL distribution point for crl.
+	URL string `json:"url,omitempty"`
+	// RefreshInterval is how often a CRL is downloaded again, 1h by default,
+	// or how often a snapshot file is checked for changes, 10s by default.
+	RefreshInterval string `json:"refreshInterval,omitempty"`
+	// Path and PublicKeyPath are the signed revocation snapshot and the key it is signed with, for snapshot.
+	Path          string `json:"path,omitempty"`
+	PublicKeyPath string `json:"publicKeyPath,omitempty"`
+}
+
+// BundlesConfig is the content of mtlsTrustBundlesPath.
+type BundlesConfig struct {
+	Bundles []BundleConfig `json:"bundles"`
+}
+
+// trustBundle verifies client certificates issued by its CAs.
+type trustBundle struct {
+	name       string
+	roots      *x509.CertPool
+	anchors    []*x509.Certificate
+	revocation revocationBackend
+	// policy overrides mtlsCertPolicyPath when set
+	policy *certpolicy.Policy
+	// trustScopes is set for bundles whose CAs may grant scopes
+	trustScopes bool
+}
+
+func (b *trustBundle) certPolicy() *certpolicy.Policy {
+	if b.policy != nil {
+		return b.policy
+	}
+	return currentPolicy.Load()
+}
+
+var (
+	loadBundlesOnce sync.Once
+	loadBundlesErr  error
+	bundles         []*trustBundle
+)
+
+// loadTrustBundles loads the trust bundles once for all listeners.
+func loadTrustBundles() ([]*trustBundle, error) {
+	loadBundlesOnce.Do(func() {
+		if loadBundlesErr = restoreCaches(); loadBundlesErr != nil {
+			return
+		}
+		if *mtlsTrustBundlesPath == "" {
+			bundles, loadBundlesErr = defaultTrustBundle()
+		} else {
+			bundles, loadBundlesErr = readTrustBundles(*mtlsTrustBundlesPath)
+		}
+	})
+	return bundles, loadBundlesErr
+}
+
+// defaultTrustBundle is the single bundle configured by the mtlsCaCert* flags, verified against the system roots too.
+func defaultTrustBundle() ([]*trustBundle, error) {
+	pool, err := createCaPool()
+	if err != nil {
+		return nil, err
+	}
+
+	var revocation revocationBackend = &reputationBackend{bundle: *mtlsDefaultBundleName, url: *mtlsReputationUrl}
+	if *mtlsRevocationSnapshotPath != "" {
+		if revocation, err = newSnapshotBackend(*mtlsDefaultBundleName, *mtlsRevocationSnapshotPath, *mtlsRevocationSnapshotKeyPath, *mtlsRevocationSnapshotReloadInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	return []*trustBundle{{
+		name:        *mtlsDefaultBundleName,
+		roots:       pool,
+		revocation:  revocation,
+		trustScopes: true,
+	}}, nil
+}
+
+func readTrustBundles(path string) ([]*trustBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust bundles %s: %w", path, err)
+	}
+
+	cfg := &BundlesConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse trust bundles %s: %w", path, err)
+	}
+	if len(cfg.Bundles) == 0 {
+		return nil, fmt.Errorf("no trust bundles in %s", path)
+	}
+
+	var out []*trustBundle
+	seen := map[string]bool{}
+	for _, bc := range cfg.Bundles {
+		if bc.Name == "" {
+			return nil, fmt.Errorf("trust bundle without a name in %s", path)
+		}
+		if seen[bc.Name] {
+			return nil, fmt.Errorf("duplicate trust bundle %q in %s", bc.Name, path)
+		}
+		seen[bc.Name] = true
+
+		b, err := newTrustBundle(bc)
+		if err != nil {
+			return nil, fmt.Errorf("trust bundle %q: %w", bc.Name, err)
+		}
+		out = append(out, b)
+	}
+
+	return out, nil
+}
+
+func newTrustBundle(bc BundleConfig) (*trustBundle, error) {
+	pemCerts, err := fetchCACerts(bc.CACertPath, bc.CACertURL)
+	if err != nil {
+		return nil, err
+	}
+
+	anchors := parsePEMCertificates(pemCerts)
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no CA certificates")
+	}
+	exportExpiry(roleTrustAnchor, anchors...)
+
+	b := &trustBundle{name: bc.Name, roots: x509.NewCertPool(), anchors: anchors, trustScopes: bc.TrustScopes}
+	for _, c := range anchors {
+		b.roots.AddCert(c)
+	}
+
+	if bc.PolicyPath != "" {
+		if b.policy, err = certpolicy.Load(bc.PolicyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	switch bc.Revocation.Type {
+	case "", RevocationReputation:
+		url := bc.Revocation.URL
+		if url == "" {
+			url = *mtlsReputationUrl
+		}
+		b.revocation = &reputationBackend{bundle: bc.Name, url: url}
+	case RevocationCRL:
+		if bc.Revocation.URL == "" {
+			return nil, fmt.Errorf("crl revocation needs a url")
+		}
+		refresh := time.Hour
+		if bc.Revocation.RefreshInterval != "" {
+			if refresh, err = time.ParseDuration(bc.Revocation.RefreshInterval); err != nil || refresh <= 0 {
+				return nil, fmt.Errorf("invalid refreshInterval %q", bc.Revocation.RefreshInterval)
+			}
+		}
+		crl := &crlBackend{bundle: bc.Name, url: bc.Revocation.URL, issuers: anchors, cachePath: crlCachePath(bc.Name)}
+		if err := crl.start(refresh); err != nil {
+			return nil, err
+		}
+		b.revocation = crl
+	case RevocationSnapshot:
+		interval := 10 * time.Second
+		if bc.Revocation.RefreshInterval != "" {
+			if interval, err = time.ParseDuration(bc.Revocation.RefreshInterval); err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid refreshInterval %q", bc.Revocation.RefreshInterval)
+			}
+		}
+		if b.revocation, err = newSnapshotBackend(bc.Name, bc.Revocation.Path, bc.Revocation.PublicKeyPath, interval); err != nil {
+			return nil, err
+		}
+	case RevocationNone:
+		b.revocation = noRevocation{}
+	default:
+		return nil, fmt.Errorf("unsupported revocation type %q", bc.Revocation.Type)
+	}
+
+	return b, nil
+}
+
+// clientCAs returns the CAs advertised to clients in the TLS handshake.
+func clientCAs(bs []*trustBundle) *x509.CertPool {
+	if len(bs) == 1 {
+		return bs[0].roots
+	}
+
+	pool := x509.NewCertPool()
+	for _, b := range bs {
+		for _, c := range b.anchors {
+			pool.AddCert(c)
+		}
+	}
+	return pool
+}
@@ -0,0 +1,172 @@
+package mtls
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"github.com/mygaru/id-check/pkg/scopes"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyClientCertificate_NamedBundles(t *testing.T) {
+	mygaru := newTestCA(t, "myGaru CA")
+	partner := newTestCA(t, "Partner CA")
+	bundles := []*trustBundle{mygaru.bundle("mygaru"), partner.bundle("partner-ca")}
+
+	// the same CN under two CAs is told apart by the bundle that issued it
+	fromMygaru := mygaru.issue(t, clientTemplate("DV1", 20, time.Now().Add(time.Hour)))
+	domain, _, err := verifyClientCertificate([]*x509.Certificate{fromMygaru.Leaf}, bundles, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "mygaru", domain)
+
+	fromPartner := partner.issue(t, clientTemplate("DV1", 20, time.Now().Add(time.Hour)))
+	domain, _, err = verifyClientCertificate([]*x509.Certificate{fromPartner.Leaf}, bundles, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "partner-ca", domain)
+
+	// an expired certificate of the second bundle is not reported as unknown to the first
+	expired := partner.issue(t, clientTemplate("DV1", 21, time.Now().Add(-time.Hour)))
+	_, reason, err := verifyClientCertificate([]*x509.Certificate{expired.Leaf}, bundles, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureExpired, reason)
+
+	foreign := newTestCA(t, "Other CA").issue(t, clientTemplate("DV1", 22, time.Now().Add(time.Hour)))
+	_, reason, _ = verifyClientCertificate([]*x509.Certificate{foreign.Leaf}, bundles, nil)
+	assert.Equal(t, FailureUnknownCA, reason)
+}
+
+func TestCRLBackend(t *testing.T) {
+	ca := newTestCA(t, "Partner CA")
+	dir := t.TempDir()
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(31), RevocationTime: time.Now().Add(-time.Minute)},
+		},
+	}, ca.cert, ca.key)
+	assert.Nil(t, err)
+	crlPath := filepath.Join(dir, "partner.crl")
+	assert.Nil(t, os.WriteFile(crlPath, crlDER, 0o644))
+
+	caPath := filepath.Join(dir, "partner-ca.pem")
+	assert.Nil(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o644))
+
+	b, err := newTrustBundle(BundleConfig{
+		Name:       "partner-ca",
+		CACertPath: caPath,
+		Revocation: RevocationConfig{Type: RevocationCRL, URL: "file://" + crlPath},
+	})
+	assert.Nil(t, err)
+
+	revoked := ca.issue(t, clientTemplate("DV1", 31, time.Now().Add(time.Hour)))
+	_, reason, err := verifyClientCertificate([]*x509.Certificate{revoked.Leaf}, []*trustBundle{b}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureRevoked, reason)
+
+	good := ca.issue(t, clientTemplate("DV1", 32, time.Now().Add(time.Hour)))
+	domain, _, err := verifyClientCertificate([]*x509.Certificate{good.Leaf}, []*trustBundle{b}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "partner-ca", domain)
+
+	// a stale CRL fails closed
+	crl := b.revocation.(*crlBackend)
+	_, _, err = crl.lookup(big.NewInt(32), time.Now().Add(2*time.Hour))
+	assert.NotNil(t, err)
+
+	// CRLs signed by another CA are rejected
+	other := newTestCA(t, "Other CA")
+	otherCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{Number: big.NewInt(1), NextUpdate: time.Now().Add(time.Hour)}, other.cert, other.key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(crlPath, otherCRL, 0o644))
+	assert.NotNil(t, crl.refresh())
+}
+
+func TestReadTrustBundles(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCA(t, "CA").cert.Raw}), 0o644))
+
+	write := func(content string) string {
+		path := filepath.Join(dir, "bundles.json")
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	bs, err := readTrustBundles(write(`{"bundles": [
+		{"name": "mygaru", "caCertPath": "` + caPath + `", "trustScopes": true, "revocation": {"url": "https://ca.mygaru.com/reputation"}},
+		{"name": "partner-ca", "caCertPath": "` + caPath + `", "revocation": {"type": "none"}}
+	]}`))
+	assert.Nil(t, err)
+	assert.Len(t, bs, 2)
+	assert.IsType(t, &reputationBackend{}, bs[0].revocation)
+	assert.IsType(t, noRevocation{}, bs[1].revocation)
+	assert.True(t, bs[0].trustScopes)
+	assert.False(t, bs[1].trustScopes)
+
+	for _, invalid := range []string{
+		`{"bundles": []}`,
+		`{"bundles": [{"caCertPath": "` + caPath + `"}]}`,
+		`{"bundles": [{"name": "a", "caCertPath": "` + caPath + `"}, {"name": "a", "caCertPath": "` + caPath + `"}]}`,
+		`{"bundles": [{"name": "a", "caCertPath": "` + caPath + `", "revocation": {"type": "ocsp"}}]}`,
+		`{"bundles": [{"name": "a", "caCertPath": "` + caPath + `", "revocation": {"type": "crl"}}]}`,
+	} {
+		_, err := readTrustBundles(write(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestVerifyClientCertificate_ScopeExtensions(t *testing.T) {
+	assert.Nil(t, flag.Set("scopeExtensionOIDs", "1.3.6.1.4.1.55555.1.2"))
+	assert.Nil(t, scopes.Init())
+	t.Cleanup(func() {
+		_ = flag.Set("scopeExtensionOIDs", "")
+		_ = scopes.Init()
+	})
+
+	ca := newTestCA(t, "myGaru CA")
+	mygaru := ca.bundle("mygaru")
+	mygaru.trustScopes = true
+	partner := newTestCA(t, "Partner CA")
+	bundles := []*trustBundle{mygaru, partner.bundle("partner-ca")}
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 55555, 1, 2}
+
+	// the scope extension is understood even when critical
+	value, err := asn1.Marshal([]string{"ids:read"})
+	assert.Nil(t, err)
+	tmpl := clientTemplate("DV1", 40, time.Now().Add(time.Hour))
+	tmpl.ExtraExtensions = []pkix.Extension{{Id: oid, Critical: true, Value: value}}
+	cert := ca.issue(t, tmpl)
+	_, _, err = verifyClientCertificate([]*x509.Certificate{cert.Leaf}, bundles, nil)
+	assert.Nil(t, err)
+
+	tmpl = clientTemplate("DV1", 41, time.Now().Add(time.Hour))
+	tmpl.ExtraExtensions = []pkix.Extension{{Id: oid, Value: []byte{0x04, 0x01, 0x00}}}
+	cert = ca.issue(t, tmpl)
+	_, reason, err := verifyClientCertificate([]*x509.Certificate{cert.Leaf}, bundles, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureInvalidScopes, reason)
+
+	// another CA cannot grant scopes
+	tmpl = clientTemplate("DV1", 42, time.Now().Add(time.Hour))
+	tmpl.ExtraExtensions = []pkix.Extension{{Id: oid, Value: value}}
+	cert = partner.issue(t, tmpl)
+	_, reason, err = verifyClientCertificate([]*x509.Certificate{cert.Leaf}, bundles, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureUntrustedScopes, reason)
+
+	// its certificates without scope extensions are fine
+	cert = partner.issue(t, clientTemplate("DV1", 43, time.Now().Add(time.Hour)))
+	_, _, err = verifyClientCertificate([]*x509.Certificate{cert.Leaf}, bundles, nil)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,177 @@
+package mtls
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/diskcache"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mtlsCacheDir = flag.String("mtlsCacheDir", "", "Directory where reputation verdicts and downloaded CRLs are persisted and restored from at startup, "+
+		"within mtlsReputationCacheTTL and the CRL nextUpdate; verdicts need mtlsReputationCacheTTL > 0; empty keeps them in memory only")
+	mtlsCacheFlushInterval = flag.Duration("mtlsCacheFlushInterval", 10*time.Second, "How often changed reputation verdicts are written to mtlsCacheDir")
+)
+
+const verdictsFile = "reputation.json"
+
+// verdictsDirty is set when verdicts changed since they were last written to mtlsCacheDir.
+var verdictsDirty atomic.Bool
+
+var verdictListeners []func(bundle, serial string, v Verdict)
+
+// OnVerdict registers f to be called with every verdict obtained by this instance, but not with those passed to MergeVerdict.
+// It must be called before the server starts.
+func OnVerdict(f func(bundle, serial string, v Verdict)) {
+	verdictListeners = append(verdictListeners, f)
+}
+
+func storeVerdict(bundle, serial string, v Verdict) {
+	verdicts.Store(bundle+"/"+serial, v)
+	verdictsDirty.Store(true)
+
+	for _, f := range verdictListeners {
+		f(bundle, serial, v)
+	}
+}
+
+// MergeVerdict caches a verdict obtained by another instance unless a newer one is cached already,
+// and reports whether it was taken. A CheckedAt in the future counts as now, and a revoked verdict is
+// never replaced by another status. Open connections of a certificate found revoked are closed.
+func MergeVerdict(bundle, serial string, v Verdict) bool {
+	if now := time.Now(); v.CheckedAt.After(now) {
+		v.CheckedAt = now
+	}
+	if !mergeVerdict(bundle+"/"+serial, v) {
+		return false
+	}
+
+	verdictsDirty.Store(true)
+	if v.Status == CertStatusRevoked {
+		revokedUpdated(bundle, revokedSerial(serial))
+	}
+	return true
+}
+
+// mergeVerdict stores v under key unless the cached verdict supersedes it, and reports whether it was stored.
+func mergeVerdict(key string, v Verdict) bool {
+	for {
+		cur, loaded := verdicts.LoadOrStore(key, v)
+		if !loaded {
+			return true
+		}
+		if c := cur.(Verdict); !v.CheckedAt.After(c.CheckedAt) || c.Status == CertStatusRevoked && v.Status != CertStatusRevoked {
+			return false
+		}
+		if verdicts.CompareAndSwap(key, cur, v) {
+			return true
+		}
+	}
+}
+
+// FreshVerdicts calls f with every cached verdict still within mtlsReputationCacheTTL.
+func FreshVerdicts(f func(bundle, serial string, v Verdict)) {
+	now := time.Now()
+	verdicts.Range(func(k, v any) bool {
+		if verdict := v.(Verdict); verdictFresh(verdict, now) {
+			i := strings.LastIndexByte(k.(string), '/')
+			f(k.(string)[:i], k.(string)[i+1:], verdict)
+		}
+		return true
+	})
+}
+
+// restoreCaches loads the reputation verdicts persisted in mtlsCacheDir and keeps writing them back.
+// It is a no-op when mtlsCacheDir is not set, and only creates the directory for CRLs when mtlsReputationCacheTTL is 0.
+func restoreCaches() error {
+	if *mtlsCacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*mtlsCacheDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create mtlsCacheDir: %w", err)
+	}
+
+	if !ReputationCacheEnabled() {
+		// verdicts are not reused without a TTL, the directory still keeps the CRLs
+		reputationLog.Warn("mtlsCacheDir is set without mtlsReputationCacheTTL, reputation verdicts are not persisted")
+		return nil
+	}
+
+	path := filepath.Join(*mtlsCacheDir, verdictsFile)
+	n, err := loadVerdicts(path, time.Now())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		// a damaged cache only costs fresh lookups
+		reputationLog.Error("Failed to restore reputation verdicts, starting with an empty cache", "path", path, "err", err)
+	default:
+		reputationLog.Info("Restored reputation verdicts", "path", path, "verdicts", n)
+	}
+
+	go func() {
+		for range time.Tick(*mtlsCacheFlushInterval) {
+			if !verdictsDirty.Swap(false) {
+				continue
+			}
+			if err := saveVerdicts(path, time.Now()); err != nil {
+				verdictsDirty.Store(true)
+				reputationLog.Error("Failed to persist reputation verdicts", "path", path, "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// saveVerdicts writes the verdicts still within mtlsReputationCacheTTL at now to path.
+func saveVerdicts(path string, now time.Time) error {
+	out := map[string]Verdict{}
+	verdicts.Range(func(k, v any) bool {
+		if verdict := v.(Verdict); verdictFresh(verdict, now) {
+			out[k.(string)] = verdict
+		}
+		return true
+	})
+	return diskcache.Save(path, out)
+}
+
+// loadVerdicts restores the verdicts of path that are still within mtlsReputationCacheTTL at now,
+// keeping cached ones that supersede them, e.g. those pulled from a peer.
+func loadVerdicts(path string, now time.Time) (int, error) {
+	var in map[string]Verdict
+	if err := diskcache.Load(path, &in); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for k, v := range in {
+		if verdictFresh(v, now) && mergeVerdict(k, v) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func verdictFresh(v Verdict, now time.Time) bool {
+	return *mtlsReputationCacheTTL > 0 && now.Sub(v.CheckedAt) < *mtlsReputationCacheTTL
+}
+
+// crlCachePath returns where the CRL of bundle is persisted, or "" when mtlsCacheDir is not set.
+func crlCachePath(bundle string) string {
+	if *mtlsCacheDir == "" {
+		return ""
+	}
+	return filepath.Join(*mtlsCacheDir, "crl-"+url.PathEscape(bundle)+".json")
+}
+
+// cachedCRL is a downloaded CRL as persisted in mtlsCacheDir.
+type cachedCRL struct {
+	URL string `json:"url"`
+	DER []byte `json:"der"`
+}
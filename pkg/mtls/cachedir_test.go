@@ -0,0 +1,122 @@
+package mtls
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerdictsPersistence(t *testing.T) {
+	assert.Nil(t, flag.Set("mtlsReputationCacheTTL", "1h"))
+	t.Cleanup(func() { _ = flag.Set("mtlsReputationCacheTTL", "0") })
+
+	path := filepath.Join(t.TempDir(), verdictsFile)
+	now := time.Now()
+	storeVerdict("persist", "1", Verdict{Status: CertStatusGood, CheckedAt: now.Add(-30 * time.Minute)})
+	storeVerdict("persist", "2", Verdict{Status: CertStatusRevoked, Reason: "keyCompromise", CheckedAt: now.Add(-time.Minute)})
+	storeVerdict("persist", "3", Verdict{Status: CertStatusGood, CheckedAt: now.Add(-2 * time.Hour)})
+	assert.Nil(t, saveVerdicts(path, now))
+
+	verdicts.Delete("persist/1")
+	verdicts.Delete("persist/2")
+	verdicts.Delete("persist/3")
+
+	// restored 45 minutes later, only verdicts still within the TTL are honored
+	n, err := loadVerdicts(path, now.Add(45*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	v, ok := CachedVerdict("persist", "2")
+	assert.True(t, ok)
+	assert.Equal(t, "keyCompromise", v.Reason)
+	_, ok = CachedVerdict("persist", "1")
+	assert.False(t, ok)
+	_, ok = CachedVerdict("persist", "3")
+	assert.False(t, ok)
+
+	// a newer verdict pulled from a peer before the restore is kept
+	verdicts.Delete("persist/2")
+	assert.True(t, MergeVerdict("persist", "2", Verdict{Status: CertStatusRevoked, Reason: "superseded", CheckedAt: now}))
+	n, err = loadVerdicts(path, now.Add(45*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	v, _ = CachedVerdict("persist", "2")
+	assert.Equal(t, "superseded", v.Reason)
+	verdicts.Delete("persist/2")
+
+	// a damaged file is not loaded
+	assert.Nil(t, os.WriteFile(path, []byte(`{"version":1,"sha256":"00","data":{}}`), 0o600))
+	_, err = loadVerdicts(path, now)
+	assert.NotNil(t, err)
+}
+
+func TestCRLBackend_RestoresCachedCRL(t *testing.T) {
+	ca := newTestCA(t, "Partner CA")
+	dir := t.TempDir()
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(31), RevocationTime: time.Now().Add(-time.Minute)},
+		},
+	}, ca.cert, ca.key)
+	assert.Nil(t, err)
+	crlPath := filepath.Join(dir, "partner.crl")
+	assert.Nil(t, os.WriteFile(crlPath, crlDER, 0o644))
+
+	cachePath := filepath.Join(dir, "crl-partner-ca.json")
+	first := &crlBackend{bundle: "partner-ca", url: "file://" + crlPath, issuers: []*x509.Certificate{ca.cert}, cachePath: cachePath}
+	assert.Nil(t, first.refresh())
+
+	// the CA is unreachable after a restart
+	assert.Nil(t, os.Remove(crlPath))
+	restarted := &crlBackend{bundle: "partner-ca", url: "file://" + crlPath, issuers: []*x509.Certificate{ca.cert}, cachePath: cachePath}
+	assert.Nil(t, restarted.start(time.Hour))
+	status, _, err := restarted.lookup(big.NewInt(31), time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, CertStatusRevoked, status)
+
+	// without a cache the CRL is required at startup
+	cold := &crlBackend{bundle: "partner-ca", url: "file://" + crlPath, issuers: []*x509.Certificate{ca.cert}}
+	assert.NotNil(t, cold.start(time.Hour))
+
+	// a cached CRL of another CA is not trusted
+	other := newTestCA(t, "Other CA")
+	untrusted := &crlBackend{bundle: "partner-ca", url: "file://" + crlPath, issuers: []*x509.Certificate{other.cert}, cachePath: cachePath}
+	assert.NotNil(t, untrusted.start(time.Hour))
+}
+
+func TestMergeVerdict(t *testing.T) {
+	t.Cleanup(func() {
+		verdicts.Delete("merge/1")
+		verdicts.Delete("merge/2")
+	})
+	now := time.Now()
+
+	// a verdict from the future counts as checked now, so it cannot pin itself in the cache
+	assert.True(t, MergeVerdict("merge", "1", Verdict{Status: CertStatusGood, CheckedAt: now.Add(24 * time.Hour)}))
+	v, _ := CachedVerdict("merge", "1")
+	assert.False(t, v.CheckedAt.After(time.Now()))
+	assert.True(t, MergeVerdict("merge", "1", Verdict{Status: CertStatusUnknown, CheckedAt: time.Now().Add(time.Second)}))
+	v, _ = CachedVerdict("merge", "1")
+	assert.Equal(t, CertStatusUnknown, v.Status)
+
+	// an older verdict is ignored
+	assert.False(t, MergeVerdict("merge", "1", Verdict{Status: CertStatusGood, CheckedAt: now.Add(-time.Minute)}))
+
+	// a revoked verdict is never replaced by a newer good one
+	assert.True(t, MergeVerdict("merge", "2", Verdict{Status: CertStatusRevoked, Reason: "keyCompromise", CheckedAt: now.Add(-time.Minute)}))
+	assert.False(t, MergeVerdict("merge", "2", Verdict{Status: CertStatusGood, CheckedAt: now}))
+	v, _ = CachedVerdict("merge", "2")
+	assert.Equal(t, CertStatusRevoked, v.Status)
+	assert.True(t, MergeVerdict("merge", "2", Verdict{Status: CertStatusRevoked, Reason: "superseded", CheckedAt: now}))
+	v, _ = CachedVerdict("merge", "2")
+	assert.Equal(t, "superseded", v.Reason)
+}
@@ -0,0 +1,72 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"sync"
+	"time"
+)
+
+var forcedDisconnects = metrics.NewCounterVec("idcheck_forced_disconnects_total",
+	"Client connections closed by id-check because their certificate is no longer acceptable", "reason")
+
+// Reasons of forced disconnects.
+const (
+	DisconnectDenylist = "denylist"
+	DisconnectRevoked  = "revoked"
+	DisconnectExpired  = "expired"
+)
+
+// conns tracks the connections of RunServer that completed their handshake, so they can be closed
+// when the certificate they were authenticated with is denied later.
+var conns = struct {
+	sync.Mutex
+	open map[*serverConn]struct{}
+}{open: map[*serverConn]struct{}{}}
+
+func init() {
+	metrics.NewGaugeFunc("idcheck_client_connections", "Open client connections that completed the mTLS handshake", func() float64 {
+		conns.Lock()
+		defer conns.Unlock()
+		return float64(len(conns.open))
+	})
+}
+
+func trackConn(c *serverConn) {
+	conns.Lock()
+	defer conns.Unlock()
+
+	if !c.closed {
+		c.validatedAt = time.Now()
+		conns.open[c] = struct{}{}
+	}
+}
+
+func untrackConn(c *serverConn) {
+	conns.Lock()
+	defer conns.Unlock()
+
+	c.closed = true
+	delete(conns.open, c)
+}
+
+// CloseConnections closes the open client connections whose certificate, verified by the trust bundle named issuerDomain,
+// matches and returns how many were matched.
+// Like revalidated connections, those answering a request are closed once the response is written.
+// reason labels the idcheck_forced_disconnects_total metric.
+func CloseConnections(match func(leaf *x509.Certificate, issuerDomain string) bool, reason string) int {
+	conns.Lock()
+	var matched []*serverConn
+	for c := range conns.open {
+		if match(c.leaf, c.issuerDomain) {
+			matched = append(matched, c)
+		}
+	}
+	conns.Unlock()
+
+	for _, c := range matched {
+		c.closeAfterRequest(reason)
+	}
+
+	return len(matched)
+}
@@ -0,0 +1,100 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// connect completes a handshake of a client presenting cert against a handshake listener trusting ca
+// and returns both ends of the connection.
+func connect(t *testing.T, ca *testCA, cert tls.Certificate) (*serverConn, *tls.Conn) {
+	t.Helper()
+
+	serverCert := ca.issue(t, clientTemplate("localhost", 100, time.Now().Add(time.Hour)))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	hl := newHandshakeListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}, []*trustBundle{ca.bundle("test")})
+
+	accepted := make(chan *serverConn, 1)
+	go func() {
+		c, err := hl.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		sc := c.(*serverConn)
+		_ = sc.Handshake()
+		accepted <- sc
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		MaxVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	})
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return <-accepted, client
+}
+
+// awaitRequest makes c wait for the next request, like fasthttp between requests.
+func awaitRequest(t *testing.T, c *serverConn) {
+	t.Helper()
+
+	go func() { _, _ = c.Read(make([]byte, 1)) }()
+	assert.Eventually(t, func() bool {
+		c.reqMu.Lock()
+		defer c.reqMu.Unlock()
+		return c.reading
+	}, 2*time.Second, time.Millisecond)
+}
+
+func TestCloseConnections(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	conn, client := connect(t, ca, ca.issue(t, clientTemplate("DV1", 50, time.Now().Add(time.Hour))))
+	other, _ := connect(t, ca, ca.issue(t, clientTemplate("DV2", 51, time.Now().Add(time.Hour))))
+	t.Cleanup(func() { _ = other.Close() })
+	awaitRequest(t, conn)
+
+	closed := CloseConnections(func(leaf *x509.Certificate, _ string) bool { return leaf.Subject.CommonName == "DV1" }, DisconnectDenylist)
+	assert.Equal(t, 1, closed)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// closed connections are no longer tracked
+	assert.Equal(t, 0, CloseConnections(func(leaf *x509.Certificate, _ string) bool { return leaf.Subject.CommonName == "DV1" }, DisconnectDenylist))
+}
+
+func TestHandshake_Denylist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"entries": [{"serial": "60"}]}`), 0o644))
+	assert.Nil(t, flag.Set("denylistPath", path))
+	assert.Nil(t, denylist.Init())
+	t.Cleanup(func() { _ = flag.Set("denylistPath", "") })
+
+	ca := newTestCA(t, "Test CA")
+	err := handshake(t, ca, []tls.Certificate{ca.issue(t, clientTemplate("DV1", 60, time.Now().Add(time.Hour)))})
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureDenied, HandshakeFailures(nil)[0].Reason)
+
+	assert.Nil(t, handshake(t, ca, []tls.Certificate{ca.issue(t, clientTemplate("DV1", 61, time.Now().Add(time.Hour)))}))
+}
@@ -0,0 +1,20 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"github.com/mygaru/id-check/pkg/metrics"
+)
+
+var certificateNotAfter = metrics.NewGaugeVec("idcheck_certificate_not_after_timestamp_seconds",
+	"Expiry (Unix time) of the server certificate and the trust anchors", "role", "subject", "serial")
+
+const (
+	roleServer      = "server"
+	roleTrustAnchor = "trust_anchor"
+)
+
+func exportExpiry(role string, certs ...*x509.Certificate) {
+	for _, c := range certs {
+		certificateNotAfter.With(role, c.Subject.String(), c.SerialNumber.String()).Set(float64(c.NotAfter.Unix()))
+	}
+}
@@ -0,0 +1,367 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/problem"
+	"github.com/mygaru/id-check/pkg/requestid"
+	"github.com/mygaru/id-check/pkg/tracing"
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	mtlsFrontProxyListenAddr = flag.String("mtlsFrontProxyListenAddr", "", "Plain HTTP address for a TLS-terminating front proxy passing client certificates in headers; "+
+		"empty disables the front proxy ingress")
+	mtlsFrontProxyTrustedCIDRs = flag.String("mtlsFrontProxyTrustedCIDRs", "", "Comma-separated CIDRs of front proxies allowed to connect to mtlsFrontProxyListenAddr")
+	mtlsFrontProxyCertHeader   = flag.String("mtlsFrontProxyCertHeader", CertHeaderClientCert, "How the front proxy passes the client certificate: client-cert (RFC 9440 Client-Cert "+
+		"and Client-Cert-Chain) or xfcc (X-Forwarded-Client-Cert)")
+)
+
+const (
+	CertHeaderClientCert = "client-cert"
+	CertHeaderXFCC       = "xfcc"
+)
+
+const (
+	headerClientCert      = "Client-Cert"
+	headerClientCertChain = "Client-Cert-Chain"
+	headerXFCC            = "X-Forwarded-Client-Cert"
+)
+
+// ClientIP returns the address of the client of a request: the connection peer, which is the real client
+// for PROXY protocol connections, or for requests passed by a front proxy the last X-Forwarded-For hop it added.
+func ClientIP(ctx *fasthttp.RequestCtx) net.IP {
+	if ViaFrontProxy(ctx) {
+		return forwardedClientIP(ctx)
+	}
+	return ctx.RemoteIP()
+}
+
+// ViaFrontProxy reports whether a request was passed by a front proxy, which terminated the client's TLS.
+func ViaFrontProxy(ctx *fasthttp.RequestCtx) bool {
+	_, ok := ctx.UserValue(peerCertificatesKey).([]*x509.Certificate)
+	return ok
+}
+
+// forwardedClientIP returns the last X-Forwarded-For hop of a request passed by a front proxy,
+// or the address of the proxy when it added none.
+func forwardedClientIP(ctx *fasthttp.RequestCtx) net.IP {
+	xff := string(ctx.Request.Header.Peek("X-Forwarded-For"))
+	if i := strings.LastIndexByte(xff, ','); i >= 0 {
+		xff = xff[i+1:]
+	}
+	if ip := net.ParseIP(strings.TrimSpace(xff)); ip != nil {
+		return ip
+	}
+	return ctx.RemoteIP()
+}
+
+var errNoCertificate = errors.New("no client certificate")
+
+// peerCertificatesKey is the user value holding the certificates passed by a front proxy.
+const peerCertificatesKey = "idcheck.peerCertificates"
+
+// issuerDomainKey is the user value holding the trust bundle that verified the certificates passed by a front proxy.
+const issuerDomainKey = "idcheck.issuerDomain"
+
+// FrontProxyEnabled reports whether the front proxy ingress is configured.
+func FrontProxyEnabled() bool {
+	return *mtlsFrontProxyListenAddr != ""
+}
+
+// RunFrontProxyServer serves handler on plain HTTP to trusted front proxies, after verifying the
+// client certificate they pass the same way as on the mTLS listener.
+func RunFrontProxyServer(handler fasthttp.RequestHandler) {
+	frontLog := log.With("ingress", "front_proxy")
+
+	trusted, err := cidr.Parse(*mtlsFrontProxyTrustedCIDRs)
+	if err != nil {
+		logger.Fatal(frontLog, "Invalid mtlsFrontProxyTrustedCIDRs", "err", err)
+	}
+	if len(trusted) == 0 {
+		logger.Fatal(frontLog, "mtlsFrontProxyTrustedCIDRs must be set to use mtlsFrontProxyListenAddr")
+	}
+
+	var extract func(h *fasthttp.RequestHeader) ([]*x509.Certificate, error)
+	switch *mtlsFrontProxyCertHeader {
+	case CertHeaderClientCert:
+		extract = clientCertFromRFC9440
+	case CertHeaderXFCC:
+		extract = clientCertFromXFCC
+	default:
+		logger.Fatal(frontLog, "Unsupported mtlsFrontProxyCertHeader", "value", *mtlsFrontProxyCertHeader)
+	}
+
+	if err := loadCertPolicy(); err != nil {
+		logger.Fatal(frontLog, "Failed to load certificate policy", "err", err)
+	}
+	bundles, err := loadTrustBundles()
+	if err != nil {
+		logger.Fatal(frontLog, "Failed to load trust bundles", "err", err)
+	}
+
+	s := &fasthttp.Server{
+		Handler:            frontProxyHandler(trusted, extract, bundles, handler),
+		MaxRequestBodySize: *mtlsServerMaxBodySize,
+		CloseOnShutdown:    true,
+	}
+	addServer(s)
+
+	frontLog.Info("Front proxy listener started", "addr", *mtlsFrontProxyListenAddr, "certHeader", *mtlsFrontProxyCertHeader)
+	if err := s.ListenAndServe(*mtlsFrontProxyListenAddr); err != nil {
+		logger.Fatal(frontLog, "Failed to serve", "err", err)
+	}
+}
+
+// frontProxyHandler verifies the client certificates passed by trusted front proxies and hands the requests
+// carrying a valid one to handler.
+func frontProxyHandler(trusted cidr.List, extract func(h *fasthttp.RequestHeader) ([]*x509.Certificate, error), bundles []*trustBundle,
+	handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !trusted.Contains(ctx.RemoteIP()) {
+			reject(ctx, fasthttp.StatusForbidden, "Forbidden", "connection is not from a trusted front proxy")
+			return
+		}
+
+		certs, err := extract(&ctx.Request.Header)
+		domain, reason, err := verifyForwardedCertificate(ctx, certs, err, bundles)
+		if err != nil {
+			status := fasthttp.StatusForbidden
+			if reason == FailureNoCertificate {
+				status = fasthttp.StatusUnauthorized
+			}
+			reject(ctx, status, "Client certificate rejected", reason)
+			return
+		}
+
+		// the certificate headers describe the hop to id-check, not to the upstream
+		ctx.Request.Header.Del(headerClientCert)
+		ctx.Request.Header.Del(headerClientCertChain)
+		ctx.Request.Header.Del(headerXFCC)
+
+		SetFrontProxyPeer(ctx, certs, domain)
+		handler(ctx)
+	}
+}
+
+// reject answers a request before it reaches the handler. Without a verified identity
+// the inbound request ID is not trusted, so the answer carries a generated one.
+func reject(ctx *fasthttp.RequestCtx, status int, title, detail string) {
+	requestid.Assign(ctx, "")
+	problem.Write(ctx, status, title, detail)
+}
+
+// verifyForwardedCertificate runs the handshake verification on a certificate passed by a front proxy,
+// recording the outcome like a handshake. extractErr is the error of reading the certificate header.
+func verifyForwardedCertificate(ctx *fasthttp.RequestCtx, certs []*x509.Certificate, extractErr error, bundles []*trustBundle) (string, string, error) {
+	startedAt := time.Now()
+	span := tracing.StartSpan("frontproxy.client_cert", tracing.KindServer, tracing.SpanContext{})
+
+	domain, reason, err := "", "", extractErr
+	switch {
+	case errors.Is(extractErr, errNoCertificate):
+		reason = FailureNoCertificate
+	case extractErr != nil:
+		reason = FailureMalformed
+	default:
+		span.SetAttribute("idcheck.client.serial", certs[0].SerialNumber.String())
+		domain, reason, err = verifyClientCertificate(certs, bundles, span)
+	}
+
+	outcome := OutcomeOK
+	if err != nil {
+		outcome = reason
+
+		f := HandshakeFailure{
+			Time:       time.Now(),
+			ClientIP:   forwardedClientIP(ctx).String(),
+			FrontProxy: true,
+			Reason:     reason,
+			Error:      err.Error(),
+		}
+		if len(certs) > 0 {
+			f.setLeaf(certs[0])
+		}
+
+		log.Info("Front proxy client certificate rejected", "clientIp", f.ClientIP, "proxyIp", ctx.RemoteIP().String(), "reason", f.Reason, "subject", f.Subject, "serial", f.Serial, "err", f.Error)
+
+		handshakeFailures.With(reason).Inc()
+		recordFailure(f)
+	}
+
+	handshakes.With(outcome).Inc()
+	handshakeDuration.With(outcome).ObserveSince(startedAt)
+
+	span.SetAttribute("client.address", forwardedClientIP(ctx).String())
+	span.SetAttribute("idcheck.handshake.outcome", outcome)
+	span.SetError(err)
+	span.Finish()
+
+	return domain, reason, err
+}
+
+// SetFrontProxyPeer marks ctx as passed by a front proxy, with the client certificates it passed
+// and the trust bundle that verified them.
+func SetFrontProxyPeer(ctx *fasthttp.RequestCtx, certs []*x509.Certificate, issuerDomain string) {
+	ctx.SetUserValue(peerCertificatesKey, certs)
+	ctx.SetUserValue(issuerDomainKey, issuerDomain)
+}
+
+// PeerCertificates returns the client certificate chain of a request, presented in the mTLS handshake
+// or passed by a trusted front proxy.
+func PeerCertificates(ctx *fasthttp.RequestCtx) []*x509.Certificate {
+	if certs, ok := ctx.UserValue(peerCertificatesKey).([]*x509.Certificate); ok {
+		return certs
+	}
+	if cs := ctx.TLSConnectionState(); cs != nil {
+		return cs.PeerCertificates
+	}
+	return nil
+}
+
+// IssuerDomain returns the name of the trust bundle that issued the client certificate of a request.
+func IssuerDomain(ctx *fasthttp.RequestCtx) string {
+	if domain, ok := ctx.UserValue(issuerDomainKey).(string); ok {
+		return domain
+	}
+	if sc, ok := ctx.Conn().(*serverConn); ok {
+		return sc.issuerDomain
+	}
+	return ""
+}
+
+// clientCertFromRFC9440 reads the RFC 9440 Client-Cert and Client-Cert-Chain headers,
+// which carry DER certificates as structured field byte sequences (:base64:).
+func clientCertFromRFC9440(h *fasthttp.RequestHeader) ([]*x509.Certificate, error) {
+	leaf := strings.TrimSpace(string(h.Peek(headerClientCert)))
+	if leaf == "" {
+		return nil, errNoCertificate
+	}
+
+	items := []string{leaf}
+	if chain := string(h.Peek(headerClientCertChain)); chain != "" {
+		items = append(items, strings.Split(chain, ",")...)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(items))
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if len(item) < 2 || item[0] != ':' || item[len(item)-1] != ':' {
+			return certs, fmt.Errorf("certificate is not a structured field byte sequence")
+		}
+
+		der, err := base64.StdEncoding.DecodeString(item[1 : len(item)-1])
+		if err != nil {
+			return certs, fmt.Errorf("invalid base64 certificate: %w", err)
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return certs, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// clientCertFromXFCC reads the X-Forwarded-Client-Cert header as set by Envoy. The last element was added
+// by the front proxy in front of id-check; its URL-encoded PEM Cert and Chain values are used.
+func clientCertFromXFCC(h *fasthttp.RequestHeader) ([]*x509.Certificate, error) {
+	value := string(h.Peek(headerXFCC))
+	if strings.TrimSpace(value) == "" {
+		return nil, errNoCertificate
+	}
+
+	elements := splitQuoted(value, ',')
+	var certPEM, chainPEM string
+	for _, pair := range splitQuoted(elements[len(elements)-1], ';') {
+		key, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		v = unquote(v)
+		switch strings.ToLower(key) {
+		case "cert":
+			certPEM = v
+		case "chain":
+			chainPEM = v
+		}
+	}
+
+	if certPEM == "" {
+		return nil, errNoCertificate
+	}
+
+	var certs []*x509.Certificate
+	for _, encoded := range []string{certPEM, chainPEM} {
+		if encoded == "" {
+			continue
+		}
+
+		decoded, err := url.PathUnescape(encoded)
+		if err != nil {
+			return certs, fmt.Errorf("invalid URL-encoded certificate: %w", err)
+		}
+
+		rest := []byte(decoded)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return certs, fmt.Errorf("failed to parse client certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate in %s", headerXFCC)
+	}
+
+	return certs, nil
+}
+
+// splitQuoted splits s on sep outside of double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var out []string
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func unquote(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v)
+}
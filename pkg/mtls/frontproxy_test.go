@@ -0,0 +1,109 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/mygaru/id-check/pkg/requestid"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestClientCertFromRFC9440(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf := ca.issue(t, clientTemplate("DV1", 10, time.Now().Add(time.Hour)))
+
+	var h fasthttp.RequestHeader
+	_, err := clientCertFromRFC9440(&h)
+	assert.ErrorIs(t, err, errNoCertificate)
+
+	h.Set(headerClientCert, ":"+base64.StdEncoding.EncodeToString(leaf.Certificate[0])+":")
+	h.Set(headerClientCertChain, ":"+base64.StdEncoding.EncodeToString(ca.cert.Raw)+":")
+	certs, err := clientCertFromRFC9440(&h)
+	assert.Nil(t, err)
+	assert.Len(t, certs, 2)
+	assert.Equal(t, "DV1", certs[0].Subject.CommonName)
+	assert.Equal(t, "Test CA", certs[1].Subject.CommonName)
+
+	h.Set(headerClientCert, base64.StdEncoding.EncodeToString(leaf.Certificate[0]))
+	_, err = clientCertFromRFC9440(&h)
+	assert.NotNil(t, err)
+}
+
+func TestClientCertFromXFCC(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	leaf := ca.issue(t, clientTemplate("DV1", 11, time.Now().Add(time.Hour)))
+	certPEM := url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]})))
+
+	var h fasthttp.RequestHeader
+	// the first element was added by an earlier hop and must be ignored
+	h.Set(headerXFCC, `By=spiffe://a;Hash=00;Subject="CN=evil,O=x";Cert="bogus",`+
+		`By=spiffe://lb;Hash=abc;Subject="CN=DV1,O=Partner";Cert="`+certPEM+`"`)
+
+	certs, err := clientCertFromXFCC(&h)
+	assert.Nil(t, err)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, "DV1", certs[0].Subject.CommonName)
+
+	h.Set(headerXFCC, `By=spiffe://lb;Hash=abc`)
+	_, err = clientCertFromXFCC(&h)
+	assert.ErrorIs(t, err, errNoCertificate)
+}
+
+func TestVerifyForwardedCertificate_ClassifiesFailures(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+	bundles := []*trustBundle{ca.bundle("test")}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5000}, nil)
+	ctx.Request.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+
+	_, reason, err := verifyForwardedCertificate(ctx, nil, errNoCertificate, bundles)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureNoCertificate, reason)
+
+	foreign := otherCA.issue(t, clientTemplate("DV2", 12, time.Now().Add(time.Hour)))
+	_, reason, err = verifyForwardedCertificate(ctx, []*x509.Certificate{foreign.Leaf}, nil, bundles)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureUnknownCA, reason)
+
+	got := HandshakeFailures(func(f *HandshakeFailure) bool { return f.FrontProxy })
+	assert.NotEmpty(t, got)
+	assert.Equal(t, "DV2", got[0].CommonName)
+	// the failure is recorded for the client, not for the front proxy
+	assert.Equal(t, "203.0.113.7", got[0].ClientIP)
+}
+
+func TestFrontProxyHandler_RejectionsCarryRequestID(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	trusted, err := cidr.Parse("10.0.0.0/8")
+	assert.Nil(t, err)
+	handler := frontProxyHandler(trusted, clientCertFromRFC9440, []*trustBundle{ca.bundle("test")}, func(ctx *fasthttp.RequestCtx) {
+		t.Fatal("rejected request reached the handler")
+	})
+
+	for remote, status := range map[string]int{"192.0.2.1": fasthttp.StatusForbidden, "10.0.0.5": fasthttp.StatusUnauthorized} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(remote), Port: 5000}, nil)
+		ctx.Request.Header.Set(requestid.Header(), "client-chosen")
+		handler(ctx)
+
+		assert.Equal(t, status, ctx.Response.StatusCode())
+		id := string(ctx.Response.Header.Peek(requestid.Header()))
+		assert.NotEmpty(t, id)
+		assert.NotEqual(t, "client-chosen", id)
+
+		var body struct {
+			RequestID string `json:"requestId"`
+		}
+		assert.Nil(t, json.Unmarshal(ctx.Response.Body(), &body))
+		assert.Equal(t, id, body.RequestID)
+	}
+}
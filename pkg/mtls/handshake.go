@@ -0,0 +1,564 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/certpolicy"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/proxyproto"
+	"github.com/mygaru/id-check/pkg/scopes"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/mygaru/id-check/pkg/tracing"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mtlsCertPolicyPath = flag.String("mtlsCertPolicyPath", "", "Path to JSON certificate policy client certificates must satisfy (key types and sizes, EKU, validity, "+
+		"subject and SAN rules, issuing intermediates); empty disables the policy")
+	mtlsHandshakeFailureHistory = flag.Int("mtlsHandshakeFailureHistory", 1000, "How many failed handshakes are kept for the admin API")
+)
+
+// Classified reasons of failed handshakes.
+const (
+	FailureNoCertificate   = "no_certificate"
+	FailureMalformed       = "malformed_certificate"
+	FailureUnknownCA       = "unknown_ca"
+	FailureExpired         = "expired"
+	FailureRevoked         = "revoked"
+	FailureReputationError = "reputation_error"
+	FailurePolicyDeny      = "policy_deny"
+	FailureTLS             = "tls_error"
+	// FailureInvalidSVID is a certificate whose spiffe:// URI SAN is not a valid SPIFFE ID.
+	FailureInvalidSVID = "invalid_svid"
+	// FailureUnknownTrustDomain is an SVID of a trust domain without a configured trust bundle.
+	FailureUnknownTrustDomain = "unknown_trust_domain"
+	// FailureInvalidScopes is a certificate whose scope extension cannot be parsed.
+	FailureInvalidScopes = "invalid_scopes"
+	// FailureUntrustedScopes is a certificate carrying a scope extension from a trust bundle that may not grant scopes.
+	FailureUntrustedScopes = "untrusted_scopes"
+	// FailureDenied is a certificate on the local denylist.
+	FailureDenied = "denied"
+	// FailureRevocationExpired is a revocation snapshot out of its validity window.
+	FailureRevocationExpired = "revocation_expired"
+)
+
+// Violations of the certificate policy are reported with their specific reason.
+const (
+	FailurePolicyKeyType  = certpolicy.ReasonKeyType
+	FailurePolicyKeySize  = certpolicy.ReasonKeySize
+	FailurePolicyEKU      = certpolicy.ReasonEKU
+	FailurePolicyValidity = certpolicy.ReasonValidity
+	FailurePolicySubject  = certpolicy.ReasonSubject
+	FailurePolicySAN      = certpolicy.ReasonSAN
+	FailurePolicyIssuer   = certpolicy.ReasonIssuer
+)
+
+// OutcomeOK is the outcome label of successful handshakes.
+const OutcomeOK = "ok"
+
+var (
+	handshakeFailures = metrics.NewCounterVec("idcheck_handshake_failures_total",
+		"Failed mTLS handshakes by classified reason", "reason")
+	handshakes = metrics.NewCounterVec("idcheck_handshakes_total",
+		"mTLS handshakes by outcome: ok or the classified failure reason", "outcome")
+	handshakeDuration = metrics.NewHistogramVec("idcheck_handshake_duration_seconds",
+		"Duration of mTLS handshakes, including chain verification and reputation lookup", metrics.DurationBuckets, "outcome")
+)
+
+// HandshakeFailure describes a failed mTLS handshake.
+type HandshakeFailure struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"clientIp"`
+	// FrontProxy is set when the certificate was passed by a TLS-terminating front proxy
+	FrontProxy   bool       `json:"frontProxy,omitempty"`
+	SNI          string     `json:"sni,omitempty"`
+	TLSVersions  []string   `json:"tlsVersions,omitempty"`
+	CipherSuites []string   `json:"cipherSuites,omitempty"`
+	Subject      string     `json:"subject,omitempty"`
+	CommonName   string     `json:"cn,omitempty"`
+	SPIFFEID     string     `json:"spiffeId,omitempty"`
+	Issuer       string     `json:"issuer,omitempty"`
+	Serial       string     `json:"serial,omitempty"`
+	NotBefore    *time.Time `json:"notBefore,omitempty"`
+	NotAfter     *time.Time `json:"notAfter,omitempty"`
+	Reason       string     `json:"reason"`
+	Error        string     `json:"error"`
+}
+
+// handshakeState collects what is known about a connection while its handshake is in progress.
+type handshakeState struct {
+	// conn is the raw connection; its remote address is only read once the handshake
+	// started, since a PROXY protocol connection learns it from the header
+	conn   net.Conn
+	hello  *tls.ClientHelloInfo
+	leaf   *x509.Certificate
+	reason string
+	span   *tracing.Span
+	// issuerDomain is the trust bundle that verified leaf
+	issuerDomain string
+	// bundle is the trust bundle named issuerDomain, nil for SVIDs verified against a SPIFFE bundle
+	bundle *trustBundle
+}
+
+// handshakeListener performs the TLS handshake itself instead of tls.NewListener,
+// so that handshake failures can be classified and recorded.
+type handshakeListener struct {
+	net.Listener
+	config  *tls.Config
+	bundles []*trustBundle
+}
+
+func newHandshakeListener(ln net.Listener, config *tls.Config, bundles []*trustBundle) net.Listener {
+	return &handshakeListener{Listener: ln, config: config, bundles: bundles}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &handshakeState{conn: c}
+
+	cfg := l.config.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hs.hello = hello
+		return nil, nil
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return hs.verify(rawCerts, l.bundles)
+	}
+
+	return &serverConn{Conn: tls.Server(c, cfg), hs: hs}, nil
+}
+
+// serverConn runs the handshake on first use and records its outcome.
+// It keeps the Handshake/ConnectionState methods fasthttp uses to detect TLS connections.
+type serverConn struct {
+	*tls.Conn
+	hs *handshakeState
+
+	once sync.Once
+	err  error
+	// handshakeSpan lets request spans link to the verification of their connection
+	handshakeSpan tracing.SpanContext
+	// issuerDomain is the trust bundle that issued the client certificate
+	issuerDomain string
+	// leaf is the verified client certificate and bundle the trust bundle that issued it
+	leaf   *x509.Certificate
+	bundle *trustBundle
+	// closed and validatedAt are guarded by conns
+	closed      bool
+	validatedAt time.Time
+
+	// reqMu guards the state used to close the connection between requests. reading is set while fasthttp
+	// waits for the next request; it has written and flushed every response by then
+	reqMu       sync.Mutex
+	reading     bool
+	closeReason string
+}
+
+func (c *serverConn) Handshake() error {
+	c.once.Do(func() {
+		startedAt := time.Now()
+		span := tracing.StartSpan("tls.handshake", tracing.KindServer, tracing.SpanContext{})
+		c.hs.span = span
+
+		c.err = c.Conn.Handshake()
+
+		outcome := OutcomeOK
+		if c.err != nil {
+			outcome = c.hs.fail(c.err)
+		}
+		if outcome != "" {
+			handshakes.With(outcome).Inc()
+			handshakeDuration.With(outcome).ObserveSince(startedAt)
+
+			span.SetAttribute("client.address", hostOf(c.hs.conn.RemoteAddr()))
+			span.SetAttribute("idcheck.handshake.outcome", outcome)
+			span.SetError(c.err)
+			span.Finish()
+			c.handshakeSpan = span.SpanContext()
+		}
+
+		c.issuerDomain = c.hs.issuerDomain
+		if c.err == nil {
+			c.leaf, c.bundle = c.hs.leaf, c.hs.bundle
+			trackConn(c)
+		}
+		c.hs = nil
+	})
+	return c.err
+}
+
+func (c *serverConn) Close() error {
+	untrackConn(c)
+	return c.Conn.Close()
+}
+
+// HandshakeSpanContext returns the span of the handshake of an mTLS connection accepted by RunServer.
+func HandshakeSpanContext(c net.Conn) tracing.SpanContext {
+	if sc, ok := c.(*serverConn); ok {
+		return sc.handshakeSpan
+	}
+	return tracing.SpanContext{}
+}
+
+// ProxyHeader returns the PROXY protocol header of an mTLS connection accepted by RunServer,
+// or nil when the connection did not come through a trusted load balancer.
+func ProxyHeader(c net.Conn) *proxyproto.Header {
+	sc, ok := c.(*serverConn)
+	if !ok {
+		return nil
+	}
+	pc, ok := sc.NetConn().(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+	h, _ := pc.Header()
+	return h
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.reqMu.Lock()
+	reason := c.closeReason
+	c.reading = reason == ""
+	c.reqMu.Unlock()
+
+	// a connection marked while its request was answered is closed before the next one is read
+	if reason != "" {
+		c.forceClose(reason)
+		return 0, net.ErrClosed
+	}
+
+	n, err := c.Conn.Read(b)
+
+	c.reqMu.Lock()
+	c.reading = false
+	c.reqMu.Unlock()
+
+	return n, err
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// verify checks the presented chain against the trust bundles and the revocation status of the leaf certificate.
+func (hs *handshakeState) verify(rawCerts [][]byte, bundles []*trustBundle) error {
+	if len(rawCerts) == 0 {
+		hs.reason = FailureNoCertificate
+		return errors.New("no client certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			hs.reason = FailureMalformed
+			return fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	hs.leaf = certs[0]
+
+	hs.span.SetAttribute("idcheck.client.serial", hs.leaf.SerialNumber.String())
+
+	domain, reason, err := verifyClientCertificate(certs, bundles, hs.span)
+	hs.issuerDomain, hs.reason = domain, reason
+	for _, b := range bundles {
+		if err == nil && b.name == domain {
+			hs.bundle = b
+		}
+	}
+	return err
+}
+
+var currentPolicy atomic.Pointer[certpolicy.Policy]
+
+// loadCertPolicy loads mtlsCertPolicyPath, if set.
+func loadCertPolicy() error {
+	if *mtlsCertPolicyPath == "" {
+		return nil
+	}
+
+	p, err := certpolicy.Load(*mtlsCertPolicyPath)
+	if err != nil {
+		return err
+	}
+	currentPolicy.Store(p)
+
+	return nil
+}
+
+// verifyClientCertificate builds the chain of certs[0] to one of bundles, evaluates the certificate policy of that bundle and
+// checks the leaf with its revocation backend, tracing chain building and revocation lookup as children of span.
+// It returns the name of the bundle that issued the certificate or, on failure, one of the Failure* reasons along with the error.
+//
+// When SPIFFE trust bundles are configured, SVIDs are verified against the bundle of their trust domain instead.
+// Such SVIDs are not issued by the myGaru CA, so their reputation is not checked.
+func verifyClientCertificate(certs []*x509.Certificate, bundles []*trustBundle, span *tracing.Span) (string, string, error) {
+	svid, isSVID, err := spiffe.FromCertificate(certs[0])
+	if err != nil {
+		return "", FailureInvalidSVID, err
+	}
+
+	// without SPIFFE trust bundles an SVID is verified like any other certificate and known by its CN
+	if roots, configured := spiffe.BundleFor(svid.TrustDomain); isSVID && configured {
+		span.SetAttribute("idcheck.client.spiffe_id", svid.String())
+
+		if roots == nil {
+			return "", FailureUnknownTrustDomain, fmt.Errorf("no trust bundle for SPIFFE trust domain %s", svid.TrustDomain)
+		}
+		bundles = []*trustBundle{{name: svid.TrustDomain, roots: roots, revocation: noRevocation{}}}
+	}
+
+	// scope extensions may be marked critical, they are understood here
+	certs[0].UnhandledCriticalExtensions = slices.DeleteFunc(certs[0].UnhandledCriticalExtensions, scopes.IsScopeExtension)
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	chainSpan := span.StartChild("x509.chain_build", tracing.KindInternal)
+	bundle, chains, err := buildChain(certs[0], intermediates, bundles)
+	chainSpan.SetError(err)
+	chainSpan.Finish()
+	if err != nil {
+		return "", classifyVerifyError(err), err
+	}
+	span.SetAttribute("idcheck.client.issuer_domain", bundle.name)
+
+	id := identity.FromCertificate(certs[0])
+	id.IssuerDomain = bundle.name
+	if !denylist.Check(context.Background(), id, denylist.StageHandshake) {
+		return "", FailureDenied, errors.New("certificate is denied")
+	}
+
+	if v := bundle.certPolicy().Evaluate(chains[0]); v != nil {
+		return "", v.Reason, v
+	}
+
+	if scopes.HasExtension(certs[0]) && !bundle.trustScopes {
+		return "", FailureUntrustedScopes, fmt.Errorf("trust bundle %s may not grant scopes", bundle.name)
+	}
+	if _, err := scopes.FromCertificate(certs[0]); err != nil {
+		return "", FailureInvalidScopes, err
+	}
+
+	cert := chains[0][0]
+	if v, revoked := revokedVerdict(bundle.name, cert); revoked {
+		return "", FailureRevoked, fmt.Errorf("revoked certificate: %s", v.Reason)
+	}
+	reputationLog.Debug("Validating certificate reputation", "bundle", bundle.name, "serial", cert.SerialNumber.String())
+
+	reputationSpan := span.StartChild("reputation.lookup", tracing.KindClient)
+	status, reason, err := bundle.revocation.status(cert)
+	reputationSpan.SetAttribute("idcheck.reputation.status", status)
+	reputationSpan.SetError(err)
+	reputationSpan.Finish()
+	if err != nil {
+		return "", revocationFailure(err), fmt.Errorf("error checking reputation: %s", err)
+	}
+
+	reputationLog.Info("Certificate reputation", "bundle", bundle.name, "serial", cert.SerialNumber.String(), "status", status, "reason", reason)
+
+	switch status {
+	case CertStatusRevoked:
+		return "", FailureRevoked, fmt.Errorf("revoked certificate: %s", reason)
+	case CertStatusGood:
+		return bundle.name, "", nil
+	case CertStatusUnknown:
+		return "", FailureReputationError, fmt.Errorf("certificate with unkown status")
+	default:
+		return "", FailureReputationError, fmt.Errorf("unkown status type: %s", status)
+	}
+}
+
+// buildChain verifies leaf against the bundles in order and returns the first one that issued it. When none did, the error
+// of a bundle that knows the issuer but rejects the chain, e.g. as expired, is preferred over an unknown authority.
+func buildChain(leaf *x509.Certificate, intermediates *x509.CertPool, bundles []*trustBundle) (*trustBundle, [][]*x509.Certificate, error) {
+	var firstErr error
+	for _, b := range bundles {
+		chains, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         b.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return b, chains, nil
+		}
+
+		var unknown x509.UnknownAuthorityError
+		if firstErr == nil || (errors.As(firstErr, &unknown) && !errors.As(err, &unknown)) {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = errors.New("no trust bundles configured")
+	}
+	return nil, nil, firstErr
+}
+
+func classifyVerifyError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return FailureUnknownCA
+	}
+
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		switch invalid.Reason {
+		case x509.Expired:
+			return FailureExpired
+		case x509.NotAuthorizedToSign:
+			return FailureUnknownCA
+		default:
+			return FailurePolicyDeny
+		}
+	}
+
+	return FailurePolicyDeny
+}
+
+// fail records a failed handshake and returns its classified reason. Connections closed
+// before sending a ClientHello (port scans, TCP health checks) are not recorded.
+func (hs *handshakeState) fail(err error) string {
+	if hs.hello == nil {
+		if pc, ok := hs.conn.(*proxyproto.Conn); ok {
+			if _, perr := pc.Header(); perr != nil && !errors.Is(perr, io.EOF) {
+				log.Warn("Invalid PROXY protocol header", "balancer", hostOf(pc.Conn.RemoteAddr()), "err", perr)
+			}
+		}
+		return ""
+	}
+
+	reason := hs.reason
+	if reason == "" {
+		reason = FailureTLS
+		if hs.leaf == nil && isNoCertificateError(err) {
+			reason = FailureNoCertificate
+		}
+	}
+
+	f := HandshakeFailure{
+		Time:     time.Now(),
+		ClientIP: hostOf(hs.conn.RemoteAddr()),
+		SNI:      hs.hello.ServerName,
+		Reason:   reason,
+		Error:    err.Error(),
+	}
+
+	for _, v := range hs.hello.SupportedVersions {
+		f.TLSVersions = append(f.TLSVersions, tls.VersionName(v))
+	}
+	for _, cs := range hs.hello.CipherSuites {
+		f.CipherSuites = append(f.CipherSuites, tls.CipherSuiteName(cs))
+	}
+
+	f.setLeaf(hs.leaf)
+
+	log.Info("Handshake failed", "clientIp", f.ClientIP, "reason", f.Reason, "subject", f.Subject, "serial", f.Serial, "err", f.Error)
+
+	handshakeFailures.With(reason).Inc()
+	recordFailure(f)
+
+	return reason
+}
+
+func (f *HandshakeFailure) setLeaf(leaf *x509.Certificate) {
+	if leaf == nil {
+		return
+	}
+
+	notBefore, notAfter := leaf.NotBefore, leaf.NotAfter
+	f.Subject = leaf.Subject.String()
+	f.CommonName = leaf.Subject.CommonName
+	if svid, ok, err := spiffe.FromCertificate(leaf); ok && err == nil {
+		if _, configured := spiffe.BundleFor(svid.TrustDomain); configured {
+			f.SPIFFEID = svid.String()
+		}
+	}
+	f.Issuer = leaf.Issuer.String()
+	f.Serial = leaf.SerialNumber.String()
+	f.NotBefore = &notBefore
+	f.NotAfter = &notAfter
+}
+
+func isNoCertificateError(err error) bool {
+	// crypto/tls does not export an error for a missing client certificate
+	return err.Error() == "tls: client didn't provide a certificate"
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+var (
+	failuresMu sync.Mutex
+	failures   []HandshakeFailure
+	failuresAt int
+)
+
+func recordFailure(f HandshakeFailure) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	limit := *mtlsHandshakeFailureHistory
+	if limit <= 0 {
+		return
+	}
+
+	if len(failures) < limit {
+		failures = append(failures, f)
+		return
+	}
+
+	failures[failuresAt] = f
+	failuresAt = (failuresAt + 1) % limit
+}
+
+// HandshakeFailures returns the recorded failed handshakes, newest first, that match filter.
+func HandshakeFailures(filter func(f *HandshakeFailure) bool) []HandshakeFailure {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+
+	out := []HandshakeFailure{}
+	n := len(failures)
+	for i := 0; i < n; i++ {
+		// walk backwards from the most recently written slot
+		f := &failures[(failuresAt-1-i+2*n)%n]
+		if filter == nil || filter(f) {
+			out = append(out, *f)
+		}
+	}
+
+	return out
+}
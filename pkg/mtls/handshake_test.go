@@ -0,0 +1,217 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// bundle returns a trust bundle of ca without revocation checks.
+func (ca *testCA) bundle(name string) *trustBundle {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return &trustBundle{name: name, roots: roots, anchors: []*x509.Certificate{ca.cert}, revocation: noRevocation{}}
+}
+
+func clientTemplate(cn string, serial int64, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+}
+
+// handshake runs a handshake of a client presenting certs against a handshake listener trusting ca.
+func handshake(t *testing.T, ca *testCA, certs []tls.Certificate) error {
+	t.Helper()
+
+	serverCert := ca.issue(t, clientTemplate("localhost", 100, time.Now().Add(time.Hour)))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	hl := newHandshakeListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAnyClientCert,
+	}, []*trustBundle{ca.bundle("test")})
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := hl.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		done <- c.(*serverConn).Handshake()
+	}()
+
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		MaxVersion: tls.VersionTLS12,
+		// present the certificate even when it is not issued by one of the CAs the server asks for
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		},
+	})
+	if err == nil {
+		_ = client.Close()
+	}
+
+	return <-done
+}
+
+func TestHandshake_ClassifiesFailures(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCA := newTestCA(t, "Other CA")
+
+	cases := []struct {
+		name   string
+		certs  []tls.Certificate
+		reason string
+	}{
+		{"no certificate", nil, FailureNoCertificate},
+		{"unknown ca", []tls.Certificate{otherCA.issue(t, clientTemplate("DV1", 2, time.Now().Add(time.Hour)))}, FailureUnknownCA},
+		{"expired", []tls.Certificate{ca.issue(t, clientTemplate("DV1", 3, time.Now().Add(-time.Hour)))}, FailureExpired},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := handshake(t, ca, c.certs)
+			assert.NotNil(t, err)
+
+			got := HandshakeFailures(nil)
+			assert.NotEmpty(t, got)
+			assert.Equal(t, c.reason, got[0].Reason)
+			assert.Equal(t, "127.0.0.1", got[0].ClientIP)
+			assert.Equal(t, "localhost", got[0].SNI)
+
+			if len(c.certs) > 0 {
+				assert.Equal(t, "DV1", got[0].CommonName)
+				assert.NotNil(t, got[0].NotAfter)
+			}
+		})
+	}
+
+	assert.Len(t, HandshakeFailures(func(f *HandshakeFailure) bool { return f.Reason == FailureExpired }), 1)
+}
+
+func TestHandshake_SPIFFETrustBundles(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	spiffeCA := newTestCA(t, "SPIFFE CA")
+
+	bundle := filepath.Join(t.TempDir(), "prod.pem")
+	assert.Nil(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spiffeCA.cert.Raw}), 0o644))
+
+	assert.Nil(t, flag.Set("spiffeTrustBundles", "prod.mygaru.internal="+bundle))
+	assert.Nil(t, spiffe.Init())
+	t.Cleanup(func() {
+		_ = flag.Set("spiffeTrustBundles", "")
+		_ = spiffe.Init()
+	})
+
+	svid := func(uri string) []tls.Certificate {
+		tmpl := clientTemplate("", 7, time.Now().Add(time.Hour))
+		u, err := url.Parse(uri)
+		assert.Nil(t, err)
+		tmpl.URIs = []*url.URL{u}
+		return []tls.Certificate{spiffeCA.issue(t, tmpl)}
+	}
+
+	// verified against the bundle of its trust domain, SVIDs are not looked up in the reputation service
+	assert.Nil(t, handshake(t, ca, svid("spiffe://prod.mygaru.internal/ns/billing/sa/api")))
+
+	assert.NotNil(t, handshake(t, ca, svid("spiffe://dev.mygaru.internal/ns/billing/sa/api")))
+	got := HandshakeFailures(nil)
+	assert.Equal(t, FailureUnknownTrustDomain, got[0].Reason)
+	assert.Equal(t, "spiffe://dev.mygaru.internal/ns/billing/sa/api", got[0].SPIFFEID)
+
+	assert.NotNil(t, handshake(t, ca, svid("spiffe://prod.mygaru.internal/ns/../api")))
+	assert.Equal(t, FailureInvalidSVID, HandshakeFailures(nil)[0].Reason)
+}
+
+func TestHandshake_SPIFFEIDWithoutTrustBundles(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+
+	tmpl := clientTemplate("partner-a", 8, time.Now().Add(time.Hour))
+	u, err := url.Parse("spiffe://prod.mygaru.internal/ns/billing/sa/api")
+	assert.Nil(t, err)
+	tmpl.URIs = []*url.URL{u}
+	cert := ca.issue(t, tmpl)
+	assert.Nil(t, handshake(t, ca, []tls.Certificate{cert}))
+
+	// without SPIFFE trust bundles nothing vouches for the SAN, the certificate is known by its CN
+	id := identity.FromCertificate(cert.Leaf)
+	assert.True(t, id.SPIFFEID.IsZero())
+	assert.Equal(t, "partner-a", id.Name())
+}
@@ -3,6 +3,7 @@ package mtls
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
@@ -84,52 +85,82 @@ func GetCaCertURL() string {
 }
 
 func createCaPool() (*x509.CertPool, error) {
-	var caCert []byte
-	var err error
-	if *mtlsCaCertPath != "" {
-		caCert, err = os.ReadFile(*mtlsCaCertPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read CA certificate from path %s: %w", *mtlsCaCertPath, err)
-		}
-	} else if *mtlsCaCertURL != "" {
-		req := fasthttp.AcquireRequest()
-		resp := fasthttp.AcquireResponse()
-		defer func() {
-			fasthttp.ReleaseRequest(req)
-			fasthttp.ReleaseResponse(resp)
-		}()
-
-		req.SetRequestURI(*mtlsCaCertURL)
-		req.Header.SetMethod(fasthttp.MethodGet)
-
-		client, err := proxy.GetClient(req, *mtlsCaCertURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get proxy client: %w", err)
-		}
+	caCert, err := fetchCACerts(*mtlsCaCertPath, *mtlsCaCertURL)
+	if err != nil {
+		return nil, err
+	}
+
+	systemPool, err := x509.SystemCertPool()
+	if err != nil {
+		systemPool = x509.NewCertPool()
+	}
+
+	if !systemPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to append CA certificate: %s", caCert)
+	}
+
+	exportExpiry(roleTrustAnchor, parsePEMCertificates(caCert)...)
+
+	return systemPool, nil
+}
 
-		err = client.DoTimeout(req, resp, 30*time.Second)
+// fetchCACerts reads a PEM bundle from path or, when path is empty, downloads it from caURL.
+func fetchCACerts(path, caURL string) ([]byte, error) {
+	if path != "" {
+		caCert, err := os.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get CA certificate from %s: %w", *mtlsCaCertURL, err)
+			return nil, fmt.Errorf("failed to read CA certificate from path %s: %w", path, err)
 		}
+		return caCert, nil
+	}
+	if caURL == "" {
+		return nil, fmt.Errorf("must specify either flags mtlsCaCertURL or mtlsCaCertPath")
+	}
 
-		if resp.StatusCode() != fasthttp.StatusOK {
-			return nil, fmt.Errorf("failed to read CA certificate from URL %s: got %d, want %d", *mtlsCaCertURL, resp.StatusCode(), fasthttp.StatusOK)
-		}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
 
-		caCert = resp.Body()
+	req.SetRequestURI(caURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
 
-	} else {
-		return nil, fmt.Errorf("must specify either flags mtlsCaCertURL or mtlsCaCertPath")
+	client, err := proxy.GetClient(req, caURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy client: %w", err)
 	}
 
-	systemPool, err := x509.SystemCertPool()
+	err = client.DoTimeout(req, resp, 30*time.Second)
 	if err != nil {
-		systemPool = x509.NewCertPool()
+		return nil, fmt.Errorf("failed to get CA certificate from %s: %w", caURL, err)
 	}
 
-	if !systemPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate: %s", caCert)
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("failed to read CA certificate from URL %s: got %d, want %d", caURL, resp.StatusCode(), fasthttp.StatusOK)
 	}
 
-	return systemPool, nil
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+// parsePEMCertificates returns the certificates of a PEM bundle, skipping anything it cannot parse.
+func parsePEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
 }
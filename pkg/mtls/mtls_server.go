@@ -5,15 +5,24 @@ import (
 	"crypto/x509"
 	"flag"
 	"fmt"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/mygaru/id-check/pkg/logger"
 	"github.com/mygaru/id-check/pkg/proxy"
+	"github.com/mygaru/id-check/pkg/proxyproto"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastjson"
-	"log"
 	"net"
+	"slices"
+	"sync"
 	"time"
 )
 
-// todo add more http flags & metrics
+var (
+	log           = logger.For(logger.ComponentMTLS)
+	reputationLog = logger.For(logger.ComponentReputation)
+)
+
+// todo add more http flags
 var (
 	httpServerListenAddr = flag.String("mtlsServerListenAddr", ":443", "")
 )
@@ -25,62 +34,97 @@ var (
 	mtlsReputationUrl        = flag.String("mtlsReputationUrl", "https://ca.mygaru.com/reputation", "Where to check cert status")
 )
 
+var (
+	mtlsProxyProtocolTrustedCIDRs = flag.String("mtlsProxyProtocolTrustedCIDRs", "", "Comma-separated CIDRs of load balancers whose connections start with a PROXY protocol v1/v2 header; "+
+		"empty disables the PROXY protocol")
+	mtlsProxyProtocolTimeout = flag.Duration("mtlsProxyProtocolTimeout", 5*time.Second, "How long to wait for the PROXY protocol header")
+)
+
 func RunServer(handler fasthttp.RequestHandler) {
-	caCertPool, err := createCaPool()
+	if err := loadCertPolicy(); err != nil {
+		logger.Fatal(log, "Failed to load certificate policy", "err", err)
+	}
+	bundles, err := loadTrustBundles()
 	if err != nil {
-		log.Fatalf("Failed to create CA pool: %s", err)
+		logger.Fatal(log, "Failed to load trust bundles", "err", err)
 	}
 
 	cert, err := tls.LoadX509KeyPair(*mtlsServerCertPath, *mtlsServerPrivateKeyPath)
 	if err != nil {
-		log.Fatalf("Failed to load certificate pair: %s", err)
+		logger.Fatal(log, "Failed to load certificate pair", "err", err)
 	}
+	exportExpiry(roleServer, cert.Leaf)
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		ClientCAs:    caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			cert := verifiedChains[0][0]
-			log.Printf("Validating server certificate with CRL (serial: %s)", cert.SerialNumber.String())
-
-			status, reason, err := CheckCertReputation(cert)
-			if err != nil {
-				return fmt.Errorf("error checking reputation: %s", err)
-			}
-
-			log.Printf("Cert %s has status=%s reason=%s", cert.SerialNumber.String(), status, reason)
-
-			switch status {
-			case CertStatusRevoked:
-				return fmt.Errorf("revoked certificate: %s", reason)
-			case CertStatusGood:
-				return nil
-			case CertStatusUnknown:
-				return fmt.Errorf("certificate with unkown status")
-			default:
-				return fmt.Errorf("unkown status type: %s", status)
-			}
-		},
+		ClientCAs:    clientCAs(bundles),
+		// the chain is verified by the handshake listener, which classifies failures
+		ClientAuth: tls.RequireAnyClientCert,
 	}
 
 	ln, err := net.Listen("tcp", *httpServerListenAddr)
 	if err != nil {
-		log.Fatalf("Failed to listen: %s", err)
+		logger.Fatal(log, "Failed to listen", "err", err)
 	}
 
-	lnTls := tls.NewListener(ln, tlsConfig)
+	trustedBalancers, err := cidr.Parse(*mtlsProxyProtocolTrustedCIDRs)
+	if err != nil {
+		logger.Fatal(log, "Invalid mtlsProxyProtocolTrustedCIDRs", "err", err)
+	}
+	if len(trustedBalancers) > 0 {
+		ln = &proxyproto.Listener{Listener: ln, Trusted: trustedBalancers, Timeout: *mtlsProxyProtocolTimeout}
+	}
+
+	lnTls := newHandshakeListener(ln, tlsConfig, bundles)
+
+	go revalidateLoop()
+	go runRevocationFeed(bundles)
 
 	s := &fasthttp.Server{
-		Handler:            handler,
+		Handler:            trackRequests(handler),
 		MaxRequestBodySize: *mtlsServerMaxBodySize,
+		CloseOnShutdown:    true,
 	}
+	addServer(s)
 
 	if err := s.Serve(lnTls); err != nil {
-		log.Fatalf("Failed to serve: %s", err)
+		logger.Fatal(log, "Failed to serve", "err", err)
 	}
 }
 
+// servers are the client facing servers of RunServer and RunFrontProxyServer.
+var servers struct {
+	sync.Mutex
+	running []*fasthttp.Server
+}
+
+func addServer(s *fasthttp.Server) {
+	servers.Lock()
+	defer servers.Unlock()
+
+	servers.running = append(servers.running, s)
+}
+
+// Shutdown stops the servers of RunServer and RunFrontProxyServer from accepting connections and waits until their
+// in-flight requests are answered. RunServer and RunFrontProxyServer return right away.
+func Shutdown() {
+	servers.Lock()
+	running := slices.Clone(servers.running)
+	servers.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range running {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(); err != nil {
+				log.Warn("Failed to shut down server", "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 const (
 	CertStatusRevoked = "revoked"
 	CertStatusGood    = "good"
@@ -89,6 +133,10 @@ const (
 
 // CheckCertReputation checks reputation of cert, and returns status, reason, and error
 func CheckCertReputation(cert *x509.Certificate) (string, string, error) {
+	return checkCertReputationAt(*mtlsReputationUrl, cert)
+}
+
+func checkCertReputationAt(reputationURL string, cert *x509.Certificate) (string, string, error) {
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
 
@@ -97,9 +145,9 @@ func CheckCertReputation(cert *x509.Certificate) (string, string, error) {
 		fasthttp.ReleaseRequest(req)
 	}()
 
-	url := *mtlsReputationUrl + "/" + cert.SerialNumber.String()
+	url := reputationURL + "/" + cert.SerialNumber.String()
 
-	log.Printf("Checking reputation of %s", url)
+	reputationLog.Debug("Checking reputation", "url", url)
 
 	client, err := proxy.GetClient(req, url)
 	if err != nil {
@@ -133,3 +181,24 @@ func CheckCertReputation(cert *x509.Certificate) (string, string, error) {
 	return string(status), string(v.GetStringBytes("reason")), nil
 
 }
+
+// GetMTLSServerConfig builds a *tls.Config for listeners that only accept clients with a certificate
+// issued by the CA of mtlsCaCertPath/mtlsCaCertURL, presenting the certificate of mtlsServerCertPath.
+func GetMTLSServerConfig() (*tls.Config, error) {
+	caCertPool, err := createCaPool()
+	if err != nil {
+		return nil, fmt.Errorf("error creating CA pool: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*mtlsServerCertPath, *mtlsServerPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate pair: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
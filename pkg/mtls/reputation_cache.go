@@ -0,0 +1,79 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"flag"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	mtlsReputationCacheTTL = flag.Duration("mtlsReputationCacheTTL", 0, "How long a reputation verdict is reused for new handshakes with the same certificate; 0 checks on every handshake")
+)
+
+var (
+	reputationLookupDuration = metrics.NewHistogram("idcheck_reputation_lookup_duration_seconds",
+		"Duration of certificate reputation lookups", metrics.DurationBuckets)
+	reputationLookupErrors = metrics.NewCounterVec("idcheck_reputation_lookup_errors_total",
+		"Failed certificate reputation lookups")
+	reputationVerdicts = metrics.NewCounterVec("idcheck_reputation_verdicts_total",
+		"Certificate reputation verdicts by status, including cached ones", "status", "cached")
+)
+
+// Verdict is the outcome of a reputation check of a certificate.
+type Verdict struct {
+	Status    string
+	Reason    string
+	CheckedAt time.Time
+}
+
+var verdicts sync.Map // bundle + "/" + serial -> Verdict
+
+// ReputationCacheEnabled reports whether reputation verdicts are reused for new handshakes, see mtlsReputationCacheTTL.
+func ReputationCacheEnabled() bool {
+	return *mtlsReputationCacheTTL > 0
+}
+
+// CachedVerdict returns the last reputation verdict of the certificate with the given serial issued within a trust bundle.
+func CachedVerdict(bundle, serial string) (Verdict, bool) {
+	v, ok := verdicts.Load(bundle + "/" + serial)
+	if !ok {
+		return Verdict{}, false
+	}
+	return v.(Verdict), true
+}
+
+// revokedVerdict returns the cached verdict of cert when it was found revoked within bundle, by a lookup,
+// the revocation feed or a peer. Revocations are final, so it applies whatever mtlsReputationCacheTTL and
+// the revocation backend of the bundle say.
+func revokedVerdict(bundle string, cert *x509.Certificate) (Verdict, bool) {
+	v, ok := CachedVerdict(bundle, cert.SerialNumber.String())
+	return v, ok && v.Status == CertStatusRevoked
+}
+
+func checkCertReputationCached(bundle, reputationURL string, cert *x509.Certificate) (string, string, error) {
+	serial := cert.SerialNumber.String()
+
+	if v, ok := CachedVerdict(bundle, serial); ok && *mtlsReputationCacheTTL > 0 && time.Since(v.CheckedAt) < *mtlsReputationCacheTTL {
+		reputationVerdicts.With(v.Status, "true").Inc()
+		return v.Status, v.Reason, nil
+	}
+
+	startedAt := time.Now()
+	status, reason, err := checkCertReputationAt(reputationURL, cert)
+	reputationLookupDuration.ObserveSince(startedAt)
+	if err != nil {
+		reputationLookupErrors.With().Inc()
+		return "", "", err
+	}
+
+	reputationVerdicts.With(status, "false").Inc()
+
+	storeVerdict(bundle, serial, Verdict{Status: status, Reason: reason, CheckedAt: time.Now()})
+	if status == CertStatusRevoked {
+		revokedUpdated(bundle, revokedSerial(serial))
+	}
+
+	return status, reason, nil
+}
@@ -0,0 +1,136 @@
+package mtls
+
+import (
+	"flag"
+	"github.com/valyala/fasthttp"
+	"time"
+)
+
+var (
+	mtlsRevalidateInterval = flag.Duration("mtlsRevalidateInterval", 0, "How often the certificate of an open client connection is checked again for expiry and revocation; "+
+		"connections failing the check are closed after their in-flight request. 0 only reacts to revocations learned from other handshakes and CRL updates")
+)
+
+// revalidateLoop re-checks every open connection once its last check is older than mtlsRevalidateInterval.
+func revalidateLoop() {
+	interval := *mtlsRevalidateInterval
+	if interval <= 0 {
+		return
+	}
+
+	for now := range time.Tick(max(interval/4, time.Second)) {
+		revalidateConnections(now, interval)
+	}
+}
+
+func revalidateConnections(now time.Time, interval time.Duration) {
+	conns.Lock()
+	var due []*serverConn
+	for c := range conns.open {
+		if now.Sub(c.validatedAt) >= interval {
+			c.validatedAt = now
+			due = append(due, c)
+		}
+	}
+	conns.Unlock()
+
+	for _, c := range due {
+		if reason := revalidate(c, now); reason != "" {
+			c.closeAfterRequest(reason)
+		}
+	}
+}
+
+// revalidate returns the Disconnect* reason when the certificate of c is no longer acceptable.
+// Failing revocation lookups keep the connection open.
+func revalidate(c *serverConn, now time.Time) string {
+	if now.After(c.leaf.NotAfter) {
+		return DisconnectExpired
+	}
+	if c.bundle == nil {
+		return ""
+	}
+	if _, revoked := revokedVerdict(c.bundle.name, c.leaf); revoked {
+		return DisconnectRevoked
+	}
+
+	status, _, err := c.bundle.revocation.status(c.leaf)
+	if err != nil {
+		reputationLog.Warn("Failed to revalidate certificate of open connection", "bundle", c.bundle.name, "serial", c.leaf.SerialNumber.String(), "err", err)
+		return ""
+	}
+	if status == CertStatusRevoked {
+		return DisconnectRevoked
+	}
+	return ""
+}
+
+// revokedUpdated closes the open connections of bundle whose certificate serial is revoked, once their in-flight request is done.
+// Revocation backends call it when they learn about revoked certificates.
+func revokedUpdated(bundle string, revoked func(serial string) bool) {
+	conns.Lock()
+	var matched []*serverConn
+	for c := range conns.open {
+		if c.bundle != nil && c.bundle.name == bundle && revoked(c.leaf.SerialNumber.String()) {
+			matched = append(matched, c)
+		}
+	}
+	conns.Unlock()
+
+	for _, c := range matched {
+		c.closeAfterRequest(DisconnectRevoked)
+	}
+}
+
+// closeAfterRequest closes c right away when it waits for the next request, or marks it to be closed once the response
+// to its in-flight request is written.
+func (c *serverConn) closeAfterRequest(reason string) {
+	c.reqMu.Lock()
+	if c.closeReason != "" {
+		c.reqMu.Unlock()
+		return
+	}
+	c.closeReason = reason
+	idle := c.reading
+	c.reqMu.Unlock()
+
+	if idle {
+		c.forceClose(reason)
+	}
+}
+
+func (c *serverConn) forceClose(reason string) {
+	log.Info("Closing connection of a no longer acceptable certificate", "clientIp", hostOf(c.RemoteAddr()),
+		"cn", c.leaf.Subject.CommonName, "serial", c.leaf.SerialNumber.String(), "reason", reason)
+	_ = c.Close()
+	forcedDisconnects.With(reason).Inc()
+}
+
+// trackRequests wraps handler so that connections marked by closeAfterRequest while handling a request tell the client
+// and are closed by fasthttp once the response is written. Connections marked later are closed on their next read.
+func trackRequests(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		handler(ctx)
+
+		c, ok := ctx.Conn().(*serverConn)
+		if !ok {
+			return
+		}
+
+		c.reqMu.Lock()
+		reason := c.closeReason
+		c.reqMu.Unlock()
+
+		if reason != "" {
+			ctx.SetConnectionClose()
+			forcedDisconnects.With(reason).Inc()
+			log.Info("Closing connection after the in-flight request", "clientIp", hostOf(c.RemoteAddr()),
+				"cn", c.leaf.Subject.CommonName, "serial", c.leaf.SerialNumber.String(), "reason", reason)
+		}
+	}
+}
+
+// revokedSerial is a revokedUpdated matcher for a single serial.
+func revokedSerial(serial string) func(string) bool {
+	return func(s string) bool { return s == serial }
+}
@@ -0,0 +1,89 @@
+package mtls
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRevalidateConnections_Expired(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	expired, client := connect(t, ca, ca.issue(t, clientTemplate("RV1", 70, time.Now().Add(time.Hour))))
+	good, _ := connect(t, ca, ca.issue(t, clientTemplate("RV2", 71, time.Now().Add(3*time.Hour))))
+	t.Cleanup(func() { _ = good.Close() })
+	awaitRequest(t, expired)
+
+	revalidateConnections(time.Now().Add(2*time.Hour), time.Minute)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	good.reqMu.Lock()
+	assert.Equal(t, "", good.closeReason)
+	good.reqMu.Unlock()
+}
+
+func TestRevokedUpdated_AfterInFlightRequest(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	conn, client := connect(t, ca, ca.issue(t, clientTemplate("RV3", 72, time.Now().Add(time.Hour))))
+	t.Cleanup(func() { _ = conn.Close() })
+
+	revokedUpdated("other", revokedSerial("72"))
+	revokedUpdated("test", revokedSerial("73"))
+	conn.reqMu.Lock()
+	assert.Equal(t, "", conn.closeReason)
+	conn.reqMu.Unlock()
+
+	revokedUpdated("test", revokedSerial("72"))
+
+	conn.reqMu.Lock()
+	assert.Equal(t, DisconnectRevoked, conn.closeReason)
+	conn.reqMu.Unlock()
+
+	// the connection stays open while the in-flight request is answered
+	conns.Lock()
+	_, open := conns.open[conn]
+	conns.Unlock()
+	assert.True(t, open)
+
+	// and is closed instead of reading the next request
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestTrackRequests_ResponseWrittenBeforeClose(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	conn, client := connect(t, ca, ca.issue(t, clientTemplate("RV4", 74, time.Now().Add(time.Hour))))
+
+	go func() {
+		_ = fasthttp.ServeConn(conn, trackRequests(func(ctx *fasthttp.RequestCtx) {
+			revokedUpdated("test", revokedSerial("74"))
+			ctx.SetBodyString("ok")
+		}))
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Nil(t, err)
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.True(t, resp.Close)
+
+	_, err = br.ReadByte()
+	assert.NotNil(t, err)
+}
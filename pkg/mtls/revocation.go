@@ -0,0 +1,201 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/diskcache"
+	"github.com/mygaru/id-check/pkg/proxy"
+	"github.com/valyala/fasthttp"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocationBackend returns the CertStatus* of a certificate along with a reason.
+type revocationBackend interface {
+	status(cert *x509.Certificate) (string, string, error)
+}
+
+// reputationBackend asks a myGaru reputation service, reusing verdicts for mtlsReputationCacheTTL.
+type reputationBackend struct {
+	bundle string
+	url    string
+}
+
+func (r *reputationBackend) status(cert *x509.Certificate) (string, string, error) {
+	return checkCertReputationCached(r.bundle, r.url, cert)
+}
+
+type noRevocation struct{}
+
+func (noRevocation) status(*x509.Certificate) (string, string, error) {
+	return CertStatusGood, "", nil
+}
+
+// crlBackend checks certificates against a CRL signed by one of the bundle's CAs, downloaded periodically.
+type crlBackend struct {
+	bundle  string
+	url     string
+	issuers []*x509.Certificate
+
+	mu         sync.RWMutex
+	revoked    map[string]time.Time // serial -> revocation time
+	nextUpdate time.Time
+
+	// cachePath is where the last downloaded CRL is persisted, empty when mtlsCacheDir is not set
+	cachePath string
+}
+
+// start downloads the CRL and keeps refreshing it every interval. A CRL that cannot be loaded at startup is an error,
+// unless the copy persisted in mtlsCacheDir is still before its nextUpdate.
+func (c *crlBackend) start(interval time.Duration) error {
+	if err := c.refresh(); err != nil {
+		if cacheErr := c.restore(); cacheErr != nil {
+			return fmt.Errorf("%w; cached CRL: %s", err, cacheErr)
+		}
+		reputationLog.Warn("Failed to download CRL, using the cached one", "bundle", c.bundle, "url", c.url, "err", err)
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := c.refresh(); err != nil {
+				reputationLog.Error("Failed to refresh CRL, keeping the previous one", "bundle", c.bundle, "url", c.url, "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *crlBackend) refresh() error {
+	der, err := c.fetch()
+	if err != nil {
+		return err
+	}
+	if err := c.apply(der); err != nil {
+		return err
+	}
+
+	if c.cachePath != "" {
+		if err := diskcache.Save(c.cachePath, cachedCRL{URL: c.url, DER: der}); err != nil {
+			reputationLog.Error("Failed to persist CRL", "bundle", c.bundle, "path", c.cachePath, "err", err)
+		}
+	}
+	return nil
+}
+
+// restore applies the CRL persisted in mtlsCacheDir, unless it is past its nextUpdate.
+func (c *crlBackend) restore() error {
+	if c.cachePath == "" {
+		return errors.New("mtlsCacheDir is not set")
+	}
+
+	var cached cachedCRL
+	if err := diskcache.Load(c.cachePath, &cached); err != nil {
+		return err
+	}
+	if cached.URL != c.url {
+		return fmt.Errorf("%s holds the CRL of %s", c.cachePath, cached.URL)
+	}
+
+	crl, err := x509.ParseRevocationList(cached.DER)
+	if err != nil {
+		return fmt.Errorf("failed to parse cached CRL: %w", err)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("cached CRL expired at %s", crl.NextUpdate.Format(time.RFC3339))
+	}
+
+	return c.apply(cached.DER)
+}
+
+// apply verifies a DER CRL and replaces the revoked serials with its entries.
+func (c *crlBackend) apply(der []byte) error {
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse CRL from %s: %w", c.url, err)
+	}
+
+	if err := c.checkSignature(crl); err != nil {
+		return err
+	}
+
+	revoked := make(map[string]time.Time, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = e.RevocationTime
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.nextUpdate = crl.NextUpdate
+	c.mu.Unlock()
+
+	reputationLog.Info("Loaded CRL", "bundle", c.bundle, "url", c.url, "revoked", len(revoked), "nextUpdate", crl.NextUpdate)
+
+	revokedUpdated(c.bundle, func(serial string) bool {
+		_, ok := revoked[serial]
+		return ok
+	})
+
+	return nil
+}
+
+func (c *crlBackend) checkSignature(crl *x509.RevocationList) error {
+	var err error
+	for _, issuer := range c.issuers {
+		if err = crl.CheckSignatureFrom(issuer); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL from %s is not signed by a CA of the bundle: %w", c.url, err)
+}
+
+func (c *crlBackend) fetch() ([]byte, error) {
+	if path, ok := strings.CutPrefix(c.url, "file://"); ok {
+		return os.ReadFile(path)
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+
+	req.SetRequestURI(c.url)
+	req.Header.SetMethod(fasthttp.MethodGet)
+
+	client, err := proxy.GetClient(req, c.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy client: %w", err)
+	}
+	if err := client.DoTimeout(req, resp, 30*time.Second); err != nil {
+		return nil, fmt.Errorf("failed to download CRL from %s: %w", c.url, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("failed to download CRL from %s: got %d, want %d", c.url, resp.StatusCode(), fasthttp.StatusOK)
+	}
+
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+func (c *crlBackend) status(cert *x509.Certificate) (string, string, error) {
+	return c.lookup(cert.SerialNumber, time.Now())
+}
+
+func (c *crlBackend) lookup(serial *big.Int, now time.Time) (string, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.nextUpdate.IsZero() && now.After(c.nextUpdate) {
+		return "", "", fmt.Errorf("CRL of bundle %s expired at %s", c.bundle, c.nextUpdate.Format(time.RFC3339))
+	}
+
+	if at, ok := c.revoked[serial.String()]; ok {
+		return CertStatusRevoked, "listed in CRL since " + at.UTC().Format(time.RFC3339), nil
+	}
+	return CertStatusGood, "", nil
+}
@@ -0,0 +1,234 @@
+package mtls
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/proxy"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mtlsRevocationFeedURL = flag.String("mtlsRevocationFeedURL", "", "URL of the CA revocation feed (Server-Sent Events) pushing revoked certificates; "+
+		"empty disables the subscription")
+	mtlsRevocationFeedRetry   = flag.Duration("mtlsRevocationFeedRetry", 5*time.Second, "How long to wait before reconnecting to the revocation feed, unless the feed sends its own retry")
+	mtlsRevocationFeedTimeout = flag.Duration("mtlsRevocationFeedTimeout", 10*time.Second, "How long to wait for the revocation feed to accept the connection, complete the TLS handshake "+
+		"and send the response headers; the event stream itself has no deadline")
+)
+
+var (
+	revocationFeedEvents = metrics.NewCounterVec("idcheck_revocation_feed_events_total",
+		"Revocation feed events by outcome", "outcome")
+	revocationFeedConnected atomic.Bool
+)
+
+func init() {
+	metrics.NewGaugeFunc("idcheck_revocation_feed_connected", "Whether the revocation feed subscription is connected", func() float64 {
+		if revocationFeedConnected.Load() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// RevocationEventType is the SSE event type of a revocation. Events of other types are ignored.
+const RevocationEventType = "revoked"
+
+// RevocationEvent is the data of a revocation feed event. An empty Bundle stands for mtlsDefaultBundleName.
+type RevocationEvent struct {
+	Bundle    string    `json:"bundle,omitempty"`
+	Serial    string    `json:"serial"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revokedAt,omitempty"`
+}
+
+// revocationFeed is a resumable subscription to the revocation feed at url.
+type revocationFeed struct {
+	url     string
+	bundles map[string]bool
+	client  *http.Client
+
+	lastEventID string
+	retry       time.Duration
+}
+
+func newRevocationFeed(url string, bundles []*trustBundle) (*revocationFeed, error) {
+	pc, err := proxy.NewProxyContext(url)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := *mtlsRevocationFeedTimeout
+	transport := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	switch {
+	case pc.ProxyURL == nil:
+	case pc.BaseURLScheme == "http":
+		// plain HTTP requests are sent to the proxy in absolute form
+		transport.Proxy = http.ProxyURL(pc.ProxyURL)
+	default:
+		dial := proxy.ProxyDialerTimeout(pc, timeout)
+		transport.DialContext = func(_ context.Context, _, addr string) (net.Conn, error) {
+			return dial(addr)
+		}
+	}
+
+	names := make(map[string]bool, len(bundles))
+	for _, b := range bundles {
+		names[b.name] = true
+	}
+
+	return &revocationFeed{url: url, bundles: names, client: &http.Client{Transport: transport}, retry: *mtlsRevocationFeedRetry}, nil
+}
+
+// runRevocationFeed keeps a subscription to mtlsRevocationFeedURL, reconnecting after failures.
+// It is a no-op when the feed is disabled.
+func runRevocationFeed(bundles []*trustBundle) {
+	if *mtlsRevocationFeedURL == "" {
+		return
+	}
+
+	f, err := newRevocationFeed(*mtlsRevocationFeedURL, bundles)
+	if err != nil {
+		reputationLog.Error("Failed to set up revocation feed", "url", *mtlsRevocationFeedURL, "err", err)
+		return
+	}
+
+	for {
+		err := f.subscribe(context.Background())
+		reputationLog.Warn("Revocation feed disconnected", "url", f.url, "lastEventId", f.lastEventID, "retry", f.retry, "err", err)
+		time.Sleep(f.retry)
+	}
+}
+
+// subscribe reads the feed until the connection ends, resuming after lastEventID.
+func (f *revocationFeed) subscribe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if f.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", f.lastEventID)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		return fmt.Errorf("unexpected content type %q", ct)
+	}
+
+	reputationLog.Info("Subscribed to revocation feed", "url", f.url, "lastEventId", f.lastEventID)
+	revocationFeedConnected.Store(true)
+	defer revocationFeedConnected.Store(false)
+
+	return f.read(resp.Body)
+}
+
+// read dispatches the events of an SSE stream, see https://html.spec.whatwg.org/multipage/server-sent-events.html.
+func (f *revocationFeed) read(r io.Reader) error {
+	var (
+		event string
+		data  []string
+		id    string
+		hasID bool
+	)
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if hasID {
+				f.lastEventID = id
+			}
+			if len(data) > 0 {
+				f.dispatch(event, strings.Join(data, "\n"))
+			}
+			event, data, hasID = "", nil, false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				id, hasID = value, true
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				f.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (f *revocationFeed) dispatch(event, data string) {
+	if event != RevocationEventType {
+		revocationFeedEvents.With("ignored").Inc()
+		return
+	}
+
+	var ev RevocationEvent
+	if err := json.Unmarshal([]byte(data), &ev); err != nil || ev.Serial == "" {
+		revocationFeedEvents.With("invalid").Inc()
+		reputationLog.Warn("Invalid revocation feed event", "id", f.lastEventID, "data", data, "err", err)
+		return
+	}
+	if ev.Bundle == "" {
+		ev.Bundle = *mtlsDefaultBundleName
+	}
+	if !f.bundles[ev.Bundle] {
+		revocationFeedEvents.With("unknown_bundle").Inc()
+		reputationLog.Warn("Revocation feed event for an unknown trust bundle", "id", f.lastEventID, "bundle", ev.Bundle, "serial", ev.Serial)
+		return
+	}
+
+	applyRevocation(ev)
+	revocationFeedEvents.With("applied").Inc()
+}
+
+// applyRevocation records a pushed revocation in the reputation cache, which new handshakes and revalidations of the bundle
+// honor, and closes the open connections of the revoked certificate. Serials are only unique within a CA, so the revocation
+// is not added to the denylist, which applies to every bundle.
+func applyRevocation(ev RevocationEvent) {
+	reason := ev.Reason
+	if reason == "" {
+		reason = "revoked by CA"
+	}
+	reputationLog.Warn("Certificate revoked by feed", "bundle", ev.Bundle, "serial", ev.Serial, "reason", reason)
+
+	storeVerdict(ev.Bundle, ev.Serial, Verdict{Status: CertStatusRevoked, Reason: reason, CheckedAt: time.Now()})
+	revokedUpdated(ev.Bundle, revokedSerial(ev.Serial))
+}
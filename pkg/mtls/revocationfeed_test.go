@@ -0,0 +1,103 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/revocationfeedtest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevocationFeed_ParseEvents(t *testing.T) {
+	f := &revocationFeed{bundles: map[string]bool{"test": true}}
+	stream := ": comment\nretry: 1500\n\nid: 7\nevent: revoked\ndata: {\"bundle\": \"test\",\ndata:  \"serial\": \"90\"}\n\nid: 8\nevent: ping\ndata: {}\n\n"
+
+	assert.NotNil(t, f.read(strings.NewReader(stream)))
+	assert.Equal(t, "8", f.lastEventID)
+	assert.Equal(t, 1500*time.Millisecond, f.retry)
+
+	v, ok := CachedVerdict("test", "90")
+	assert.True(t, ok)
+	assert.Equal(t, CertStatusRevoked, v.Status)
+}
+
+func TestRevocationFeed_Subscription(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"entries": []}`), 0o644))
+	assert.Nil(t, flag.Set("denylistPath", path))
+	assert.Nil(t, denylist.Init())
+	t.Cleanup(func() { _ = flag.Set("denylistPath", "") })
+
+	revoked := func(bundle, serial string) func() bool {
+		return func() bool {
+			v, _ := CachedVerdict(bundle, serial)
+			return v.Status == CertStatusRevoked
+		}
+	}
+
+	ca := newTestCA(t, "Test CA")
+	conn, client := connect(t, ca, ca.issue(t, clientTemplate("RF1", 80, time.Now().Add(time.Hour))))
+	awaitRequest(t, conn)
+
+	feed := revocationfeedtest.NewServer()
+	defer feed.Close()
+
+	f, err := newRevocationFeed(feed.URL, []*trustBundle{ca.bundle("test")})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			_ = f.subscribe(ctx)
+			time.Sleep(f.retry)
+		}
+	}()
+
+	feed.Publish(RevocationEventType, RevocationEvent{Bundle: "other", Serial: "80"})
+	feed.Publish(RevocationEventType, RevocationEvent{Bundle: "test", Serial: "80", Reason: "keyCompromise"})
+
+	assert.Eventually(t, revoked("test", "80"), 5*time.Second, 10*time.Millisecond)
+
+	// the revocation is limited to its bundle, the same serial of another CA is not denied
+	_, denied := denylist.Lookup(identity.Identity{Serial: "80"})
+	assert.False(t, denied)
+	_, ok := CachedVerdict("other", "80")
+	assert.False(t, ok)
+
+	v, _ := CachedVerdict("test", "80")
+	assert.Equal(t, CertStatusRevoked, v.Status)
+	assert.Equal(t, "keyCompromise", v.Reason)
+	conn.reqMu.Lock()
+	assert.Equal(t, DisconnectRevoked, conn.closeReason)
+	conn.reqMu.Unlock()
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// a reconnect resumes after the last delivered event
+	feed.Disconnect()
+	feed.Publish(RevocationEventType, RevocationEvent{Bundle: "test", Serial: "81"})
+	assert.Eventually(t, revoked("test", "81"), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(feed.LastEventIDs()) > 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, "", feed.LastEventIDs()[1])
+}
+
+func TestApplyRevocation_DeniesNewHandshakes(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	t.Cleanup(func() { verdicts.Delete("test/82") })
+
+	applyRevocation(RevocationEvent{Bundle: "test", Serial: "82", Reason: "keyCompromise"})
+
+	// the bundle has no revocation backend, the pushed verdict is honored anyway
+	assert.NotNil(t, handshake(t, ca, []tls.Certificate{ca.issue(t, clientTemplate("RF2", 82, time.Now().Add(time.Hour)))}))
+	assert.Equal(t, FailureRevoked, HandshakeFailures(nil)[0].Reason)
+	assert.Nil(t, handshake(t, ca, []tls.Certificate{ca.issue(t, clientTemplate("RF2", 83, time.Now().Add(time.Hour)))}))
+}
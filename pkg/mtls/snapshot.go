@@ -0,0 +1,120 @@
+package mtls
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/revsnapshot"
+	"github.com/mygaru/id-check/pkg/signing"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	mtlsRevocationSnapshotPath = flag.String("mtlsRevocationSnapshotPath", "", "Path to a signed revocation snapshot checked instead of mtlsReputationUrl by the bundle built from mtlsCaCertPath/mtlsCaCertURL, "+
+		"for deployments without access to the reputation service; empty uses mtlsReputationUrl")
+	mtlsRevocationSnapshotKeyPath        = flag.String("mtlsRevocationSnapshotKeyPath", "", "Path to the PEM public key or certificate the revocation snapshot must be signed with")
+	mtlsRevocationSnapshotReloadInterval = flag.Duration("mtlsRevocationSnapshotReloadInterval", 10*time.Second, "How often mtlsRevocationSnapshotPath is checked for a new snapshot")
+)
+
+// snapshotBackend checks certificates against a signed revocation snapshot, reloaded when the file changes.
+// Handshakes are refused once the snapshot is out of its validity window.
+type snapshotBackend struct {
+	bundle string
+	path   string
+	pub    crypto.PublicKey
+
+	mu       sync.RWMutex
+	snapshot *revsnapshot.Snapshot
+	revoked  map[string]revsnapshot.Entry
+}
+
+func newSnapshotBackend(bundle, path, keyPath string, interval time.Duration) (*snapshotBackend, error) {
+	if path == "" || keyPath == "" {
+		return nil, fmt.Errorf("snapshot revocation needs a path and a publicKeyPath")
+	}
+	pub, err := signing.LoadPublicKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshotBackend{bundle: bundle, path: path, pub: pub}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	filewatch.Watch(path, interval, s.reload, func(err error) {
+		reputationLog.Error("Failed to reload revocation snapshot, keeping the previous one", "bundle", bundle, "path", path, "err", err)
+	})
+
+	return s, nil
+}
+
+// reload loads the snapshot file. A snapshot older than the current one is rejected.
+func (s *snapshotBackend) reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read revocation snapshot %s: %w", s.path, err)
+	}
+	snap, err := revsnapshot.Parse(data, s.pub)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	if s.snapshot != nil && snap.Sequence < s.snapshot.Sequence {
+		cur := s.snapshot.Sequence
+		s.mu.Unlock()
+		return fmt.Errorf("revocation snapshot %s has sequence %d, older than the loaded %d", s.path, snap.Sequence, cur)
+	}
+	revoked := snap.Index()
+	s.snapshot, s.revoked = snap, revoked
+	s.mu.Unlock()
+
+	reputationLog.Info("Loaded revocation snapshot", "bundle", s.bundle, "path", s.path, "issuer", snap.Issuer, "sequence", snap.Sequence,
+		"revoked", len(revoked), "notAfter", snap.NotAfter)
+	if err := snap.Check(time.Now()); err != nil {
+		reputationLog.Error("Revocation snapshot is out of its validity window, handshakes are refused", "bundle", s.bundle, "path", s.path, "err", err)
+	}
+
+	revokedUpdated(s.bundle, func(serial string) bool {
+		_, ok := revoked[serial]
+		return ok
+	})
+
+	return nil
+}
+
+func (s *snapshotBackend) status(cert *x509.Certificate) (string, string, error) {
+	return s.lookup(cert.SerialNumber.String(), time.Now())
+}
+
+func (s *snapshotBackend) lookup(serial string, now time.Time) (string, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.snapshot.Check(now); err != nil {
+		return "", "", fmt.Errorf("%w (bundle %s, sequence %d)", err, s.bundle, s.snapshot.Sequence)
+	}
+
+	if e, ok := s.revoked[serial]; ok {
+		reason := e.Reason
+		if reason == "" {
+			reason = "listed in revocation snapshot"
+		}
+		return CertStatusRevoked, reason, nil
+	}
+	return CertStatusGood, "", nil
+}
+
+// revocationFailure classifies an error of a revocation backend.
+func revocationFailure(err error) string {
+	if errors.Is(err, revsnapshot.ErrExpired) {
+		return FailureRevocationExpired
+	}
+	return FailureReputationError
+}
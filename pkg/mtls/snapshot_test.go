@@ -0,0 +1,68 @@
+package mtls
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"github.com/mygaru/id-check/pkg/revsnapshot"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSnapshot(t *testing.T, path string, priv ed25519.PrivateKey, sequence uint64, notAfter time.Time, serials ...string) {
+	t.Helper()
+
+	s := revsnapshot.Snapshot{Issuer: "test", Sequence: sequence, IssuedAt: time.Now(), NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter}
+	for _, serial := range serials {
+		s.Revoked = append(s.Revoked, revsnapshot.Entry{Serial: serial})
+	}
+	data, err := revsnapshot.Build(s, priv)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, data, 0o644))
+}
+
+func TestSnapshotBackend(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path, priv, 2, time.Now().Add(time.Hour), "41")
+
+	ca := newTestCA(t, "Test CA")
+	s := &snapshotBackend{bundle: "test", path: path, pub: pub}
+	assert.Nil(t, s.reload())
+	b := ca.bundle("test")
+	b.revocation = s
+
+	revoked := ca.issue(t, clientTemplate("SN1", 41, time.Now().Add(time.Hour)))
+	_, reason, err := verifyClientCertificate([]*x509.Certificate{revoked.Leaf}, []*trustBundle{b}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureRevoked, reason)
+
+	good := ca.issue(t, clientTemplate("SN2", 42, time.Now().Add(time.Hour)))
+	domain, _, err := verifyClientCertificate([]*x509.Certificate{good.Leaf}, []*trustBundle{b}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", domain)
+
+	// an older snapshot is not loaded over a newer one
+	writeSnapshot(t, path, priv, 1, time.Now().Add(time.Hour), "42")
+	assert.NotNil(t, s.reload())
+	status, _, _ := s.lookup("42", time.Now())
+	assert.Equal(t, CertStatusGood, status)
+
+	// handshakes are refused once the snapshot expires
+	_, _, err = s.lookup("42", time.Now().Add(2*time.Hour))
+	assert.NotNil(t, err)
+	writeSnapshot(t, path, priv, 3, time.Now().Add(-time.Minute))
+	assert.Nil(t, s.reload())
+	_, reason, err = verifyClientCertificate([]*x509.Certificate{good.Leaf}, []*trustBundle{b}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureRevocationExpired, reason)
+
+	// a snapshot signed with another key is rejected
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	writeSnapshot(t, path, other, 4, time.Now().Add(time.Hour))
+	assert.NotNil(t, s.reload())
+}
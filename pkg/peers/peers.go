@@ -0,0 +1,383 @@
+// Package peers shares reputation verdicts and denylist changes between id-check instances
+// over mutually authenticated TLS. Without reachable peers every instance keeps working on its local caches.
+package peers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/mygaru/id-check/pkg/problem"
+	"github.com/valyala/fasthttp"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentPeers)
+
+var (
+	peerListenAddr = flag.String("peerListenAddr", "", "Address of the mTLS listener sharing reputation verdicts and denylist changes with other id-check instances; "+
+		"empty keeps the caches local")
+	peerAddrs        = flag.String("peerAddrs", "", "Comma-separated host:port of the peerListenAddr of the other instances")
+	peerServerName   = flag.String("peerServerName", "", "Name verified in the server certificates of peers; empty uses the host of each peer address")
+	peerAllowedSPKIs = flag.String("peerAllowedSPKIs", "", "Comma-separated hex SHA-256 SPKI fingerprints of the client certificates accepted from peers; "+
+		"empty accepts the key of mtlsClientCertPath")
+	peerSyncInterval = flag.Duration("peerSyncInterval", time.Second, "How often pending updates are sent to peers")
+	peerTimeout      = flag.Duration("peerTimeout", 5*time.Second, "Timeout of requests to peers")
+	peerMaxPending   = flag.Int("peerMaxPending", 10000, "How many updates are queued for an unreachable peer; beyond that it is sent the full state once it is back")
+)
+
+var (
+	syncs = metrics.NewCounterVec("idcheck_peer_syncs_total",
+		"Updates sent to peers by result", "peer", "result")
+	received = metrics.NewCounterVec("idcheck_peer_updates_received_total",
+		"Verdicts and denylist changes received from peers by kind and result", "kind", "result")
+)
+
+const (
+	pathUpdates = "/peer/v1/updates"
+	pathState   = "/peer/v1/state"
+)
+
+// Verdict is a reputation verdict of a certificate of a trust bundle.
+type Verdict struct {
+	Bundle    string    `json:"bundle"`
+	Serial    string    `json:"serial"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// DenylistChange is a denylist entry added or removed on an instance.
+type DenylistChange struct {
+	Entry   denylist.Entry `json:"entry"`
+	Removed bool           `json:"removed,omitempty"`
+}
+
+// Update is the body of POST /peer/v1/updates and of the response to GET /peer/v1/state.
+// DenylistComplete is set when Denylist is the full denylist of the sender, which then replaces the one of the receiver,
+// so that entries removed while the instances were out of sync are lifted too.
+type Update struct {
+	Verdicts         []Verdict        `json:"verdicts,omitempty"`
+	Denylist         []DenylistChange `json:"denylist,omitempty"`
+	DenylistComplete bool             `json:"denylistComplete,omitempty"`
+}
+
+func (u *Update) len() int {
+	return len(u.Verdicts) + len(u.Denylist)
+}
+
+type peer struct {
+	addr   string
+	client *fasthttp.HostClient
+
+	mu      sync.Mutex
+	pending Update
+	// resync is set when pending overflowed, the peer is then sent the full state
+	resync bool
+	up     bool
+}
+
+var (
+	peers   []*peer
+	allowed = map[string]bool{}
+)
+
+// Enabled reports whether verdicts are shared with peers.
+func Enabled() bool {
+	return *peerListenAddr != ""
+}
+
+// Init starts the peer listener, takes over the state of the first reachable peer and starts sending local changes.
+// It must be called after denylist.Init and before the mTLS server starts. It is a no-op when sharing is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	// the CA also issues partner certificates, so peers are pinned by key rather than by name
+	spkis := splitList(*peerAllowedSPKIs)
+	if len(spkis) == 0 {
+		cert, err := tls.LoadX509KeyPair(mtls.GetClientCertPath(), mtls.GetClientCertKeyPath())
+		if err != nil {
+			return fmt.Errorf("peerAllowedSPKIs is empty and the client certificate cannot be read: %w", err)
+		}
+		spkis = []string{identity.SPKIFingerprint(cert.Leaf)}
+	}
+	for _, fp := range spkis {
+		allowed[strings.ToLower(fp)] = true
+	}
+
+	for _, addr := range splitList(*peerAddrs) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid peer address %q: %w", addr, err)
+		}
+		serverName := *peerServerName
+		if serverName == "" {
+			serverName = host
+		}
+		cfg, err := mtls.GetMTLSConfig(serverName)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, &peer{addr: addr, client: &fasthttp.HostClient{Addr: addr, IsTLS: true, TLSConfig: cfg}})
+	}
+
+	serverCfg, err := mtls.GetMTLSServerConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", *peerListenAddr, serverCfg)
+	if err != nil {
+		return fmt.Errorf("failed to listen on peerListenAddr: %w", err)
+	}
+	go func() {
+		s := &fasthttp.Server{Handler: Handler, ReadTimeout: *peerTimeout, WriteTimeout: *peerTimeout}
+		if err := s.Serve(ln); err != nil {
+			log.Error("Peer listener stopped", "err", err)
+		}
+	}()
+
+	metrics.NewGaugeFunc("idcheck_peers_up", "Peers whose last sync succeeded", func() float64 {
+		n := 0
+		for _, p := range peers {
+			p.mu.Lock()
+			if p.up {
+				n++
+			}
+			p.mu.Unlock()
+		}
+		return float64(n)
+	})
+
+	// verdicts are not reused without a cache TTL, so peers would only store them
+	if mtls.ReputationCacheEnabled() {
+		mtls.OnVerdict(func(bundle, serial string, v mtls.Verdict) {
+			enqueue(Update{Verdicts: []Verdict{{Bundle: bundle, Serial: serial, Status: v.Status, Reason: v.Reason, CheckedAt: v.CheckedAt}}})
+		})
+	}
+	denylist.OnLocalChange(func(e denylist.Entry, removed bool) {
+		enqueue(Update{Denylist: []DenylistChange{{Entry: e, Removed: removed}}})
+	})
+
+	pullState()
+
+	go func() {
+		for range time.Tick(*peerSyncInterval) {
+			for _, p := range peers {
+				p.sync()
+			}
+		}
+	}()
+
+	log.Info("Sharing caches with peers", "listen", *peerListenAddr, "peers", len(peers))
+	return nil
+}
+
+// pullState takes over the verdicts and denylist of the first reachable peer, so a restarted instance starts warm.
+func pullState() {
+	for _, p := range peers {
+		var u Update
+		if err := p.do(fasthttp.MethodGet, pathState, nil, &u); err != nil {
+			log.Warn("Failed to pull state from peer", "peer", p.addr, "err", err)
+			continue
+		}
+		apply(u)
+		log.Info("Pulled state from peer", "peer", p.addr, "verdicts", len(u.Verdicts), "denylist", len(u.Denylist))
+		return
+	}
+	if len(peers) > 0 {
+		log.Warn("No peer reachable, starting with the local caches only")
+	}
+}
+
+func enqueue(u Update) {
+	for _, p := range peers {
+		p.mu.Lock()
+		if !p.resync {
+			p.pending.Verdicts = append(p.pending.Verdicts, u.Verdicts...)
+			p.pending.Denylist = append(p.pending.Denylist, u.Denylist...)
+			if p.pending.len() > *peerMaxPending {
+				p.pending, p.resync = Update{}, true
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// sync sends the pending updates, or the full state after an overflow, to p. Failed updates are kept for the next attempt.
+func (p *peer) sync() {
+	p.mu.Lock()
+	u, resync := p.pending, p.resync
+	// updates enqueued from now on are sent next time, also after a full state
+	p.pending, p.resync = Update{}, false
+	p.mu.Unlock()
+
+	if resync {
+		u = state()
+	}
+	// an empty full denylist still lifts the entries of the peer
+	if u.len() == 0 && !u.DenylistComplete {
+		return
+	}
+
+	err := p.do(fasthttp.MethodPost, pathUpdates, u, nil)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		syncs.With(p.addr, "error").Inc()
+		if p.up {
+			log.Warn("Peer unreachable, queueing updates", "peer", p.addr, "err", err)
+		}
+		p.up = false
+		if resync {
+			p.pending, p.resync = Update{}, true
+			return
+		}
+		p.pending.Verdicts = append(u.Verdicts, p.pending.Verdicts...)
+		p.pending.Denylist = append(u.Denylist, p.pending.Denylist...)
+		if p.pending.len() > *peerMaxPending {
+			p.pending, p.resync = Update{}, true
+		}
+		return
+	}
+
+	syncs.With(p.addr, "ok").Inc()
+	if !p.up {
+		log.Info("Peer reachable", "peer", p.addr)
+	}
+	p.up = true
+}
+
+func (p *peer) do(method, path string, in, out any) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+
+	req.SetRequestURI("https://" + p.addr + path)
+	req.Header.SetMethod(method)
+	if in != nil {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req.Header.SetContentType("application/json")
+		req.SetBody(body)
+	}
+
+	if err := p.client.DoTimeout(req, resp, *peerTimeout); err != nil {
+		return err
+	}
+	if sc := resp.StatusCode(); sc != fasthttp.StatusOK && sc != fasthttp.StatusNoContent {
+		return fmt.Errorf("unexpected status %d: %s", sc, resp.Body())
+	}
+	if out != nil {
+		return json.Unmarshal(resp.Body(), out)
+	}
+	return nil
+}
+
+// Handler serves the peer API to authenticated peers.
+func Handler(ctx *fasthttp.RequestCtx) {
+	cs := ctx.TLSConnectionState()
+	if cs == nil || len(cs.PeerCertificates) == 0 || !allowed[identity.SPKIFingerprint(cs.PeerCertificates[0])] {
+		problem.Write(ctx, fasthttp.StatusForbidden, "Forbidden", "client certificate is not an id-check peer")
+		return
+	}
+
+	switch {
+	case string(ctx.Path()) == pathUpdates && ctx.IsPost():
+		var u Update
+		if err := json.Unmarshal(ctx.PostBody(), &u); err != nil {
+			problem.Write(ctx, fasthttp.StatusBadRequest, "Bad Request", err.Error())
+			return
+		}
+		apply(u)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+
+	case string(ctx.Path()) == pathState && ctx.IsGet():
+		admin.WriteJSON(ctx, state())
+
+	default:
+		problem.Write(ctx, fasthttp.StatusNotFound, "Not Found", "")
+	}
+}
+
+// state returns the fresh verdicts and the denylist of this instance.
+func state() Update {
+	var u Update
+	mtls.FreshVerdicts(func(bundle, serial string, v mtls.Verdict) {
+		u.Verdicts = append(u.Verdicts, Verdict{Bundle: bundle, Serial: serial, Status: v.Status, Reason: v.Reason, CheckedAt: v.CheckedAt})
+	})
+	if denylist.Enabled() {
+		for _, e := range denylist.Entries() {
+			u.Denylist = append(u.Denylist, DenylistChange{Entry: e})
+		}
+		u.DenylistComplete = true
+	}
+	return u
+}
+
+// apply merges the updates of a peer into the local caches without sending them on.
+func apply(u Update) {
+	for _, v := range u.Verdicts {
+		if mtls.MergeVerdict(v.Bundle, v.Serial, mtls.Verdict{Status: v.Status, Reason: v.Reason, CheckedAt: v.CheckedAt}) {
+			received.With("verdict", "applied").Inc()
+		} else {
+			received.With("verdict", "ignored").Inc()
+		}
+	}
+
+	if u.DenylistComplete && denylist.Enabled() {
+		var list []denylist.Entry
+		for _, c := range u.Denylist {
+			if !c.Removed {
+				list = append(list, c.Entry)
+			}
+		}
+		if err := denylist.ReplaceRemote(list); err != nil {
+			received.With("denylist", "error").Add(uint64(len(u.Denylist)))
+			log.Error("Failed to replace the denylist with the one of a peer", "err", err)
+			return
+		}
+		received.With("denylist", "applied").Add(uint64(len(u.Denylist)))
+		return
+	}
+
+	for _, c := range u.Denylist {
+		if !denylist.Enabled() {
+			received.With("denylist", "ignored").Inc()
+			continue
+		}
+		if err := denylist.ApplyRemote(c.Entry, c.Removed); err != nil {
+			received.With("denylist", "error").Inc()
+			log.Error("Failed to apply denylist change of a peer", "removed", c.Removed, "err", err)
+			continue
+		}
+		received.With("denylist", "applied").Inc()
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
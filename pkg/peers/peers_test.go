@@ -0,0 +1,192 @@
+package peers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"github.com/mygaru/id-check/pkg/denylist"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/mtls"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setFlags(t *testing.T, kv map[string]string) {
+	t.Helper()
+	for k, v := range kv {
+		prev := flag.Lookup(k).Value.String()
+		require.NoError(t, flag.Set(k, v))
+		t.Cleanup(func() { _ = flag.Set(k, prev) })
+	}
+}
+
+func useDenylist(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"entries": []}`), 0o644))
+	setFlags(t, map[string]string{"denylistPath": path})
+	require.NoError(t, denylist.Init())
+}
+
+// issue returns a certificate for cn signed by parent, self-signed when parent is nil.
+func issue(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerCert := any(key), tmpl
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		signer, signerCert = parent.PrivateKey, parent.Leaf
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// servePeer serves Handler on an mTLS listener trusting ca and returns a peer connecting with client.
+func servePeer(t *testing.T, ca, client tls.Certificate) *peer {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{issue(t, "localhost", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	s := &fasthttp.Server{Handler: Handler}
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	addr := ln.Addr().String()
+	return &peer{addr: addr, client: &fasthttp.HostClient{Addr: addr, IsTLS: true, TLSConfig: &tls.Config{
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client},
+	}}}
+}
+
+func TestSync(t *testing.T) {
+	setFlags(t, map[string]string{"mtlsReputationCacheTTL": "1h"})
+	useDenylist(t)
+	ca := issue(t, "Test CA", nil)
+	client := issue(t, "id-check", &ca)
+	allowed = map[string]bool{identity.SPKIFingerprint(client.Leaf): true}
+	p := servePeer(t, ca, client)
+	checkedAt := time.Now().Truncate(time.Second)
+	p.pending = Update{
+		Verdicts: []Verdict{{Bundle: "mygaru", Serial: "5001", Status: mtls.CertStatusRevoked, Reason: "keyCompromise", CheckedAt: checkedAt}},
+		Denylist: []DenylistChange{{Entry: denylist.Entry{Serial: "5002", Reason: "leaked"}}},
+	}
+	p.sync()
+	require.True(t, p.up)
+	require.Equal(t, 0, p.pending.len())
+
+	v, ok := mtls.CachedVerdict("mygaru", "5001")
+	require.True(t, ok)
+	require.Equal(t, mtls.CertStatusRevoked, v.Status)
+	e, ok := denylist.Lookup(identity.Identity{Serial: "5002"})
+	require.True(t, ok)
+	require.Equal(t, "leaked", e.Reason)
+
+	// an older verdict does not replace a newer one
+	apply(Update{Verdicts: []Verdict{{Bundle: "mygaru", Serial: "5001", Status: mtls.CertStatusGood, CheckedAt: checkedAt.Add(-time.Minute)}}})
+	v, _ = mtls.CachedVerdict("mygaru", "5001")
+	require.Equal(t, mtls.CertStatusRevoked, v.Status)
+
+	var pulled Update
+	require.NoError(t, p.do(fasthttp.MethodGet, pathState, nil, &pulled))
+	require.Contains(t, pulled.Denylist, DenylistChange{Entry: e})
+
+	// other keys are refused, also under the CN of a peer
+	stranger := servePeer(t, ca, issue(t, "id-check", &ca))
+	require.Error(t, stranger.do(fasthttp.MethodGet, pathState, nil, &pulled))
+}
+
+func TestSync_UnreachablePeer(t *testing.T) {
+	setFlags(t, map[string]string{"peerMaxPending": "2", "peerTimeout": "100ms"})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	p := &peer{addr: addr, client: &fasthttp.HostClient{Addr: addr, IsTLS: true}}
+	peers = []*peer{p}
+	t.Cleanup(func() { peers = nil })
+
+	enqueue(Update{Verdicts: []Verdict{{Bundle: "mygaru", Serial: "1"}}})
+	p.sync()
+	require.False(t, p.up)
+	require.Equal(t, 1, p.pending.len())
+
+	// beyond peerMaxPending the peer gets the full state instead
+	enqueue(Update{Verdicts: []Verdict{{Bundle: "mygaru", Serial: "2"}, {Bundle: "mygaru", Serial: "3"}}})
+	require.True(t, p.resync)
+	require.Equal(t, 0, p.pending.len())
+}
+
+func TestApply_NotSentBack(t *testing.T) {
+	useDenylist(t)
+
+	var local []denylist.Entry
+	denylist.OnLocalChange(func(e denylist.Entry, removed bool) { local = append(local, e) })
+
+	apply(Update{Denylist: []DenylistChange{{Entry: denylist.Entry{SPKI: "abcd"}}}})
+	require.Empty(t, local)
+	_, ok := denylist.Lookup(identity.Identity{Fingerprint: "abcd"})
+	require.True(t, ok)
+
+	require.NoError(t, denylist.Add(denylist.Entry{CommonName: "partner-b"}))
+	require.Len(t, local, 1)
+}
+
+func TestApply_FullStateReplacesDenylist(t *testing.T) {
+	useDenylist(t)
+
+	var local []denylist.Entry
+	denylist.OnLocalChange(func(e denylist.Entry, removed bool) { local = append(local, e) })
+
+	require.NoError(t, denylist.ApplyRemote(denylist.Entry{Serial: "1"}, false))
+	require.NoError(t, denylist.ApplyRemote(denylist.Entry{Serial: "2"}, false))
+
+	// the peer removed serial 2 while the instances were out of sync
+	peerState := Update{Denylist: []DenylistChange{{Entry: denylist.Entry{Serial: "1"}}, {Entry: denylist.Entry{CommonName: "partner-c"}}}, DenylistComplete: true}
+	apply(peerState)
+
+	_, ok := denylist.Lookup(identity.Identity{Serial: "2"})
+	require.False(t, ok)
+	_, ok = denylist.Lookup(identity.Identity{Serial: "1"})
+	require.True(t, ok)
+	_, ok = denylist.Lookup(identity.Identity{CommonName: "partner-c"})
+	require.True(t, ok)
+	require.Empty(t, local)
+
+	// the full state of this instance is marked as such, also when the denylist is empty
+	apply(Update{DenylistComplete: true})
+	require.Empty(t, denylist.Entries())
+	require.True(t, state().DenylistComplete)
+}
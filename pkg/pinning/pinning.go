@@ -0,0 +1,235 @@
+package pinning
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"github.com/mygaru/id-check/pkg/audit"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentPinning)
+
+var (
+	pinningStorePath      = flag.String("pinningStorePath", "", "Path to JSON file mapping identities to the SPKI SHA-256 fingerprints of their keys; empty disables key pinning")
+	pinningMode           = flag.String("pinningMode", ModeLearn, "learn pins the first key seen for unpinned identities and only reports mismatches; enforce rejects keys not pinned for pinned identities")
+	pinningReloadInterval = flag.Duration("pinningReloadInterval", 10*time.Second, "How often pinningStorePath is checked for changes")
+)
+
+const (
+	ModeLearn   = "learn"
+	ModeEnforce = "enforce"
+)
+
+// mismatchEventInterval limits audit events for the same identity and key.
+const mismatchEventInterval = time.Hour
+
+var checks = metrics.NewCounterVec("idcheck_pin_checks_total",
+	"Key pin checks by result: ok, unpinned, learned, mismatch_allowed or mismatch_rejected", "result")
+
+// Store is the content of pinningStorePath. Several pins per identity allow key rotation.
+// Pins apply to identities of any issuer, Domains to those issued within a trust bundle, and win over Pins.
+type Store struct {
+	Pins    map[string][]string            `json:"pins"`
+	Domains map[string]map[string][]string `json:"domains,omitempty"`
+}
+
+var (
+	mu             sync.Mutex
+	pins           map[string][]string // pinKey -> fingerprints
+	lastMismatches = map[string]time.Time{}
+)
+
+// pinKey returns the key of the pins of name within domain, empty for any issuer.
+func pinKey(domain, name string) string {
+	if domain == "" {
+		return name
+	}
+	return domain + "\x00" + name
+}
+
+// Enabled reports whether key pinning is configured.
+func Enabled() bool {
+	return *pinningStorePath != ""
+}
+
+// Init loads the pin store and reloads it when the file changes. It is a no-op when pinning is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if *pinningMode != ModeLearn && *pinningMode != ModeEnforce {
+		return fmt.Errorf("unsupported pinningMode %q, want %s or %s", *pinningMode, ModeLearn, ModeEnforce)
+	}
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	filewatch.Watch(*pinningStorePath, *pinningReloadInterval, reload, func(err error) {
+		log.Error("Failed to reload pin store, keeping the previous one", "err", err)
+	})
+
+	return nil
+}
+
+func reload() error {
+	loaded, err := load(*pinningStorePath)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	pins = loaded
+	mu.Unlock()
+
+	log.Info("Loaded pin store", "identities", len(loaded), "mode", *pinningMode)
+
+	return nil
+}
+
+func load(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && *pinningMode == ModeLearn {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pin store %s: %w", path, err)
+	}
+
+	s := &Store{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse pin store %s: %w", path, err)
+	}
+
+	out := make(map[string][]string, len(s.Pins))
+	add := func(key string, fps []string) {
+		for _, fp := range fps {
+			out[key] = append(out[key], strings.ToLower(strings.TrimSpace(fp)))
+		}
+	}
+	for name, fps := range s.Pins {
+		add(name, fps)
+	}
+	for domain, domainPins := range s.Domains {
+		if domain == "" {
+			return nil, fmt.Errorf("pin store %s has an empty domain", path)
+		}
+		for name, fps := range domainPins {
+			add(pinKey(domain, name), fps)
+		}
+	}
+
+	return out, nil
+}
+
+// persist writes the pins to pinningStorePath. The caller must hold mu.
+func persist() error {
+	s := Store{Pins: map[string][]string{}}
+	for key, fps := range pins {
+		domain, name, scoped := strings.Cut(key, "\x00")
+		if !scoped {
+			s.Pins[key] = fps
+			continue
+		}
+		if s.Domains == nil {
+			s.Domains = map[string]map[string][]string{}
+		}
+		if s.Domains[domain] == nil {
+			s.Domains[domain] = map[string][]string{}
+		}
+		s.Domains[domain][name] = fps
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(*pinningStorePath, data, 0o644)
+}
+
+// Check reports whether the key of id may be used. Identities without pins are always allowed; in learn mode
+// their key is pinned within their issuer domain. A key not pinned for a pinned identity is reported in the audit log
+// and rejected in enforce mode. Pins of the issuer domain of id win over pins for any issuer.
+func Check(ctx context.Context, id identity.Identity, clientIP string) bool {
+	if !Enabled() {
+		return true
+	}
+
+	name := id.Name()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	key := pinKey(id.IssuerDomain, name)
+	pinned, ok := pins[key]
+	if !ok {
+		pinned = pins[name]
+	}
+	if slices.Contains(pinned, id.Fingerprint) {
+		checks.With("ok").Inc()
+		return true
+	}
+
+	if len(pinned) == 0 {
+		if *pinningMode == ModeEnforce {
+			checks.With("unpinned").Inc()
+			return true
+		}
+
+		pins[key] = []string{id.Fingerprint}
+		if err := persist(); err != nil {
+			log.ErrorContext(ctx, "Failed to persist pin store", "err", err)
+		}
+
+		checks.With("learned").Inc()
+		log.InfoContext(ctx, "Pinned key of identity", "identity", name, "issuerDomain", id.IssuerDomain, "spki", id.Fingerprint)
+		auditPin(audit.TypePinLearned, id, clientIP, "")
+
+		return true
+	}
+
+	enforce := *pinningMode == ModeEnforce
+	action := "allowed"
+	if enforce {
+		action = "rejected"
+	}
+	checks.With("mismatch_" + action).Inc()
+
+	mismatch := key + "\x00" + id.Fingerprint
+	if time.Since(lastMismatches[mismatch]) >= mismatchEventInterval {
+		lastMismatches[mismatch] = time.Now()
+
+		sorted := slices.Clone(pinned)
+		sort.Strings(sorted)
+
+		log.WarnContext(ctx, "Key does not match the pins of identity", "identity", name, "issuerDomain", id.IssuerDomain, "spki", id.Fingerprint, "serial", id.Serial, "action", action)
+		auditPin(audit.TypePinMismatch, id, clientIP, fmt.Sprintf("%s; pinned: %s", action, strings.Join(sorted, ",")))
+	}
+
+	return !enforce
+}
+
+func auditPin(typ string, id identity.Identity, clientIP, detail string) {
+	audit.Log(audit.Record{
+		Type:         typ,
+		CommonName:   id.CommonName,
+		IssuerDomain: id.IssuerDomain,
+		Serial:       id.Serial,
+		SPKI:         id.Fingerprint,
+		ClientIP:     clientIP,
+		Detail:       detail,
+	})
+}
@@ -0,0 +1,93 @@
+package pinning
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T, mode, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pins.json")
+	if content != "" {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	prevPath, prevMode, prevInterval := *pinningStorePath, *pinningMode, *pinningReloadInterval
+	*pinningStorePath, *pinningMode, *pinningReloadInterval = path, mode, time.Hour
+	t.Cleanup(func() {
+		*pinningStorePath, *pinningMode, *pinningReloadInterval = prevPath, prevMode, prevInterval
+		lastMismatches = map[string]time.Time{}
+	})
+
+	require.NoError(t, Init())
+	return path
+}
+
+func TestLearn(t *testing.T) {
+	path := setup(t, ModeLearn, "")
+
+	first := identity.Identity{CommonName: "partner-a", Fingerprint: "aa"}
+	require.True(t, Check(context.Background(), first, "192.0.2.1"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var s Store
+	require.NoError(t, json.Unmarshal(data, &s))
+	require.Equal(t, []string{"aa"}, s.Pins["partner-a"])
+
+	// a different key is reported but allowed while learning
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Fingerprint: "bb"}, "192.0.2.1"))
+	require.Equal(t, []string{"aa"}, pins["partner-a"])
+	require.Contains(t, lastMismatches, "partner-a\x00bb")
+}
+
+func TestEnforce(t *testing.T) {
+	setup(t, ModeEnforce, `{"pins":{"partner-a":["AA","cc"]}}`)
+
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Fingerprint: "aa"}, ""))
+	// overlapping pins during key rotation
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Fingerprint: "cc"}, ""))
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", Fingerprint: "bb"}, ""))
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", Fingerprint: "bb"}, ""))
+	require.NotContains(t, pins, "partner-b")
+}
+
+func TestDomains(t *testing.T) {
+	path := setup(t, ModeLearn, `{"pins":{"partner-a":["aa"]},"domains":{"partner-ca":{"partner-b":["bb"]}}}`)
+
+	// pins of the issuer domain win over pins for any issuer
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", IssuerDomain: "partner-ca", Fingerprint: "bb"}, ""))
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-a", IssuerDomain: "partner-ca", Fingerprint: "aa"}, ""))
+
+	// the same CN of another issuer is learned on its own
+	require.True(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", IssuerDomain: "mygaru", Fingerprint: "cc"}, ""))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var s Store
+	require.NoError(t, json.Unmarshal(data, &s))
+	require.Equal(t, []string{"cc"}, s.Domains["mygaru"]["partner-b"])
+	require.Equal(t, []string{"bb"}, s.Domains["partner-ca"]["partner-b"])
+	require.Equal(t, []string{"aa"}, s.Pins["partner-a"])
+
+	*pinningMode = ModeEnforce
+	require.False(t, Check(context.Background(), identity.Identity{CommonName: "partner-b", IssuerDomain: "partner-ca", Fingerprint: "cc"}, ""))
+}
+
+func TestInvalidMode(t *testing.T) {
+	prev := *pinningStorePath
+	*pinningStorePath = filepath.Join(t.TempDir(), "pins.json")
+	t.Cleanup(func() { *pinningStorePath = prev })
+
+	prevMode := *pinningMode
+	*pinningMode = "audit"
+	t.Cleanup(func() { *pinningMode = prevMode })
+
+	require.Error(t, Init())
+}
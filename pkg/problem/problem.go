@@ -0,0 +1,36 @@
+package problem
+
+import (
+	"encoding/json"
+	"github.com/mygaru/id-check/pkg/requestid"
+	"github.com/valyala/fasthttp"
+)
+
+const ContentType = "application/problem+json"
+
+// Details is an RFC 9457 problem details body.
+type Details struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Write responds with status and a problem+json body carrying the request ID of ctx.
+func Write(ctx *fasthttp.RequestCtx, status int, title, detail string) {
+	body, _ := json.Marshal(Details{
+		Type:      "about:blank",
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  string(ctx.Path()),
+		RequestID: requestid.Get(ctx),
+	})
+
+	ctx.Response.ResetBody()
+	ctx.SetStatusCode(status)
+	ctx.SetContentType(ContentType)
+	ctx.SetBody(body)
+}
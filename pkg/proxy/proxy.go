@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/net/http/httpproxy"
 	"net"
@@ -12,6 +13,8 @@ import (
 	"time"
 )
 
+var log = logger.For(logger.ComponentProxy)
+
 type ProxyContext struct {
 	BaseURLScheme   string
 	ProxyURL        *url.URL
@@ -81,6 +84,7 @@ func ProxyDialerTimeout(pc *ProxyContext, timeout time.Duration) fasthttp.DialFu
 		}
 
 		proxyHost := pc.ProxyURL.Host
+		log.Debug("Dialing through proxy", "proxy", proxyHost, "addr", addr)
 
 		dialer := &net.Dialer{}
 
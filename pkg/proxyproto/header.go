@@ -0,0 +1,237 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLen is the longest v1 header including CRLF.
+const v1MaxLen = 107
+
+// TLV types defined by the PROXY protocol v2 specification.
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+)
+
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// TLV is a type-length-value field of a v2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version int
+	// Local is set for v2 LOCAL commands and v1 UNKNOWN, sent by the balancer for its own
+	// connections such as health checks; the connection addresses are kept as they are.
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV returns the value of the first TLV of type t.
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority is the host name the client connected to (SNI), if the balancer sent it.
+func (h *Header) Authority() string {
+	v, _ := h.TLV(TypeAuthority)
+	return string(v)
+}
+
+// UniqueID is the connection ID assigned by the balancer, if any.
+func (h *Header) UniqueID() []byte {
+	v, _ := h.TLV(TypeUniqueID)
+	return v
+}
+
+// ReadHeader reads a v1 or v2 header from r.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil && len(sig) < 6 {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is not terminated by CRLF within %d bytes", v1MaxLen)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Local: true}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+
+	src, err := tcpAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source: %w", err)
+	}
+	dst, err := tcpAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 destination: %w", err)
+	}
+
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func tcpAddr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+const (
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+	famUnix   = 0x3
+)
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := readFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", fixed[12]>>4)
+	}
+	cmd := fixed[12] & 0x0f
+	fam := fixed[13] >> 4
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := readFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+
+	var addrLen int
+	switch fam {
+	case famUnspec:
+	case famInet:
+		addrLen = 12
+	case famInet6:
+		addrLen = 36
+	case famUnix:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("unsupported v2 address family %d", fam)
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("v2 header too short for address family %d", fam)
+	}
+
+	switch cmd {
+	case cmdLocal:
+		h.Local = true
+	case cmdProxy:
+		switch fam {
+		case famInet:
+			h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		case famInet6:
+			h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		default:
+			// unix sockets and unspecified families carry no usable client address
+			h.Local = true
+		}
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", cmd)
+	}
+
+	tlvs, err := parseTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+
+	return h, nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var out []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("truncated v2 TLV")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("v2 TLV 0x%02x is longer than the header", b[0])
+		}
+		if b[0] != TypeNoop {
+			out = append(out, TLV{Type: b[0], Value: b[3 : 3+n]})
+		}
+		b = b[3+n:]
+	}
+	return out, nil
+}
+
+func readFull(r *bufio.Reader, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := r.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
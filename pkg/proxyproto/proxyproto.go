@@ -0,0 +1,97 @@
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener accepts connections prefixed with a PROXY protocol header from trusted sources.
+// Connections from other sources are returned as they are.
+type Listener struct {
+	net.Listener
+	Trusted cidr.List
+	// Timeout bounds reading the header; zero means no limit.
+	Timeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.Trusted.ContainsAddr(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	return &Conn{Conn: c, timeout: l.Timeout}, nil
+}
+
+// Conn reads the PROXY protocol header lazily, on the first Read or address lookup,
+// so Accept never blocks on a slow client. RemoteAddr and LocalAddr report the
+// addresses from the header.
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	r      *bufio.Reader
+	header *Header
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+
+		c.r = bufio.NewReader(c.Conn)
+		c.header, c.err = ReadHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("failed to read PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+}
+
+// Header returns the PROXY protocol header of the connection.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	// the reader may hold bytes past the header
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && !c.header.Local {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && !c.header.Local {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,130 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/mygaru/id-check/pkg/cidr"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte, tlvs ...TLV) []byte {
+	var body []byte
+	body = append(body, addrs...)
+	for _, t := range tlvs {
+		body = append(body, t.Type, byte(len(t.Value)>>8), byte(len(t.Value)))
+		body = append(body, t.Value...)
+	}
+
+	out := append([]byte{}, v2Signature...)
+	out = append(out, 0x20|cmd, fam<<4|0x1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)))
+	return append(out, body...)
+}
+
+func TestReadV1(t *testing.T) {
+	h, err := ReadHeader(bufio.NewReader(bytes.NewBufferString("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nGET /")))
+	require.NoError(t, err)
+	require.Equal(t, 1, h.Version)
+	require.Equal(t, "203.0.113.7:51234", h.Source.String())
+	require.Equal(t, "10.0.0.1:443", h.Destination.String())
+
+	h, err = ReadHeader(bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n")))
+	require.NoError(t, err)
+	require.True(t, h.Local)
+
+	_, err = ReadHeader(bufio.NewReader(bytes.NewBufferString("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n")))
+	require.Error(t, err)
+
+	_, err = ReadHeader(bufio.NewReader(bytes.NewBufferString("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00")))
+	require.ErrorIs(t, err, ErrNoHeader)
+}
+
+func TestReadV2(t *testing.T) {
+	addrs := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x01, 0xbb}
+	raw := v2Header(cmdProxy, famInet, addrs,
+		TLV{Type: TypeAuthority, Value: []byte("api.example.com")},
+		TLV{Type: TypeNoop, Value: []byte{0, 0}},
+		TLV{Type: TypeUniqueID, Value: []byte{1, 2, 3}},
+	)
+
+	h, err := ReadHeader(bufio.NewReader(bytes.NewReader(append(raw, "rest"...))))
+	require.NoError(t, err)
+	require.Equal(t, 2, h.Version)
+	require.Equal(t, "203.0.113.7:51234", h.Source.String())
+	require.Equal(t, "10.0.0.1:443", h.Destination.String())
+	require.Equal(t, "api.example.com", h.Authority())
+	require.Equal(t, []byte{1, 2, 3}, h.UniqueID())
+	require.Len(t, h.TLVs, 2)
+
+	h, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(cmdLocal, famUnspec, nil))))
+	require.NoError(t, err)
+	require.True(t, h.Local)
+
+	truncated := v2Header(cmdProxy, famInet, addrs, TLV{Type: TypeAuthority, Value: []byte("x")})
+	truncated[15]-- // the TLV no longer fits
+	_, err = ReadHeader(bufio.NewReader(bytes.NewReader(truncated)))
+	require.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	trusted, err := cidr.Parse("127.0.0.0/8")
+	require.NoError(t, err)
+	pl := &Listener{Listener: ln, Trusted: trusted, Timeout: time.Second}
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 443\r\nhello"))
+	}()
+
+	c, err := pl.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Equal(t, "[2001:db8::7]:40000", c.RemoteAddr().String())
+	require.Equal(t, "[2001:db8::1]:443", c.LocalAddr().String())
+
+	data, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+}
+
+func TestListenerUntrustedSource(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	trusted, err := cidr.Parse("10.0.0.0/8")
+	require.NoError(t, err)
+	pl := &Listener{Listener: ln, Trusted: trusted}
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("PROXY TCP4 1.2.3.4 10.0.0.1 40000 443\r\n"))
+	}()
+
+	c, err := pl.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the header is not interpreted and the spoofed address is ignored
+	_, isProxied := c.(*Conn)
+	require.False(t, isProxied)
+	require.Contains(t, c.RemoteAddr().String(), "127.0.0.1:")
+}
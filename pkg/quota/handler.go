@@ -0,0 +1,22 @@
+package quota
+
+import (
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/valyala/fasthttp"
+	"time"
+)
+
+// AdminHandler reports usage and remaining quota for every partner, or only for ?identity=.
+func AdminHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	if identity := string(ctx.QueryArgs().Peek("identity")); identity != "" {
+		admin.WriteJSON(ctx, map[string][]WindowReport{identity: ReportFor(identity, time.Now())})
+		return
+	}
+
+	admin.WriteJSON(ctx, Report(time.Now()))
+}
@@ -0,0 +1,414 @@
+package quota
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentQuota)
+
+var (
+	quotaConfigPath    = flag.String("quotaConfigPath", "", "Path to JSON file with per-partner request/byte quotas; empty disables quotas")
+	quotaStorePath     = flag.String("quotaStorePath", "", "Path to file where quota counters are persisted so they survive restarts; empty keeps them in memory only")
+	quotaFlushInterval = flag.Duration("quotaFlushInterval", 10*time.Second, "How often quota counters are written to quotaStorePath")
+)
+
+// Wildcard matches any identity in a quota rule.
+const Wildcard = "*"
+
+const (
+	WindowDaily   = "daily"
+	WindowMonthly = "monthly"
+)
+
+// Limits caps requests and bytes (request + response bodies) within one window. Zero means unlimited.
+type Limits struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Rule is a quota for a single identity (or Wildcard) on requests to Route or a path below it.
+// With Domain set, it only applies to identities issued within that trust bundle.
+type Rule struct {
+	Identity string `json:"identity"`
+	Domain   string `json:"domain,omitempty"`
+	Route    string `json:"route"`
+	Daily    Limits `json:"daily"`
+	Monthly  Limits `json:"monthly"`
+}
+
+// Config is the content of quotaConfigPath.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Usage is what was consumed within one window.
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+var (
+	mu       sync.Mutex
+	rules    []Rule
+	counters = map[string]*Usage{}
+	dirty    bool
+)
+
+// Init loads quota rules and persisted counters and starts the periodic flush.
+// It is a no-op when quotaConfigPath is not set.
+func Init() error {
+	if *quotaConfigPath == "" {
+		return nil
+	}
+
+	cfg, err := loadConfig(*quotaConfigPath)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := loadCounters(*quotaStorePath)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	rules = cfg.Rules
+	counters = loaded
+	mu.Unlock()
+
+	log.Info("Loaded quotas", "rules", len(cfg.Rules), "counters", len(loaded))
+
+	if *quotaStorePath == "" {
+		log.Warn("quotaStorePath is not set, quota counters will be lost on restart")
+		return nil
+	}
+
+	go func() {
+		for range time.Tick(*quotaFlushInterval) {
+			if err := Flush(); err != nil {
+				log.Error("Failed to persist quota counters", "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota config %s: %w", path, err)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse quota config %s: %w", path, err)
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Identity == "" {
+			return nil, fmt.Errorf("quota rule #%d has no identity", i)
+		}
+		if r.Route == "" {
+			cfg.Rules[i].Route = "/"
+		}
+	}
+
+	return cfg, nil
+}
+
+// Allow checks every rule matching identity of the issuer domain and path and, when none is exhausted, counts the request.
+// Otherwise it returns false and the time at which the exhausted windows reset. Identities of different domains
+// have their own counters.
+func Allow(domain, identity, path string, now time.Time) (time.Time, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var resetAt time.Time
+	matched := matchingRules(domain, identity, path)
+
+	for _, r := range matched {
+		for _, w := range windows(r, now) {
+			u := counters[counterKey(domain, identity, r.Route, w.period)]
+			if u == nil || !w.limits.exceededBy(u) {
+				continue
+			}
+			if w.resetAt.After(resetAt) {
+				resetAt = w.resetAt
+			}
+		}
+	}
+
+	if !resetAt.IsZero() {
+		return resetAt, false
+	}
+
+	for _, r := range matched {
+		for _, w := range windows(r, now) {
+			counter(domain, identity, r.Route, w.period).Requests++
+		}
+	}
+	dirty = dirty || len(matched) > 0
+
+	return time.Time{}, true
+}
+
+// AddBytes counts n transferred bytes against every rule matching identity of the issuer domain and path.
+func AddBytes(domain, identity, path string, n int64, now time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, r := range matchingRules(domain, identity, path) {
+		for _, w := range windows(r, now) {
+			counter(domain, identity, r.Route, w.period).Bytes += n
+		}
+		dirty = true
+	}
+}
+
+func matchingRules(domain, identity, path string) []Rule {
+	var matched []Rule
+	best := map[string]int{}
+	for _, r := range rules {
+		if !routeMatches(r.Route, path) || (r.Domain != "" && r.Domain != domain) {
+			continue
+		}
+		if r.Identity != identity && r.Identity != Wildcard {
+			continue
+		}
+
+		matched = append(matched, r)
+		best[r.Route] = max(best[r.Route], r.specificity())
+	}
+
+	// only the most specific rules of a route apply: identity specific rules replace the wildcard ones
+	// and domain scoped rules the unscoped ones, so a request is never counted twice on the same counter
+	applied := matched[:0]
+	for _, r := range matched {
+		if r.specificity() == best[r.Route] {
+			applied = append(applied, r)
+		}
+	}
+
+	return applied
+}
+
+func (r Rule) specificity() int {
+	s := 0
+	if r.Identity != Wildcard {
+		s += 2
+	}
+	if r.Domain != "" {
+		s++
+	}
+	return s
+}
+
+// routeMatches reports whether path is route or below it, matching whole path segments: /lookup covers /lookup/123
+// but not /lookups.
+func routeMatches(route, path string) bool {
+	if route == "/" || path == route {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/")
+}
+
+type window struct {
+	name    string
+	period  string
+	limits  Limits
+	resetAt time.Time
+}
+
+func windows(r Rule, now time.Time) []window {
+	now = now.UTC()
+	year, month, day := now.Date()
+
+	return []window{
+		{
+			name:    WindowDaily,
+			period:  now.Format("2006-01-02"),
+			limits:  r.Daily,
+			resetAt: time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    WindowMonthly,
+			period:  now.Format("2006-01"),
+			limits:  r.Monthly,
+			resetAt: time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+}
+
+func (l Limits) exceededBy(u *Usage) bool {
+	return (l.Requests > 0 && u.Requests >= l.Requests) || (l.Bytes > 0 && u.Bytes >= l.Bytes)
+}
+
+func (l Limits) remaining(u Usage) Usage {
+	var rem Usage
+	if l.Requests > 0 {
+		rem.Requests = max(l.Requests-u.Requests, 0)
+	}
+	if l.Bytes > 0 {
+		rem.Bytes = max(l.Bytes-u.Bytes, 0)
+	}
+	return rem
+}
+
+func counterKey(domain, identity, route, period string) string {
+	return domain + "\x00" + identity + "\x00" + route + "\x00" + period
+}
+
+func splitCounterKey(key string) (domain, identity, route, period string) {
+	parts := strings.SplitN(key, "\x00", 4)
+	if len(parts) != 4 {
+		return "", "", "", ""
+	}
+	return parts[0], parts[1], parts[2], parts[3]
+}
+
+func counter(domain, identity, route, period string) *Usage {
+	key := counterKey(domain, identity, route, period)
+	u := counters[key]
+	if u == nil {
+		u = &Usage{}
+		counters[key] = u
+	}
+	return u
+}
+
+// WindowReport describes usage of one rule by the identity of one issuer domain within one window.
+type WindowReport struct {
+	Domain    string    `json:"domain,omitempty"`
+	Route     string    `json:"route"`
+	Window    string    `json:"window"`
+	Period    string    `json:"period"`
+	Limits    Limits    `json:"limits"`
+	Used      Usage     `json:"used"`
+	Remaining Usage     `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// Report returns current usage and remaining quota per identity.
+// Identities appear once they have been configured explicitly or have made a request.
+func Report(now time.Time) map[string][]WindowReport {
+	mu.Lock()
+	defer mu.Unlock()
+
+	identities := map[string]struct{}{}
+	for _, r := range rules {
+		if r.Identity != Wildcard {
+			identities[r.Identity] = struct{}{}
+		}
+	}
+	for key := range counters {
+		_, identity, _, _ := splitCounterKey(key)
+		identities[identity] = struct{}{}
+	}
+
+	report := make(map[string][]WindowReport, len(identities))
+	for identity := range identities {
+		report[identity] = reportFor(identity, now)
+	}
+
+	return report
+}
+
+// ReportFor returns current usage and remaining quota of a single identity, in every issuer domain it was seen in.
+func ReportFor(identity string, now time.Time) []WindowReport {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return reportFor(identity, now)
+}
+
+func reportFor(identity string, now time.Time) []WindowReport {
+	domains := map[string]struct{}{}
+	for key := range counters {
+		if domain, id, _, _ := splitCounterKey(key); id == identity {
+			domains[domain] = struct{}{}
+		}
+	}
+	for _, r := range rules {
+		if r.Identity == identity && r.Domain != "" {
+			domains[r.Domain] = struct{}{}
+		}
+	}
+	if len(domains) == 0 {
+		domains[""] = struct{}{}
+	}
+
+	var reports []WindowReport
+	for domain := range domains {
+		reports = append(reports, reportIn(domain, identity, now)...)
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		if reports[i].Domain != reports[j].Domain {
+			return reports[i].Domain < reports[j].Domain
+		}
+		return reports[i].Route < reports[j].Route
+	})
+
+	return reports
+}
+
+func reportIn(domain, identity string, now time.Time) []WindowReport {
+	var reports []WindowReport
+	for _, r := range matchingRulesAnyRoute(domain, identity) {
+		for _, w := range windows(r, now) {
+			var used Usage
+			if u := counters[counterKey(domain, identity, r.Route, w.period)]; u != nil {
+				used = *u
+			}
+
+			reports = append(reports, WindowReport{
+				Domain:    domain,
+				Route:     r.Route,
+				Window:    w.name,
+				Period:    w.period,
+				Limits:    w.limits,
+				Used:      used,
+				Remaining: w.limits.remaining(used),
+				ResetsAt:  w.resetAt,
+			})
+		}
+	}
+	return reports
+}
+
+func matchingRulesAnyRoute(domain, identity string) []Rule {
+	routes := map[string]struct{}{}
+	for _, r := range rules {
+		if (r.Identity == identity || r.Identity == Wildcard) && (r.Domain == "" || r.Domain == domain) {
+			routes[r.Route] = struct{}{}
+		}
+	}
+
+	var matched []Rule
+	for route := range routes {
+		matched = append(matched, matchingRules(domain, identity, route)...)
+	}
+
+	// matchingRules returns every rule whose route covers route, keep each once
+	seen := map[string]struct{}{}
+	uniq := matched[:0]
+	for _, r := range matched {
+		key := r.Identity + "\x00" + r.Domain + "\x00" + r.Route
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		uniq = append(uniq, r)
+	}
+
+	return uniq
+}
@@ -0,0 +1,167 @@
+package quota
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setRules(t *testing.T, r ...Rule) {
+	t.Helper()
+
+	mu.Lock()
+	rules = r
+	counters = map[string]*Usage{}
+	dirty = false
+	mu.Unlock()
+}
+
+func TestAllow_DailyRequests(t *testing.T) {
+	setRules(t, Rule{Identity: Wildcard, Route: "/", Daily: Limits{Requests: 2}})
+	now := time.Date(2026, 3, 31, 22, 0, 0, 0, time.UTC)
+
+	_, ok := Allow("mygaru", "DV1", "/lookup", now)
+	assert.True(t, ok)
+	_, ok = Allow("mygaru", "DV1", "/lookup", now)
+	assert.True(t, ok)
+
+	resetAt, ok := Allow("mygaru", "DV1", "/lookup", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), resetAt)
+
+	// other partners have their own counters
+	_, ok = Allow("mygaru", "DV2", "/lookup", now)
+	assert.True(t, ok)
+
+	// next day
+	_, ok = Allow("mygaru", "DV1", "/lookup", now.Add(3*time.Hour))
+	assert.True(t, ok)
+}
+
+func TestAllow_IdentityOverridesWildcard(t *testing.T) {
+	setRules(t,
+		Rule{Identity: Wildcard, Route: "/", Monthly: Limits{Requests: 1}},
+		Rule{Identity: "DV1", Route: "/", Monthly: Limits{Requests: 3}},
+	)
+	now := time.Date(2026, 12, 15, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		_, ok := Allow("mygaru", "DV1", "/", now)
+		assert.True(t, ok)
+	}
+
+	resetAt, ok := Allow("mygaru", "DV1", "/", now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), resetAt)
+}
+
+func TestAllow_RouteSegments(t *testing.T) {
+	setRules(t, Rule{Identity: Wildcard, Route: "/lookup", Daily: Limits{Requests: 1}})
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	_, ok := Allow("mygaru", "DV1", "/lookup/123", now)
+	assert.True(t, ok)
+	_, ok = Allow("mygaru", "DV1", "/lookup", now)
+	assert.False(t, ok)
+
+	// a route only covers whole path segments
+	_, ok = Allow("mygaru", "DV1", "/lookups", now)
+	assert.True(t, ok)
+	_, ok = Allow("mygaru", "DV1", "/lookups", now)
+	assert.True(t, ok)
+
+	assert.True(t, routeMatches("/", "/anything"))
+	assert.True(t, routeMatches("/lookup/", "/lookup/123"))
+	assert.False(t, routeMatches("/lookup/", "/lookups"))
+}
+
+func TestAllow_Bytes(t *testing.T) {
+	setRules(t, Rule{Identity: "DV1", Route: "/upload", Daily: Limits{Bytes: 100}})
+	now := time.Now()
+
+	_, ok := Allow("mygaru", "DV1", "/upload/x", now)
+	assert.True(t, ok)
+	AddBytes("mygaru", "DV1", "/upload/x", 100, now)
+
+	_, ok = Allow("mygaru", "DV1", "/upload/x", now)
+	assert.False(t, ok)
+
+	// not covered by any rule
+	_, ok = Allow("mygaru", "DV1", "/lookup", now)
+	assert.True(t, ok)
+
+	report := ReportFor("DV1", now)
+	assert.Len(t, report, 2)
+	assert.Equal(t, int64(100), report[0].Used.Bytes)
+	assert.Equal(t, int64(0), report[0].Remaining.Bytes)
+}
+
+func TestFlush_Persists(t *testing.T) {
+	setRules(t, Rule{Identity: "DV1", Route: "/", Daily: Limits{Requests: 10}})
+	path := filepath.Join(t.TempDir(), "quota.json")
+	*quotaStorePath = path
+	defer func() { *quotaStorePath = "" }()
+
+	_, ok := Allow("mygaru", "DV1", "/", time.Now())
+	assert.True(t, ok)
+	assert.Nil(t, Flush())
+
+	loaded, err := loadCounters(path)
+	assert.Nil(t, err)
+	assert.Len(t, loaded, 2)
+	for _, u := range loaded {
+		assert.Equal(t, int64(1), u.Requests)
+	}
+}
+
+func TestAllow_Domain(t *testing.T) {
+	setRules(t,
+		Rule{Identity: "DV1", Route: "/", Daily: Limits{Requests: 1}},
+		Rule{Identity: "DV1", Domain: "partner-ca", Route: "/bulk", Daily: Limits{Requests: 1}},
+	)
+	now := time.Now()
+
+	_, ok := Allow("mygaru", "DV1", "/lookup", now)
+	assert.True(t, ok)
+	_, ok = Allow("mygaru", "DV1", "/lookup", now)
+	assert.False(t, ok)
+
+	// the same CN issued by another CA has its own counters
+	_, ok = Allow("partner-ca", "DV1", "/lookup", now)
+	assert.True(t, ok)
+
+	// rules of a domain only apply to its identities
+	_, ok = Allow("partner-ca", "DV1", "/bulk", now)
+	assert.False(t, ok)
+	assert.Len(t, ReportFor("DV1", now), 6)
+}
+
+func TestAllow_DomainOverridesUnscoped(t *testing.T) {
+	setRules(t,
+		Rule{Identity: "DV1", Route: "/", Daily: Limits{Requests: 3}},
+		Rule{Identity: "DV1", Domain: "partner-ca", Route: "/", Daily: Limits{Requests: 2}},
+	)
+	now := time.Now()
+
+	// the domain scoped rule replaces the unscoped one, each request is counted once
+	for i := 0; i < 2; i++ {
+		_, ok := Allow("partner-ca", "DV1", "/lookup", now)
+		assert.True(t, ok)
+	}
+	_, ok := Allow("partner-ca", "DV1", "/lookup", now)
+	assert.False(t, ok)
+
+	report := ReportFor("DV1", now)
+	assert.Len(t, report, 2)
+	assert.Equal(t, int64(2), report[0].Used.Requests)
+	assert.Equal(t, int64(2), report[0].Limits.Requests)
+
+	// other domains keep the unscoped rule
+	for i := 0; i < 3; i++ {
+		_, ok = Allow("mygaru", "DV1", "/lookup", now)
+		assert.True(t, ok)
+	}
+	_, ok = Allow("mygaru", "DV1", "/lookup", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,92 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// storedCounter is the on-disk form of a single counter.
+type storedCounter struct {
+	Domain   string `json:"domain,omitempty"`
+	Identity string `json:"identity"`
+	Route    string `json:"route"`
+	Period   string `json:"period"`
+	Usage
+}
+
+func loadCounters(path string) (map[string]*Usage, error) {
+	loaded := map[string]*Usage{}
+	if path == "" {
+		return loaded, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return loaded, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota counters %s: %w", path, err)
+	}
+
+	var stored []storedCounter
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse quota counters %s: %w", path, err)
+	}
+
+	for _, c := range stored {
+		u := c.Usage
+		loaded[counterKey(c.Domain, c.Identity, c.Route, c.Period)] = &u
+	}
+
+	return loaded, nil
+}
+
+// Flush persists the counters to quotaStorePath, dropping counters of windows that already ended.
+func Flush() error {
+	if *quotaStorePath == "" {
+		return nil
+	}
+
+	mu.Lock()
+	if !dirty {
+		mu.Unlock()
+		return nil
+	}
+
+	now := time.Now().UTC()
+	current := map[string]struct{}{
+		now.Format("2006-01-02"): {},
+		now.Format("2006-01"):    {},
+	}
+
+	stored := make([]storedCounter, 0, len(counters))
+	for key, u := range counters {
+		domain, identity, route, period := splitCounterKey(key)
+		if _, ok := current[period]; !ok {
+			delete(counters, key)
+			continue
+		}
+		stored = append(stored, storedCounter{Domain: domain, Identity: identity, Route: route, Period: period, Usage: *u})
+	}
+	dirty = false
+	mu.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to encode quota counters: %w", err)
+	}
+
+	if err := atomicfile.WriteFile(*quotaStorePath, data, 0o600); err != nil {
+		mu.Lock()
+		dirty = true
+		mu.Unlock()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	requestIDHeader            = flag.String("requestIDHeader", "X-Request-ID", "Header carrying the request ID from the client, to the upstream and back on the response")
+	requestIDFormat            = flag.String("requestIDFormat", FormatUUIDv7, "Format of generated request IDs: uuidv7 or ulid")
+	requestIDTrustedIdentities = flag.String("requestIDTrustedIdentities", "", "Comma-separated identities whose inbound request IDs are kept; * trusts every identity. "+
+		"Requests of other identities get a generated ID")
+)
+
+const (
+	FormatUUIDv7 = "uuidv7"
+	FormatULID   = "ulid"
+)
+
+// maxLen bounds accepted inbound IDs, longer values are replaced.
+const maxLen = 128
+
+// userValueKey is the fasthttp user value holding the request ID.
+const userValueKey = "idcheck.requestID"
+
+var (
+	trustedOnce sync.Once
+	trustAll    bool
+	trusted     map[string]bool
+)
+
+func loadTrusted() {
+	trusted = map[string]bool{}
+	for _, name := range strings.Split(*requestIDTrustedIdentities, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case "*":
+			trustAll = true
+		default:
+			trusted[name] = true
+		}
+	}
+}
+
+// Header is the name of the request ID header.
+func Header() string {
+	return *requestIDHeader
+}
+
+// Validate checks the request ID flags.
+func Validate() error {
+	if *requestIDFormat != FormatUUIDv7 && *requestIDFormat != FormatULID {
+		return fmt.Errorf("unsupported requestIDFormat %q, want %s or %s", *requestIDFormat, FormatUUIDv7, FormatULID)
+	}
+	return nil
+}
+
+// Assign resolves the request ID of ctx, keeping the inbound one when identity is trusted to set it,
+// echoes it on the response and returns it.
+func Assign(ctx *fasthttp.RequestCtx, identity string) string {
+	id := string(ctx.Request.Header.Peek(*requestIDHeader))
+	if !acceptable(id) || !isTrusted(identity) {
+		id = New()
+	}
+
+	ctx.SetUserValue(userValueKey, id)
+	ctx.Response.Header.Set(*requestIDHeader, id)
+
+	return id
+}
+
+// Get returns the request ID assigned to ctx, if any.
+func Get(ctx *fasthttp.RequestCtx) string {
+	id, _ := ctx.UserValue(userValueKey).(string)
+	return id
+}
+
+func isTrusted(identity string) bool {
+	trustedOnce.Do(loadTrusted)
+	return trustAll || trusted[identity]
+}
+
+// acceptable reports whether an inbound ID is safe to log and forward.
+func acceptable(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.:/+=", c) >= 0
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// New generates a request ID in the configured format.
+func New() string {
+	now := time.Now()
+	if *requestIDFormat == FormatULID {
+		return newULID(now)
+	}
+	return newUUIDv7(now)
+}
+
+// newUUIDv7 returns an RFC 9562 version 7 UUID: 48 bits of unix milliseconds followed by random bits.
+func newUUIDv7(now time.Time) string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+
+	return string(out[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of unix milliseconds and 80 random bits in Crockford base32.
+func newULID(now time.Time) string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+
+	// 128 bits encode to 26 characters of 5 bits, the first one carrying the top 3 bits
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out[:])
+}
@@ -0,0 +1,55 @@
+package requestid
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGeneratedFormats(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	uuid := newUUIDv7(now)
+	require.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), uuid)
+	require.Equal(t, "018bcfe5-6800", uuid[:13])
+
+	ulid := newULID(now)
+	require.Len(t, ulid, 26)
+	require.Equal(t, "01HF7YAT00", ulid[:10])
+	require.NotEqual(t, ulid, newULID(now))
+}
+
+func TestAssign(t *testing.T) {
+	prev := *requestIDTrustedIdentities
+	*requestIDTrustedIdentities = "trusted-partner"
+	trustedOnce = sync.Once{}
+	t.Cleanup(func() {
+		*requestIDTrustedIdentities = prev
+		trustedOnce = sync.Once{}
+	})
+
+	assign := func(inbound, identity string) (string, *fasthttp.RequestCtx) {
+		ctx := &fasthttp.RequestCtx{}
+		if inbound != "" {
+			ctx.Request.Header.Set("X-Request-ID", inbound)
+		}
+		return Assign(ctx, identity), ctx
+	}
+
+	id, ctx := assign("abc-123", "trusted-partner")
+	require.Equal(t, "abc-123", id)
+	require.Equal(t, id, Get(ctx))
+	require.Equal(t, id, string(ctx.Response.Header.Peek("X-Request-ID")))
+
+	id, _ = assign("abc-123", "other-partner")
+	require.NotEqual(t, "abc-123", id)
+
+	id, _ = assign("bad id\r\n", "trusted-partner")
+	require.NotEqual(t, "bad id\r\n", id)
+
+	id, _ = assign("", "trusted-partner")
+	require.Len(t, id, 36)
+}
@@ -0,0 +1,123 @@
+// Package revocationfeedtest provides a local stand-in for the CA revocation feed.
+package revocationfeedtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+type event struct {
+	id   int
+	typ  string
+	data []byte
+}
+
+// Server is an SSE revocation feed. Events get increasing IDs and are replayed
+// after the Last-Event-ID of a reconnecting subscriber.
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	events      []event
+	subscribers map[chan struct{}]struct{}
+	drop        chan struct{}
+	lastIDs     []string
+}
+
+// NewServer starts a feed server. Close it with Close.
+func NewServer() *Server {
+	s := &Server{subscribers: map[chan struct{}]struct{}{}, drop: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Publish appends an event of type typ with data encoded as JSON and returns its ID.
+func (s *Server) Publish(typ string, data any) string {
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := len(s.events) + 1
+	s.events = append(s.events, event{id: id, typ: typ, data: b})
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return strconv.Itoa(id)
+}
+
+// Disconnect ends the streams of all current subscribers.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.drop)
+	s.drop = make(chan struct{})
+}
+
+// LastEventIDs returns the Last-Event-ID header of every subscription so far, "" for none.
+func (s *Server) LastEventIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lastIDs...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	last, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	notify := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.lastIDs = append(s.lastIDs, r.Header.Get("Last-Event-ID"))
+	s.subscribers[notify] = struct{}{}
+	drop := s.drop
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, notify)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, ": revocation feed\nretry: 50\n\n")
+	flusher.Flush()
+
+	for {
+		s.mu.Lock()
+		pending := append([]event(nil), s.events[min(last, len(s.events)):]...)
+		s.mu.Unlock()
+
+		for _, e := range pending {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.typ, e.data); err != nil {
+				return
+			}
+			last = e.id
+		}
+		flusher.Flush()
+
+		select {
+		case <-notify:
+		case <-drop:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package revsnapshot reads and writes signed revocation snapshots, the revoked serials of a CA
+// for deployments that cannot reach its reputation service.
+package revsnapshot
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/signing"
+	"time"
+)
+
+// ErrExpired is returned by Snapshot.Check outside of the validity window of a snapshot.
+var ErrExpired = errors.New("revocation snapshot is not valid")
+
+// Entry is a revoked certificate.
+type Entry struct {
+	Serial    string    `json:"serial"`
+	Reason    string    `json:"reason,omitempty"`
+	RevokedAt time.Time `json:"revokedAt,omitzero"`
+}
+
+// Snapshot lists the revoked certificates of Issuer as of IssuedAt. Sequence increases with every snapshot of an issuer.
+type Snapshot struct {
+	Issuer    string    `json:"issuer"`
+	Sequence  uint64    `json:"sequence"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Revoked   []Entry   `json:"revoked"`
+}
+
+// file is the on-disk form. The signature covers the snapshot member in compact JSON,
+// so reformatting the file does not invalidate it.
+type file struct {
+	Snapshot  json.RawMessage `json:"snapshot"`
+	Signature string          `json:"signature"`
+}
+
+// Build signs s and returns the snapshot file content.
+func Build(s Snapshot, signer crypto.Signer) ([]byte, error) {
+	if !s.NotAfter.After(s.NotBefore) {
+		return nil, fmt.Errorf("notAfter must be after notBefore")
+	}
+	for _, e := range s.Revoked {
+		if e.Serial == "" {
+			return nil, fmt.Errorf("revoked entry without a serial")
+		}
+	}
+
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signing.Sign(signer, raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign revocation snapshot: %w", err)
+	}
+
+	out, err := json.MarshalIndent(file{Snapshot: raw, Signature: base64.StdEncoding.EncodeToString(sig)}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// Parse verifies the signature of a snapshot file against pub and decodes it. The validity window is not checked.
+func Parse(data []byte, pub crypto.PublicKey) (*Snapshot, error) {
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse revocation snapshot: %w", err)
+	}
+	if len(f.Snapshot) == 0 || f.Signature == "" {
+		return nil, fmt.Errorf("revocation snapshot needs snapshot and signature")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(f.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode revocation snapshot signature: %w", err)
+	}
+	var signed bytes.Buffer
+	if err := json.Compact(&signed, f.Snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse revocation snapshot: %w", err)
+	}
+	if err := signing.Verify(pub, signed.Bytes(), sig); err != nil {
+		return nil, fmt.Errorf("revocation snapshot signature: %w", err)
+	}
+
+	s := &Snapshot{}
+	if err := json.Unmarshal(f.Snapshot, s); err != nil {
+		return nil, fmt.Errorf("failed to parse revocation snapshot: %w", err)
+	}
+	return s, nil
+}
+
+// Check returns ErrExpired when now is outside of the validity window of s.
+func (s *Snapshot) Check(now time.Time) error {
+	if now.Before(s.NotBefore) || now.After(s.NotAfter) {
+		return fmt.Errorf("%w: valid from %s to %s", ErrExpired, s.NotBefore.Format(time.RFC3339), s.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Index returns the revoked entries of s by serial.
+func (s *Snapshot) Index() map[string]Entry {
+	out := make(map[string]Entry, len(s.Revoked))
+	for _, e := range s.Revoked {
+		out[e.Serial] = e
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package revsnapshot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBuildParse(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	data, err := Build(Snapshot{
+		Issuer:    "mygaru",
+		Sequence:  3,
+		IssuedAt:  now,
+		NotBefore: now,
+		NotAfter:  now.Add(time.Hour),
+		Revoked:   []Entry{{Serial: "12", Reason: "keyCompromise"}, {Serial: "13"}},
+	}, priv)
+	require.NoError(t, err)
+
+	s, err := Parse(data, pub)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.Sequence)
+	require.Equal(t, "keyCompromise", s.Index()["12"].Reason)
+	require.NoError(t, s.Check(now.Add(time.Minute)))
+	require.True(t, errors.Is(s.Check(now.Add(2*time.Hour)), ErrExpired))
+	require.True(t, errors.Is(s.Check(now.Add(-time.Minute)), ErrExpired))
+
+	// dropping a serial breaks the signature
+	_, err = Parse(bytes.Replace(data, []byte(`"13"`), []byte(`"14"`), 1), pub)
+	require.Error(t, err)
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = Parse(data, other)
+	require.Error(t, err)
+}
+
+func TestBuild_InvalidWindow(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	_, err := Build(Snapshot{NotBefore: now, NotAfter: now}, priv)
+	require.Error(t, err)
+}
@@ -0,0 +1,59 @@
+package route
+
+import (
+	"flag"
+	"strings"
+	"sync"
+)
+
+var (
+	routePrefixes = flag.String("routePrefixes", "", "Comma-separated path prefixes reported as routes in usage records; "+
+		"other paths are reported by their first segment")
+)
+
+var (
+	prefixes     []string
+	prefixesOnce sync.Once
+)
+
+// Of returns the route path belongs to: the longest prefix from routePrefixes covering path
+// by whole segments, otherwise the first path segment (e.g. /lookup for /lookup/123).
+func Of(path string) string {
+	prefixesOnce.Do(func() {
+		prefixes = parsePrefixes(*routePrefixes)
+	})
+
+	best := ""
+	for _, p := range prefixes {
+		if Matches(p, path) && len(p) > len(best) {
+			best = p
+		}
+	}
+	if best != "" {
+		return best
+	}
+
+	if i := strings.IndexByte(strings.TrimPrefix(path, "/"), '/'); i >= 0 {
+		return path[:i+1]
+	}
+	return path
+}
+
+// Matches reports whether path is route or below it, matching whole path segments: /lookup covers /lookup/123
+// but not /lookups.
+func Matches(route, path string) bool {
+	if route == "/" || path == route {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/")
+}
+
+func parsePrefixes(s string) []string {
+	out := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+package route
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	prev := *routePrefixes
+	*routePrefixes = "/lookup, /lookup/bulk"
+	prefixesOnce = sync.Once{}
+	t.Cleanup(func() {
+		*routePrefixes = prev
+		prefixesOnce = sync.Once{}
+	})
+
+	require.Equal(t, "/lookup", Of("/lookup"))
+	require.Equal(t, "/lookup", Of("/lookup/123"))
+	require.Equal(t, "/lookup/bulk", Of("/lookup/bulk/7"))
+	// prefixes only cover whole path segments
+	require.Equal(t, "/lookups", Of("/lookups"))
+	require.Equal(t, "/lookups", Of("/lookups/123"))
+	require.Equal(t, "/other", Of("/other"))
+}
+
+func TestMatches(t *testing.T) {
+	require.True(t, Matches("/", "/anything"))
+	require.True(t, Matches("/lookup/", "/lookup/123"))
+	require.True(t, Matches("/lookup", "/lookup"))
+	require.False(t, Matches("/lookup", "/lookups"))
+	require.False(t, Matches("/lookup/", "/lookups"))
+}
@@ -0,0 +1,131 @@
+package scopes
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	scopeExtensionOIDs = flag.String("scopeExtensionOIDs", "", "Comma-separated OIDs of certificate extensions holding an ASN.1 SEQUENCE OF strings with the caller's scopes; "+
+		"OID=prefix prepends prefix to each value, e.g. 1.3.6.1.4.1.55555.1.1=product:,1.3.6.1.4.1.55555.1.2")
+	scopeHeader = flag.String("scopeHeader", "X-Client-Scopes", "Header carrying the caller's space-separated scopes upstream")
+)
+
+type extension struct {
+	oid    asn1.ObjectIdentifier
+	prefix string
+}
+
+var extensions []extension
+
+// Init parses scopeExtensionOIDs.
+func Init() error {
+	parsed, err := parseExtensions(*scopeExtensionOIDs)
+	if err != nil {
+		return err
+	}
+	extensions = parsed
+	return nil
+}
+
+// Header returns the name of the header the scopes are forwarded in.
+func Header() string {
+	return *scopeHeader
+}
+
+func parseExtensions(list string) ([]extension, error) {
+	var out []extension
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		oidStr, prefix, _ := strings.Cut(item, "=")
+		oid, err := parseOID(strings.TrimSpace(oidStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid scopeExtensionOIDs entry %q: %w", item, err)
+		}
+		out = append(out, extension{oid: oid, prefix: strings.TrimSpace(prefix)})
+	}
+	return out, nil
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID needs at least two arcs")
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID arc %q", p)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// IsScopeExtension reports whether oid is one of the configured scope extensions.
+func IsScopeExtension(oid asn1.ObjectIdentifier) bool {
+	for _, e := range extensions {
+		if e.oid.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasExtension reports whether cert carries one of the configured scope extensions.
+func HasExtension(cert *x509.Certificate) bool {
+	return slices.ContainsFunc(cert.Extensions, func(ext pkix.Extension) bool { return IsScopeExtension(ext.Id) })
+}
+
+// FromCertificate returns the sorted, deduplicated scopes of cert from the configured extensions.
+func FromCertificate(cert *x509.Certificate) ([]string, error) {
+	var out []string
+	for _, ext := range cert.Extensions {
+		for _, e := range extensions {
+			if !e.oid.Equal(ext.Id) {
+				continue
+			}
+
+			var values []string
+			rest, err := asn1.Unmarshal(ext.Value, &values)
+			if err != nil {
+				return nil, fmt.Errorf("extension %s is not a SEQUENCE OF strings: %w", ext.Id, err)
+			}
+			if len(rest) > 0 {
+				return nil, fmt.Errorf("extension %s has trailing data", ext.Id)
+			}
+
+			for _, v := range values {
+				if v == "" || strings.ContainsAny(v, " \t\r\n") {
+					return nil, fmt.Errorf("extension %s has an invalid scope %q", ext.Id, v)
+				}
+				out = append(out, e.prefix+v)
+			}
+		}
+	}
+
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// HasAll reports whether scopes contains every one of required.
+func HasAll(scopes, required []string) bool {
+	for _, r := range required {
+		if !slices.Contains(scopes, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package scopes
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func extensionOf(t *testing.T, oid asn1.ObjectIdentifier, values ...string) pkix.Extension {
+	t.Helper()
+
+	der, err := asn1.Marshal(values)
+	require.NoError(t, err)
+	return pkix.Extension{Id: oid, Value: der}
+}
+
+func TestFromCertificate(t *testing.T) {
+	parsed, err := parseExtensions("1.3.6.1.4.1.55555.1.1=product:, 1.3.6.1.4.1.55555.1.2")
+	require.NoError(t, err)
+	extensions = parsed
+	t.Cleanup(func() { extensions = nil })
+
+	products := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 55555, 1, 1}
+	scopeOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 55555, 1, 2}
+	require.True(t, IsScopeExtension(scopeOID))
+	require.False(t, IsScopeExtension(asn1.ObjectIdentifier{2, 5, 29, 37}))
+
+	cert := &x509.Certificate{Extensions: []pkix.Extension{
+		extensionOf(t, products, "lookup", "batch"),
+		extensionOf(t, scopeOID, "ids:read", "ids:write", "ids:read"),
+		extensionOf(t, asn1.ObjectIdentifier{1, 2, 3}, "ignored"),
+	}}
+	got, err := FromCertificate(cert)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ids:read", "ids:write", "product:batch", "product:lookup"}, got)
+
+	require.True(t, HasAll(got, []string{"ids:read", "product:lookup"}))
+	require.False(t, HasAll(got, []string{"ids:admin"}))
+
+	got, err = FromCertificate(&x509.Certificate{})
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	_, err = FromCertificate(&x509.Certificate{Extensions: []pkix.Extension{{Id: scopeOID, Value: []byte{0x04, 0x01, 0x00}}}})
+	require.Error(t, err)
+	_, err = FromCertificate(&x509.Certificate{Extensions: []pkix.Extension{extensionOf(t, scopeOID, "two words")}})
+	require.Error(t, err)
+}
+
+func TestParseExtensions_Invalid(t *testing.T) {
+	for _, invalid := range []string{"1", "1.x.3", "1.-2"} {
+		_, err := parseExtensions(invalid)
+		require.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,142 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var spiffeTrustBundles = flag.String("spiffeTrustBundles", "", "Comma-separated trust domain=bundle file pairs used to verify SPIFFE X.509 SVIDs, "+
+	"e.g. prod.mygaru.internal=/etc/id-check/prod.bundle.json. Bundles are PEM or SPIFFE bundle JSON files")
+
+// Bundles maps trust domains to the X.509 authorities of their SVIDs.
+type Bundles map[string]*x509.CertPool
+
+var current atomic.Pointer[Bundles]
+
+// Init loads spiffeTrustBundles.
+func Init() error {
+	b, err := LoadBundles(*spiffeTrustBundles)
+	if err != nil {
+		return err
+	}
+	current.Store(&b)
+	return nil
+}
+
+// BundleFor returns the trust bundle of a trust domain. configured is false when no bundles are configured at all.
+func BundleFor(trustDomain string) (pool *x509.CertPool, configured bool) {
+	b := current.Load()
+	if b == nil || len(*b) == 0 {
+		return nil, false
+	}
+	return (*b)[trustDomain], true
+}
+
+// LoadBundles parses a comma-separated list of trust domain=file pairs.
+func LoadBundles(list string) (Bundles, error) {
+	out := Bundles{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		domain, path, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid spiffeTrustBundles entry %q, want domain=path", pair)
+		}
+		domain, path = strings.TrimSpace(domain), strings.TrimSpace(path)
+
+		if _, err := Parse(Scheme + "://" + domain); err != nil {
+			return nil, fmt.Errorf("invalid trust domain %q: %w", domain, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trust bundle of %s: %w", domain, err)
+		}
+
+		certs, err := ParseBundle(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trust bundle of %s from %s: %w", domain, path, err)
+		}
+
+		pool := x509.NewCertPool()
+		for _, c := range certs {
+			pool.AddCert(c)
+		}
+		out[domain] = pool
+	}
+	return out, nil
+}
+
+// bundleJSON is the SPIFFE bundle format: a JWK set whose x509-svid keys carry the CA certificates in x5c.
+type bundleJSON struct {
+	Keys []struct {
+		Use string   `json:"use"`
+		X5C []string `json:"x5c"`
+	} `json:"keys"`
+}
+
+// ParseBundle parses the X.509 authorities of a SPIFFE bundle JSON document or a PEM bundle.
+func ParseBundle(data []byte) ([]*x509.Certificate, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		var b bundleJSON
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, err
+		}
+
+		var out []*x509.Certificate
+		for _, k := range b.Keys {
+			if k.Use != "x509-svid" {
+				continue
+			}
+			if len(k.X5C) != 1 {
+				return nil, fmt.Errorf("x509-svid key must have exactly one x5c certificate, got %d", len(k.X5C))
+			}
+			der, err := base64.StdEncoding.DecodeString(k.X5C[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid x5c: %w", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cert)
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("bundle has no x509-svid authorities")
+		}
+		return out, nil
+	}
+
+	var out []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cert)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no PEM certificates")
+	}
+	return out, nil
+}
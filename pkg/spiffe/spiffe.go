@@ -0,0 +1,100 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const Scheme = "spiffe"
+
+// ID is a SPIFFE ID: spiffe://<trust domain>/<path>.
+type ID struct {
+	TrustDomain string
+	Path        string
+}
+
+// Parse parses and validates a SPIFFE ID.
+func Parse(s string) (ID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: %w", s, err)
+	}
+	if u.Scheme != Scheme {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: scheme is not %s", s, Scheme)
+	}
+	if u.Host == "" || u.User != nil || u.Port() != "" {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: trust domain must be a bare host name", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: query and fragment are not allowed", s)
+	}
+	if u.Host != strings.ToLower(u.Host) {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: trust domain must be lowercase", s)
+	}
+	if strings.HasSuffix(u.Path, "/") || strings.Contains(u.Path, "//") {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: path has empty segments", s)
+	}
+	for _, seg := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+		if seg == "." || seg == ".." {
+			return ID{}, fmt.Errorf("invalid SPIFFE ID %q: path has relative segments", s)
+		}
+	}
+
+	return ID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+// FromPath parses a SPIFFE ID taken from a URL path, where spiffe://td/p arrives as spiffe:/td/p
+// once the path is normalized; the scheme may also be left out.
+func FromPath(s string) (ID, error) {
+	s = strings.TrimLeft(strings.TrimPrefix(s, Scheme+":"), "/")
+	return Parse(Scheme + "://" + s)
+}
+
+func (id ID) String() string {
+	if id.TrustDomain == "" {
+		return ""
+	}
+	return Scheme + "://" + id.TrustDomain + id.Path
+}
+
+// IsZero reports whether id is empty.
+func (id ID) IsZero() bool {
+	return id.TrustDomain == ""
+}
+
+// Segments returns the path segments of id.
+func (id ID) Segments() []string {
+	if id.Path == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(id.Path, "/"), "/")
+}
+
+var ErrMultipleIDs = errors.New("X.509 SVID must have exactly one SPIFFE ID")
+
+// FromCertificate returns the SPIFFE ID of an X.509 SVID. ok is false when cert has no spiffe:// URI SAN.
+func FromCertificate(cert *x509.Certificate) (id ID, ok bool, err error) {
+	for _, u := range cert.URIs {
+		if u.Scheme != Scheme {
+			continue
+		}
+		if ok {
+			return ID{}, true, ErrMultipleIDs
+		}
+
+		id, err = Parse(u.String())
+		if err != nil {
+			return ID{}, true, err
+		}
+		ok = true
+	}
+
+	if ok && cert.IsCA {
+		return ID{}, true, errors.New("X.509 SVID of a client must not be a CA certificate")
+	}
+
+	return id, ok, nil
+}
@@ -0,0 +1,131 @@
+package spiffe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	id, err := Parse("spiffe://prod.mygaru.internal/ns/billing/sa/api")
+	require.NoError(t, err)
+	require.Equal(t, "prod.mygaru.internal", id.TrustDomain)
+	require.Equal(t, []string{"ns", "billing", "sa", "api"}, id.Segments())
+	require.Equal(t, "spiffe://prod.mygaru.internal/ns/billing/sa/api", id.String())
+
+	id, err = Parse("spiffe://prod.mygaru.internal")
+	require.NoError(t, err)
+	require.Empty(t, id.Segments())
+
+	for _, invalid := range []string{
+		"https://prod.mygaru.internal/ns/billing",
+		"spiffe:///ns/billing",
+		"spiffe://Prod.mygaru.internal/ns",
+		"spiffe://prod.mygaru.internal:8443/ns",
+		"spiffe://user@prod.mygaru.internal/ns",
+		"spiffe://prod.mygaru.internal/ns//billing",
+		"spiffe://prod.mygaru.internal/ns/",
+		"spiffe://prod.mygaru.internal/ns/../billing",
+		"spiffe://prod.mygaru.internal/ns?x=1",
+	} {
+		_, err := Parse(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestFromPath(t *testing.T) {
+	for _, s := range []string{"spiffe://prod.mygaru.internal/ns/ops", "spiffe:/prod.mygaru.internal/ns/ops", "prod.mygaru.internal/ns/ops"} {
+		id, err := FromPath(s)
+		require.NoError(t, err, s)
+		require.Equal(t, "spiffe://prod.mygaru.internal/ns/ops", id.String())
+	}
+
+	_, err := FromPath("https://prod.mygaru.internal/ns/ops")
+	require.Error(t, err)
+}
+
+func TestFromCertificate(t *testing.T) {
+	svid := &x509.Certificate{URIs: []*url.URL{
+		{Scheme: "https", Host: "example.com"},
+		{Scheme: "spiffe", Host: "prod.mygaru.internal", Path: "/ns/billing"},
+	}}
+	id, ok, err := FromCertificate(svid)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "spiffe://prod.mygaru.internal/ns/billing", id.String())
+
+	_, ok, err = FromCertificate(&x509.Certificate{})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	svid.URIs = append(svid.URIs, &url.URL{Scheme: "spiffe", Host: "prod.mygaru.internal", Path: "/ns/other"})
+	_, ok, err = FromCertificate(svid)
+	require.ErrorIs(t, err, ErrMultipleIDs)
+	require.True(t, ok)
+}
+
+func TestLoadBundles(t *testing.T) {
+	ca := newCA(t)
+	dir := t.TempDir()
+
+	pemPath := filepath.Join(dir, "dev.pem")
+	require.NoError(t, os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o644))
+
+	jsonPath := filepath.Join(dir, "prod.json")
+	bundle := `{"spiffe_sequence": 1, "keys": [
+		{"use": "jwt-svid", "kty": "EC", "kid": "jwt"},
+		{"use": "x509-svid", "kty": "EC", "x5c": ["` + base64.StdEncoding.EncodeToString(ca.Raw) + `"]}
+	]}`
+	require.NoError(t, os.WriteFile(jsonPath, []byte(bundle), 0o644))
+
+	bundles, err := LoadBundles("dev.mygaru.internal=" + pemPath + ", prod.mygaru.internal=" + jsonPath)
+	require.NoError(t, err)
+	require.Len(t, bundles, 2)
+
+	for _, pool := range bundles {
+		_, err := ca.Verify(x509.VerifyOptions{Roots: pool})
+		require.NoError(t, err)
+	}
+
+	_, err = LoadBundles("prod.mygaru.internal")
+	require.Error(t, err)
+	_, err = LoadBundles("Prod=" + pemPath)
+	require.Error(t, err)
+	_, err = ParseBundle([]byte(`{"keys": [{"use": "jwt-svid"}]}`))
+	require.Error(t, err)
+}
+
+func newCA(t *testing.T) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "SPIFFE CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
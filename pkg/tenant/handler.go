@@ -0,0 +1,149 @@
+package tenant
+
+import (
+	"encoding/json"
+	"github.com/mygaru/id-check/pkg/admin"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/valyala/fasthttp"
+	"strings"
+)
+
+// AdminHandler manages the tenant store:
+//
+//	GET    /tenants                              lists every mapping
+//	GET    /tenants/{cn|spiffe|serial|spki}/{v}  returns one mapping
+//	PUT    /tenants/{cn|spiffe|serial|spki}/{v}  creates or replaces it from {"attributes": {...}}
+//	DELETE /tenants/{cn|spiffe|serial|spki}/{v}  removes it
+//
+// ?domain= addresses the mapping limited to certificates of that issuer domain; serial mappings always need one.
+// SPIFFE IDs may be given without their scheme, e.g. /tenants/spiffe/prod.mygaru.internal/ns/eu/sa/billing.
+// Changes are written to tenantStorePath before they take effect.
+func AdminHandler(ctx *fasthttp.RequestCtx) {
+	if !Enabled() {
+		ctx.Error("tenant mapping is disabled", fasthttp.StatusNotFound)
+		return
+	}
+
+	sub := admin.Subpath(ctx, "/tenants")
+	if sub == "" {
+		if !ctx.IsGet() {
+			ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+		mu.RLock()
+		defer mu.RUnlock()
+		admin.WriteJSON(ctx, Store{Tenants: sortedEntries()})
+		return
+	}
+
+	kind, value, ok := strings.Cut(sub, "/")
+	if !ok || value == "" || (kind != KindCN && kind != KindSPIFFE && kind != KindSerial && kind != KindSPKI) {
+		ctx.Error("want /tenants/{cn|spiffe|serial|spki}/{value}", fasthttp.StatusNotFound)
+		return
+	}
+	domain := string(ctx.QueryArgs().Peek("domain"))
+
+	switch kind {
+	case KindSPIFFE:
+		id, err := spiffe.FromPath(value)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		value = id.String()
+	case KindSerial:
+		if domain == "" {
+			ctx.Error("serial mappings need ?domain=, serials are only unique per issuer", fasthttp.StatusBadRequest)
+			return
+		}
+	case KindSPKI:
+		value = strings.ToLower(value)
+	}
+	key := entryKey(kind, value, domain)
+
+	switch {
+	case ctx.IsGet():
+		mu.RLock()
+		e, ok := entries[key]
+		mu.RUnlock()
+		if !ok {
+			ctx.Error("no such tenant mapping", fasthttp.StatusNotFound)
+			return
+		}
+		admin.WriteJSON(ctx, e)
+
+	case ctx.IsPut():
+		var body struct {
+			Attributes map[string]string `json:"attributes"`
+		}
+		if err := json.Unmarshal(ctx.PostBody(), &body); err != nil || len(body.Attributes) == 0 {
+			ctx.Error("want {\"attributes\": {...}}", fasthttp.StatusBadRequest)
+			return
+		}
+
+		e := Entry{Domain: domain, Attributes: body.Attributes}
+		switch kind {
+		case KindCN:
+			e.CommonName = value
+		case KindSPIFFE:
+			e.SPIFFEID = value
+		case KindSerial:
+			e.Serial = value
+		case KindSPKI:
+			e.SPKI = value
+		}
+
+		if err := update(key, &e); err != nil {
+			log.Error("Failed to persist tenant store", "err", err)
+			ctx.Error("failed to persist tenant store", fasthttp.StatusInternalServerError)
+			return
+		}
+		log.Info("Tenant mapping updated", "kind", kind, "value", value, "domain", domain)
+		admin.WriteJSON(ctx, e)
+
+	case ctx.IsDelete():
+		mu.RLock()
+		_, ok := entries[key]
+		mu.RUnlock()
+		if !ok {
+			ctx.Error("no such tenant mapping", fasthttp.StatusNotFound)
+			return
+		}
+
+		if err := update(key, nil); err != nil {
+			log.Error("Failed to persist tenant store", "err", err)
+			ctx.Error("failed to persist tenant store", fasthttp.StatusInternalServerError)
+			return
+		}
+		log.Info("Tenant mapping removed", "kind", kind, "value", value, "domain", domain)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+
+	default:
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// update replaces (e != nil) or removes the entry under key, persisting the store before the change takes effect.
+func update(key string, e *Entry) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	next := make(map[string]Entry, len(entries)+1)
+	for k, v := range entries {
+		next[k] = v
+	}
+	if e != nil {
+		next[key] = *e
+	} else {
+		delete(next, key)
+	}
+
+	prev := entries
+	entries = next
+	if err := persist(Store{Tenants: sortedEntries()}); err != nil {
+		entries = prev
+		return err
+	}
+
+	return nil
+}
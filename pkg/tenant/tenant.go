@@ -0,0 +1,291 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/atomicfile"
+	"github.com/mygaru/id-check/pkg/filewatch"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentTenant)
+
+var (
+	tenantStorePath = flag.String("tenantStorePath", "", "Path to YAML (.yaml, .yml) or JSON file mapping certificate identities (CN, SPIFFE ID, serial or SPKI fingerprint) "+
+		"to tenant attributes; empty disables tenant mapping")
+	tenantReloadInterval = flag.Duration("tenantReloadInterval", 10*time.Second, "How often tenantStorePath is checked for changes")
+	tenantHeaders        = flag.String("tenantHeaders", "", "Comma-separated attribute=header pairs of tenant attributes sent upstream, e.g. tenantId=X-Tenant-ID,plan=X-Plan-Tier")
+	tenantRequireMapping = flag.Bool("tenantRequireMapping", false, "Reject requests of certificates without a tenant mapping with 403")
+)
+
+var unmapped = metrics.NewCounterVec("idcheck_tenant_unmapped_total", "Requests of certificates without a tenant mapping, by whether they were rejected", "rejected")
+
+// Kinds of certificate attributes a mapping matches on.
+const (
+	KindCN     = "cn"
+	KindSPIFFE = "spiffe"
+	KindSerial = "serial"
+	KindSPKI   = "spki"
+)
+
+// Entry maps the certificates matching exactly one of CommonName, SPIFFEID, Serial or SPKI to tenant attributes.
+// CommonName only matches certificates without a SPIFFE ID. With Domain set, it only maps certificates issued
+// within that trust bundle; serials are only unique per issuer, so Serial entries need a Domain.
+type Entry struct {
+	CommonName string            `json:"cn,omitempty" yaml:"cn,omitempty"`
+	SPIFFEID   string            `json:"spiffe,omitempty" yaml:"spiffe,omitempty"`
+	Serial     string            `json:"serial,omitempty" yaml:"serial,omitempty"`
+	SPKI       string            `json:"spki,omitempty" yaml:"spki,omitempty"`
+	Domain     string            `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Attributes map[string]string `json:"attributes" yaml:"attributes"`
+}
+
+// Store is the content of tenantStorePath.
+type Store struct {
+	Tenants []Entry `json:"tenants" yaml:"tenants"`
+}
+
+// key returns the kind and value the entry matches on.
+func (e Entry) key() (kind, value string, err error) {
+	set := 0
+	for _, k := range []struct{ kind, value string }{{KindCN, e.CommonName}, {KindSPIFFE, e.SPIFFEID}, {KindSerial, e.Serial}, {KindSPKI, e.SPKI}} {
+		if k.value != "" {
+			kind, value = k.kind, k.value
+			set++
+		}
+	}
+	if set != 1 {
+		return "", "", fmt.Errorf("set exactly one of cn, spiffe, serial or spki")
+	}
+
+	switch kind {
+	case KindSPIFFE:
+		id, err := spiffe.Parse(value)
+		if err != nil {
+			return "", "", err
+		}
+		value = id.String()
+	case KindSerial:
+		if e.Domain == "" {
+			return "", "", fmt.Errorf("serial %s needs a domain, serials are only unique per issuer", value)
+		}
+	case KindSPKI:
+		value = strings.ToLower(value)
+	}
+	return kind, value, nil
+}
+
+// entryKey returns the key of the entry matching value of kind within domain, empty for any issuer.
+func entryKey(kind, value, domain string) string {
+	if domain == "" {
+		return kind + "\x00" + value
+	}
+	return kind + "\x00" + value + "\x00" + domain
+}
+
+// header is a tenant attribute sent upstream.
+type header struct {
+	attribute string
+	name      string
+}
+
+var (
+	mu      sync.RWMutex
+	entries = map[string]Entry{} // entryKey -> entry
+	headers []header
+)
+
+// Enabled reports whether tenant mapping is configured.
+func Enabled() bool {
+	return *tenantStorePath != ""
+}
+
+// Init loads the store and reloads it when the file changes. It is a no-op when tenant mapping is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	parsed, err := parseHeaders(*tenantHeaders)
+	if err != nil {
+		return err
+	}
+	headers = parsed
+
+	if err := reload(); err != nil {
+		return err
+	}
+
+	filewatch.Watch(*tenantStorePath, *tenantReloadInterval, reload, func(err error) {
+		log.Error("Failed to reload tenant store, keeping the previous one", "err", err)
+	})
+
+	return nil
+}
+
+func parseHeaders(list string) ([]header, error) {
+	var out []header
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		attr, name, ok := strings.Cut(pair, "=")
+		attr, name = strings.TrimSpace(attr), strings.TrimSpace(name)
+		if !ok || attr == "" || name == "" {
+			return nil, fmt.Errorf("invalid tenantHeaders entry %q, want attribute=header", pair)
+		}
+		out = append(out, header{attribute: attr, name: name})
+	}
+	return out, nil
+}
+
+func reload() error {
+	loaded, err := load(*tenantStorePath)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	entries = loaded
+	mu.Unlock()
+
+	log.Info("Loaded tenant store", "tenants", len(loaded))
+
+	return nil
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func load(path string) (map[string]Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant store %s: %w", path, err)
+	}
+
+	s := &Store{}
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, s)
+	} else {
+		err = json.Unmarshal(data, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tenant store %s: %w", path, err)
+	}
+
+	out := make(map[string]Entry, len(s.Tenants))
+	for i, e := range s.Tenants {
+		kind, value, err := e.key()
+		if err != nil {
+			return nil, fmt.Errorf("tenant #%d in %s: %w", i, path, err)
+		}
+		k := entryKey(kind, value, e.Domain)
+		if _, dup := out[k]; dup {
+			return nil, fmt.Errorf("tenant #%d in %s: duplicate %s %s in domain %q", i, path, kind, value, e.Domain)
+		}
+		out[k] = e
+	}
+
+	return out, nil
+}
+
+// persist writes store to tenantStorePath in the format of its extension.
+func persist(store Store) error {
+	var data []byte
+	var err error
+	if isYAML(*tenantStorePath) {
+		data, err = yaml.Marshal(store)
+	} else {
+		data, err = json.MarshalIndent(store, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(*tenantStorePath, data, 0o644)
+}
+
+// sortedEntries returns the entries in a stable order. The caller must hold mu.
+func sortedEntries() []Entry {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, entries[k])
+	}
+	return out
+}
+
+// Lookup returns the attributes mapped to id, matching its SPKI fingerprint, serial and name (SPIFFE ID or CN)
+// in that order. For each of them an entry of the issuer domain of id wins over one for any issuer.
+func Lookup(id identity.Identity) (map[string]string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	name := struct{ kind, value string }{KindCN, id.CommonName}
+	if !id.SPIFFEID.IsZero() {
+		name = struct{ kind, value string }{KindSPIFFE, id.SPIFFEID.String()}
+	}
+
+	for _, k := range []struct{ kind, value string }{{KindSPKI, id.Fingerprint}, {KindSerial, id.Serial}, name} {
+		if k.value == "" {
+			continue
+		}
+		for _, domain := range []string{id.IssuerDomain, ""} {
+			if e, ok := entries[entryKey(k.kind, k.value, domain)]; ok {
+				return e.Attributes, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Resolve returns the tenant attributes of id. allowed is false when id has no mapping and tenantRequireMapping is set.
+func Resolve(ctx context.Context, id identity.Identity) (attrs map[string]string, allowed bool) {
+	if !Enabled() {
+		return nil, true
+	}
+
+	attrs, ok := Lookup(id)
+	if ok {
+		return attrs, true
+	}
+
+	unmapped.With(fmt.Sprint(*tenantRequireMapping)).Inc()
+	if *tenantRequireMapping {
+		log.WarnContext(ctx, "Certificate has no tenant mapping", "identity", id.Name(), "serial", id.Serial, "issuerDomain", id.IssuerDomain)
+		return nil, false
+	}
+	return nil, true
+}
+
+// SetHeaders sets the configured tenant headers of req from attrs. Headers of attributes attrs lacks are removed,
+// so clients cannot pass their own.
+func SetHeaders(req *fasthttp.Request, attrs map[string]string) {
+	for _, h := range headers {
+		if v, ok := attrs[h.attribute]; ok {
+			req.Header.Set(h.name, v)
+		} else {
+			req.Header.Del(h.name)
+		}
+	}
+}
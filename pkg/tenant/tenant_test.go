@@ -0,0 +1,213 @@
+package tenant
+
+import (
+	"context"
+	"github.com/mygaru/id-check/pkg/identity"
+	"github.com/mygaru/id-check/pkg/spiffe"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const storeYAML = `
+tenants:
+  - cn: partner-a
+    attributes:
+      tenantId: t-1042
+      plan: gold
+  - serial: "42"
+    domain: mygaru
+    attributes:
+      tenantId: t-2001
+      plan: silver
+  - spiffe: spiffe://prod.mygaru.internal/ns/eu/sa/billing
+    attributes:
+      tenantId: t-4000
+  - spki: ABCD
+    attributes:
+      tenantId: t-3000
+`
+
+func useStore(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	prevPath, prevHeaders, prevRequire, prevInterval := *tenantStorePath, *tenantHeaders, *tenantRequireMapping, *tenantReloadInterval
+	*tenantStorePath, *tenantHeaders, *tenantReloadInterval = path, "tenantId=X-Tenant-ID,plan=X-Plan-Tier", 10*time.Millisecond
+	t.Cleanup(func() {
+		*tenantStorePath, *tenantHeaders, *tenantRequireMapping, *tenantReloadInterval = prevPath, prevHeaders, prevRequire, prevInterval
+		mu.Lock()
+		entries = map[string]Entry{}
+		mu.Unlock()
+	})
+
+	require.NoError(t, Init())
+	return path
+}
+
+func TestLookup_Domain(t *testing.T) {
+	useStore(t, "tenants.yaml", storeYAML+`
+  - cn: partner-a
+    domain: partner-ca
+    attributes:
+      tenantId: t-5000
+`)
+
+	attrs, ok := Lookup(identity.Identity{CommonName: "partner-a", IssuerDomain: "partner-ca"})
+	require.True(t, ok)
+	require.Equal(t, "t-5000", attrs["tenantId"])
+
+	// other issuers get the mapping for any issuer
+	attrs, _ = Lookup(identity.Identity{CommonName: "partner-a", IssuerDomain: "mygaru"})
+	require.Equal(t, "t-1042", attrs["tenantId"])
+
+	// serials are only unique per issuer
+	attrs, _ = Lookup(identity.Identity{CommonName: "partner-a", Serial: "42", IssuerDomain: "partner-ca"})
+	require.Equal(t, "t-5000", attrs["tenantId"])
+}
+
+func TestLookup_SPIFFE(t *testing.T) {
+	useStore(t, "tenants.yaml", storeYAML)
+
+	id, err := spiffe.Parse("spiffe://prod.mygaru.internal/ns/eu/sa/billing")
+	require.NoError(t, err)
+	attrs, ok := Lookup(identity.Identity{CommonName: "partner-a", SPIFFEID: id, IssuerDomain: "prod.mygaru.internal"})
+	require.True(t, ok)
+	require.Equal(t, "t-4000", attrs["tenantId"])
+
+	// the CN of an SVID is not its identity
+	other, err := spiffe.Parse("spiffe://prod.mygaru.internal/ns/eu/sa/web")
+	require.NoError(t, err)
+	_, ok = Lookup(identity.Identity{CommonName: "partner-a", SPIFFEID: other, IssuerDomain: "prod.mygaru.internal"})
+	require.False(t, ok)
+}
+
+func TestResolve(t *testing.T) {
+	useStore(t, "tenants.yaml", storeYAML)
+
+	attrs, ok := Resolve(context.Background(), identity.Identity{CommonName: "partner-a", Serial: "1"})
+	require.True(t, ok)
+	require.Equal(t, "t-1042", attrs["tenantId"])
+
+	// the serial mapping is more specific than the CN
+	attrs, _ = Resolve(context.Background(), identity.Identity{CommonName: "partner-a", Serial: "42", IssuerDomain: "mygaru"})
+	require.Equal(t, "t-2001", attrs["tenantId"])
+
+	attrs, _ = Resolve(context.Background(), identity.Identity{CommonName: "partner-a", Serial: "42", IssuerDomain: "mygaru", Fingerprint: "abcd"})
+	require.Equal(t, "t-3000", attrs["tenantId"])
+
+	attrs, ok = Resolve(context.Background(), identity.Identity{CommonName: "unmapped"})
+	require.True(t, ok)
+	require.Nil(t, attrs)
+
+	*tenantRequireMapping = true
+	_, ok = Resolve(context.Background(), identity.Identity{CommonName: "unmapped"})
+	require.False(t, ok)
+}
+
+func TestSetHeaders(t *testing.T) {
+	useStore(t, "tenants.yaml", storeYAML)
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.Set("X-Plan-Tier", "platinum")
+
+	attrs, _ := Lookup(identity.Identity{CommonName: "unmapped", Fingerprint: "abcd"})
+	SetHeaders(req, attrs)
+
+	require.Equal(t, "t-3000", string(req.Header.Peek("X-Tenant-ID")))
+	require.Empty(t, req.Header.Peek("X-Plan-Tier"))
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"none.json":      `{"tenants": [{"attributes": {"tenantId": "t-1"}}]}`,
+		"two.json":       `{"tenants": [{"cn": "a", "serial": "1", "attributes": {"tenantId": "t-1"}}]}`,
+		"duplicate.yaml": "tenants:\n  - cn: a\n  - cn: a\n",
+		"serial.json":    `{"tenants": [{"serial": "1", "attributes": {"tenantId": "t-1"}}]}`,
+		"spiffe.json":    `{"tenants": [{"spiffe": "spiffe://Prod/ns", "attributes": {"tenantId": "t-1"}}]}`,
+		"broken.yaml":    "tenants: [",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err := load(path)
+		require.Error(t, err, name)
+	}
+
+	_, err := parseHeaders("tenantId")
+	require.Error(t, err)
+}
+
+func adminRequest(method, uri, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	AdminHandler(ctx)
+	return ctx
+}
+
+func TestAdminHandler(t *testing.T) {
+	path := useStore(t, "tenants.json", `{"tenants": [{"cn": "partner-a", "attributes": {"tenantId": "t-1042"}}]}`)
+
+	ctx := adminRequest(fasthttp.MethodPut, "/tenants/cn/partner-b", `{"attributes": {"tenantId": "t-7", "plan": "bronze"}}`)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	attrs, ok := Lookup(identity.Identity{CommonName: "partner-b"})
+	require.True(t, ok)
+	require.Equal(t, "bronze", attrs["plan"])
+
+	ctx = adminRequest(fasthttp.MethodDelete, "/tenants/cn/partner-a", "")
+	require.Equal(t, fasthttp.StatusNoContent, ctx.Response.StatusCode())
+	require.Equal(t, fasthttp.StatusNotFound, adminRequest(fasthttp.MethodGet, "/tenants/cn/partner-a", "").Response.StatusCode())
+	require.Equal(t, fasthttp.StatusBadRequest, adminRequest(fasthttp.MethodPut, "/tenants/cn/partner-c", `{}`).Response.StatusCode())
+	require.Equal(t, fasthttp.StatusNotFound, adminRequest(fasthttp.MethodPut, "/tenants/email/x", `{}`).Response.StatusCode())
+	require.Equal(t, fasthttp.StatusBadRequest, adminRequest(fasthttp.MethodPut, "/tenants/serial/42", `{"attributes": {"tenantId": "t-8"}}`).Response.StatusCode())
+
+	// the edits were persisted and survive a reload from the file
+	persisted, err := load(path)
+	require.NoError(t, err)
+	require.Len(t, persisted, 1)
+	require.Equal(t, "t-7", persisted[KindCN+"\x00partner-b"].Attributes["tenantId"])
+
+	ctx = adminRequest(fasthttp.MethodGet, "/tenants", "")
+	require.JSONEq(t, `{"tenants": [{"cn": "partner-b", "attributes": {"tenantId": "t-7", "plan": "bronze"}}]}`, string(ctx.Response.Body()))
+}
+
+func TestAdminHandler_PersistsYAML(t *testing.T) {
+	path := useStore(t, "tenants.yml", storeYAML)
+
+	ctx := adminRequest(fasthttp.MethodPut, "/tenants/spki/EF01", `{"attributes": {"tenantId": "t-9"}}`)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	persisted, err := load(path)
+	require.NoError(t, err)
+	require.Len(t, persisted, 5)
+	require.Equal(t, "t-9", persisted[KindSPKI+"\x00ef01"].Attributes["tenantId"])
+
+	// the normalized path of a SPIFFE ID loses a slash of the scheme, which may also be left out
+	for _, uri := range []string{"/tenants/spiffe/spiffe://prod.mygaru.internal/ns/ops", "/tenants/spiffe/prod.mygaru.internal/ns/ops"} {
+		ctx = adminRequest(fasthttp.MethodPut, uri, `{"attributes": {"tenantId": "t-10"}}`)
+		require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), uri)
+	}
+	persisted, err = load(path)
+	require.NoError(t, err)
+	require.Len(t, persisted, 6)
+	require.Equal(t, "t-10", persisted[KindSPIFFE+"\x00spiffe://prod.mygaru.internal/ns/ops"].Attributes["tenantId"])
+}
+
+func TestHotReload(t *testing.T) {
+	path := useStore(t, "tenants.yaml", storeYAML)
+
+	require.NoError(t, os.WriteFile(path, []byte("tenants:\n  - cn: partner-a\n    attributes:\n      tenantId: t-moved\n"), 0o644))
+	require.Eventually(t, func() bool {
+		attrs, _ := Lookup(identity.Identity{CommonName: "partner-a"})
+		return attrs["tenantId"] == "t-moved"
+	}, 2*time.Second, 10*time.Millisecond)
+}
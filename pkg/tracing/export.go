@@ -0,0 +1,248 @@
+package tracing
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mygaru/id-check/pkg/logger"
+	"github.com/mygaru/id-check/pkg/metrics"
+	"github.com/mygaru/id-check/pkg/proxy"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var log = logger.For(logger.ComponentTracing)
+
+var (
+	tracingExportInterval = flag.Duration("tracingExportInterval", 5*time.Second, "How often queued spans are exported")
+	tracingExportTimeout  = flag.Duration("tracingExportTimeout", 10*time.Second, "How long to wait for the OTLP endpoint to accept a batch")
+	tracingMaxQueueSize   = flag.Int("tracingMaxQueueSize", 4096, "How many finished spans may wait for export; further spans are dropped")
+	tracingMaxBatchSize   = flag.Int("tracingMaxBatchSize", 512, "Max spans per export request")
+)
+
+var (
+	spansExported = metrics.NewCounterVec("idcheck_tracing_spans_exported_total", "Spans accepted by the OTLP endpoint")
+	spansDropped  = metrics.NewCounterVec("idcheck_tracing_spans_dropped_total", "Spans dropped because the export queue was full or the export failed")
+)
+
+var (
+	queueMu sync.Mutex
+	queue   []*Span
+	// exportMu serializes exports so Flush and the periodic export do not interleave batches
+	exportMu sync.Mutex
+)
+
+// Init starts the periodic span export. It is a no-op when tracing is disabled.
+func Init() error {
+	if !Enabled() {
+		return nil
+	}
+
+	if *tracingSampleRatio < 0 || *tracingSampleRatio > 1 {
+		return fmt.Errorf("tracingSampleRatio must be within 0..1, got %v", *tracingSampleRatio)
+	}
+
+	go func() {
+		for range time.Tick(*tracingExportInterval) {
+			if err := Flush(); err != nil {
+				log.Warn("Failed to export spans", "err", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func enqueue(s *Span) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if len(queue) >= *tracingMaxQueueSize {
+		spansDropped.With().Inc()
+		return
+	}
+	queue = append(queue, s)
+}
+
+// Flush exports every queued span.
+func Flush() error {
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	for {
+		queueMu.Lock()
+		n := min(len(queue), *tracingMaxBatchSize)
+		batch := queue[:n:n]
+		queue = queue[n:]
+		queueMu.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		if err := export(batch); err != nil {
+			spansDropped.With().Add(uint64(n))
+			return err
+		}
+		spansExported.With().Add(uint64(n))
+	}
+}
+
+func export(batch []*Span) error {
+	body, err := json.Marshal(encodeOTLP(batch))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer func() {
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}()
+
+	client, err := proxy.GetClient(req, *tracingOTLPEndpoint)
+	if err != nil {
+		return fmt.Errorf("failed to get proxy client: %w", err)
+	}
+
+	req.SetRequestURI(*tracingOTLPEndpoint)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+
+	if err := client.DoTimeout(req, resp, *tracingExportTimeout); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("OTLP endpoint returned %d: %s", resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
+
+// The types below are the OTLP/HTTP JSON encoding of ExportTraceServiceRequest.
+// Trace and span IDs are hex strings and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+func encodeOTLP(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if s.ParentID.IsValid() {
+			out.ParentSpanID = s.ParentID.String()
+		}
+		for _, a := range s.attributes {
+			out.Attributes = append(out.Attributes, keyValue(a.key, a.value))
+		}
+		for _, l := range s.Links {
+			out.Links = append(out.Links, otlpLink{TraceID: l.TraceID.String(), SpanID: l.SpanID.String()})
+		}
+		if s.errMsg != "" {
+			out.Status = otlpStatus{Code: statusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+
+		spans = append(spans, out)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", *tracingServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/mygaru/id-check"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func keyValue(key string, value any) otlpKeyValue {
+	var v otlpValue
+	switch x := value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
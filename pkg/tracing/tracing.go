@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tracingOTLPEndpoint = flag.String("tracingOTLPEndpoint", "", "OTLP/HTTP traces endpoint spans are exported to, e.g. http://otel-collector:4318/v1/traces; empty disables tracing")
+	tracingSampleRatio  = flag.Float64("tracingSampleRatio", 1, "Share of new traces (without a sampled inbound traceparent) that are recorded, 0..1")
+	tracingServiceName  = flag.String("tracingServiceName", "id-check", "service.name resource attribute of exported spans")
+	tracingIdentityAttr = flag.Bool("tracingIdentityAttributes", true, "Whether request spans carry the caller's certificate CN, serial and fingerprint")
+)
+
+// HeaderTraceparent is the W3C Trace Context header.
+const HeaderTraceparent = "traceparent"
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent renders sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. Future versions are parsed
+// by their version 00 prefix, as the specification requires.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, errors.New("traceparent must have 4 fields")
+	}
+
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("unsupported traceparent version %q", version)
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return sc, errors.New("malformed traceparent")
+	}
+	if strings.ToLower(s) != s {
+		return sc, errors.New("traceparent must be lowercase")
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil {
+		return sc, fmt.Errorf("malformed trace-id: %w", err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil {
+		return sc, fmt.Errorf("malformed parent-id: %w", err)
+	}
+
+	var f [1]byte
+	if _, err := hex.Decode(f[:], []byte(flags)); err != nil {
+		return sc, fmt.Errorf("malformed trace-flags: %w", err)
+	}
+	sc.Sampled = f[0]&1 == 1
+
+	if !sc.IsValid() {
+		return sc, errors.New("all-zero trace-id or parent-id")
+	}
+
+	return sc, nil
+}
+
+// Span kinds, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is a timed operation. A nil *Span is a valid no-op span, used when tracing is disabled.
+type Span struct {
+	Name     string
+	Context  SpanContext
+	ParentID SpanID
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Links    []SpanContext
+
+	mu         sync.Mutex
+	attributes []attribute
+	errMsg     string
+	ended      bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Enabled reports whether spans are exported.
+func Enabled() bool {
+	return *tracingOTLPEndpoint != ""
+}
+
+// IdentityAttributes reports whether spans should carry the caller's identity.
+func IdentityAttributes() bool {
+	return *tracingIdentityAttr
+}
+
+// StartSpan starts a span. A valid parent continues its trace and sampling decision,
+// otherwise a new trace is started and sampled according to tracingSampleRatio.
+// It returns nil when tracing is disabled.
+func StartSpan(name string, kind int, parent SpanContext) *Span {
+	if !Enabled() {
+		return nil
+	}
+
+	s := &Span{Name: name, Kind: kind, Start: time.Now()}
+
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.ParentID = parent.SpanID
+	} else {
+		s.Context.TraceID = newTraceID()
+		s.Context.Sampled = sampled(s.Context.TraceID)
+	}
+	s.Context.SpanID = newSpanID()
+
+	return s
+}
+
+// StartChild starts a span within the trace of s.
+func (s *Span) StartChild(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	return StartSpan(name, kind, s.Context)
+}
+
+// SpanContext returns the context of s, or the zero SpanContext for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// SetAttribute sets a string, bool, int or int64 attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// AddLink links s to a span of another trace, e.g. the handshake of the connection.
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Links = append(s.Links, sc)
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errMsg = err.Error()
+}
+
+// Finish ends the span and queues it for export when sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled {
+		enqueue(s)
+	}
+}
+
+func sampled(id TraceID) bool {
+	ratio := *tracingSampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+
+	// same decision as the OpenTelemetry TraceIDRatioBased sampler
+	x := binary.BigEndian.Uint64(id[8:16]) >> 1
+	return x < uint64(ratio*(1<<63))
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
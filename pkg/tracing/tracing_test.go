@@ -0,0 +1,155 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sync"
+	"testing"
+)
+
+// collectorStub is an in-process OTLP/HTTP traces endpoint.
+type collectorStub struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+}
+
+func startCollectorStub(t *testing.T) (*collectorStub, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	c := &collectorStub{}
+	s := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != "/v1/traces" || string(ctx.Request.Header.ContentType()) != "application/json" {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+
+		var req otlpRequest
+		if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.mu.Unlock()
+	}}
+
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	return c, "http://" + ln.Addr().String() + "/v1/traces"
+}
+
+func (c *collectorStub) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []otlpSpan
+	for _, r := range c.requests {
+		for _, rs := range r.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				out = append(out, ss.Spans...)
+			}
+		}
+	}
+	return out
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	// future versions may carry more fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.Nil(t, err)
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestExport(t *testing.T) {
+	collector, endpoint := startCollectorStub(t)
+	*tracingOTLPEndpoint = endpoint
+	defer func() { *tracingOTLPEndpoint = "" }()
+
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handshake := StartSpan("tls.handshake", KindServer, SpanContext{})
+	handshake.Finish()
+
+	request := StartSpan("GET /lookup", KindServer, parent)
+	request.AddLink(handshake.SpanContext())
+	request.SetAttribute("idcheck.client.cn", "DV1")
+	request.SetAttribute("http.response.status_code", 502)
+
+	upstream := request.StartChild("upstream", KindClient)
+	upstream.SetError(errors.New("timeout"))
+	upstream.Finish()
+	request.Finish()
+
+	// not sampled upstream, must not be exported
+	StartSpan("GET /skip", KindServer, SpanContext{TraceID: parent.TraceID, SpanID: parent.SpanID}).Finish()
+
+	assert.Nil(t, Flush())
+
+	spans := collector.spans()
+	assert.Len(t, spans, 3)
+
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	req := byName["GET /lookup"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", req.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", req.ParentSpanID)
+	assert.Equal(t, KindServer, req.Kind)
+	assert.Equal(t, []otlpLink{{TraceID: handshake.Context.TraceID.String(), SpanID: handshake.Context.SpanID.String()}}, req.Links)
+	assert.Equal(t, "DV1", *req.Attributes[0].Value.StringValue)
+	assert.Equal(t, "502", *req.Attributes[1].Value.IntValue)
+
+	up := byName["upstream"]
+	assert.Equal(t, req.TraceID, up.TraceID)
+	assert.Equal(t, req.SpanID, up.ParentSpanID)
+	assert.Equal(t, statusError, up.Status.Code)
+	assert.Equal(t, "timeout", up.Status.Message)
+}
+
+func TestSampleRatio(t *testing.T) {
+	*tracingSampleRatio = 0
+	defer func() { *tracingSampleRatio = 1 }()
+
+	*tracingOTLPEndpoint = "http://127.0.0.1:1/v1/traces"
+	defer func() { *tracingOTLPEndpoint = "" }()
+
+	assert.False(t, StartSpan("new", KindServer, SpanContext{}).Context.Sampled)
+
+	// the sampling decision of the caller wins
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, StartSpan("continued", KindServer, parent).Context.Sampled)
+
+	// a nil span is a no-op
+	var s *Span
+	s.SetAttribute("a", "b")
+	s.Finish()
+	assert.Nil(t, s.StartChild("child", KindInternal))
+}